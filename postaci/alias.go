@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	reverseAliasPrefix = "reply-"
+	aliasAlphabet      = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+const (
+	AliasForwarded   = "forwarded"
+	AliasQuarantined = "quarantined"
+	AliasRejected    = "rejected"
+)
+
+const (
+	defaultAliasRetention       = 7 * 24 * time.Hour
+	defaultAliasCleanupInterval = time.Hour
+)
+
+var aliasLocalPart = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,63}$`)
+
+// Alias is a masked address on our domain that forwards to the real
+// address of its owner.
+type Alias struct {
+	gorm.Model
+	Address     string `gorm:"size:320;uniqueIndex"`
+	Owner       string `gorm:"size:255;index"`
+	Destination string
+	Enabled     bool
+	Description string
+	ExpiresAt   *time.Time
+	// MaxMessages limits how many mails are forwarded, zero means no limit.
+	// The alias expires when the last one arrives.
+	MaxMessages  int
+	MessageCount int
+	// ExpiredAction is AliasQuarantined or AliasRejected.
+	ExpiredAction string `gorm:"size:16;default:quarantined"`
+}
+
+// AliasTombstone keeps the address of a deleted alias, so that mail to it
+// is still rejected and the address is not handed out again.
+type AliasTombstone struct {
+	gorm.Model
+	Address string `gorm:"size:320;uniqueIndex"`
+	AliasID uint
+}
+
+// AliasHit records a mail that arrived on an alias and what was done to it.
+type AliasHit struct {
+	gorm.Model
+	Address string `gorm:"size:320;index"`
+	AliasID uint
+	EmailID uint
+	Sender  string
+	Outcome string
+}
+
+// AliasAdmission is the decision made on a mail for an alias before it is
+// stored.
+type AliasAdmission struct {
+	Alias   *Alias
+	Outcome string
+}
+
+// ReverseAlias stands in for an external contact of an alias. Mail to a
+// contact is shown to the owner as coming from the reverse alias, and mail
+// the owner sends to the reverse alias goes out to the contact from the
+// alias.
+type ReverseAlias struct {
+	gorm.Model
+	Address string `gorm:"size:320;uniqueIndex"`
+	AliasID uint   `gorm:"uniqueIndex:idx_reverse_alias_contact"`
+	Contact string `gorm:"size:320;uniqueIndex:idx_reverse_alias_contact"`
+}
+
+// Active tells whether mail to the alias is forwarded at the given time.
+func (a *Alias) Active(now time.Time) bool {
+	return a.Enabled && (a.ExpiresAt == nil || a.ExpiresAt.After(now))
+}
+
+// expiredOutcome is what is done to mail that arrives on the alias while it
+// is not active.
+func (a *Alias) expiredOutcome() string {
+	if a.ExpiredAction == AliasRejected {
+		return AliasRejected
+	}
+	return AliasQuarantined
+}
+
+type AliasStore interface {
+	CreateAlias(alias *Alias) error
+	SaveAlias(alias *Alias) error
+	DeleteAlias(address string) error
+	// FindAlias returns nil when the address is not an alias.
+	FindAlias(address string) (*Alias, error)
+	ListAliases(owner string, limit, offset int) ([]Alias, error)
+	// FindReverseAlias returns nil when the address is not a reverse alias.
+	FindReverseAlias(address string) (*ReverseAlias, *Alias, error)
+	ReverseAliasFor(alias *Alias, contact string) (*ReverseAlias, error)
+	// FindAliasTombstone returns nil when the address was never a deleted
+	// alias.
+	FindAliasTombstone(address string) (*AliasTombstone, error)
+	// PersistAliasEmail stores a mail admitted for an alias and counts it
+	// against the limit of the alias in the same transaction. When there
+	// is none left, the outcome of the admission turns to what is done to
+	// mail on an expired alias, and rejected mail is not stored.
+	PersistAliasEmail(email *Email, admission *AliasAdmission, now time.Time) error
+	CreateAliasHit(hit *AliasHit) error
+	// FindAliasHit returns the hit of a stored mail, or nil when it did
+	// not arrive on an alias.
+	FindAliasHit(emailID uint) (*AliasHit, error)
+	ListAliasHits(address string, limit, offset int) ([]AliasHit, error)
+	PurgeExpiredAliases(before time.Time) (int64, error)
+}
+
+func (p *Persistence) CreateAlias(alias *Alias) error {
+	return db.Create(alias).Error
+}
+
+func (p *Persistence) SaveAlias(alias *Alias) error {
+	return db.Save(alias).Error
+}
+
+func (p *Persistence) DeleteAlias(address string) error {
+	alias, err := p.FindAlias(address)
+	if err != nil || alias == nil {
+		return err
+	}
+
+	// Aliases are deleted for good, a soft deleted row would still hold the
+	// unique address. The tombstone keeps rejecting it.
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("alias_id = ?", alias.ID).Delete(&ReverseAlias{}).Error; err != nil {
+			return err
+		}
+		tombstone := AliasTombstone{Address: alias.Address, AliasID: alias.ID}
+		if err := tx.Where(AliasTombstone{Address: alias.Address}).FirstOrCreate(&tombstone).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(alias).Error
+	})
+}
+
+func (p *Persistence) FindAlias(address string) (*Alias, error) {
+	var alias Alias
+	result := db.Where("address = ?", normalizeAddress(address)).First(&alias)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &alias, result.Error
+}
+
+func (p *Persistence) ListAliases(owner string, limit, offset int) ([]Alias, error) {
+	query := db.Order("id desc").Limit(limit).Offset(offset)
+	if owner != "" {
+		query = query.Where("owner = ?", owner)
+	}
+
+	var aliases []Alias
+	result := query.Find(&aliases)
+	return aliases, result.Error
+}
+
+func (p *Persistence) FindReverseAlias(address string) (*ReverseAlias, *Alias, error) {
+	var reverse ReverseAlias
+	result := db.Where("address = ?", normalizeAddress(address)).First(&reverse)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil, nil
+	}
+	if result.Error != nil {
+		return nil, nil, result.Error
+	}
+
+	var alias Alias
+	if err := db.First(&alias, reverse.AliasID).Error; err != nil {
+		return nil, nil, err
+	}
+	return &reverse, &alias, nil
+}
+
+func (p *Persistence) ReverseAliasFor(alias *Alias, contact string) (*ReverseAlias, error) {
+	var reverse ReverseAlias
+	result := db.Where(ReverseAlias{AliasID: alias.ID, Contact: normalizeAddress(contact)}).
+		Attrs(ReverseAlias{Address: reverseAliasPrefix + randomLocalPart(16) + "@" + domainOf(alias.Address)}).
+		FirstOrCreate(&reverse)
+	return &reverse, result.Error
+}
+
+func (p *Persistence) FindAliasTombstone(address string) (*AliasTombstone, error) {
+	var tombstone AliasTombstone
+	result := db.Where("address = ?", normalizeAddress(address)).First(&tombstone)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &tombstone, result.Error
+}
+
+func (p *Persistence) PersistAliasEmail(email *Email, admission *AliasAdmission, now time.Time) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if admission.Outcome == AliasForwarded {
+			used, err := useAlias(tx, admission.Alias, now)
+			if err != nil {
+				return err
+			}
+			if !used {
+				admission.Outcome = admission.Alias.expiredOutcome()
+			}
+		}
+		if admission.Outcome == AliasRejected {
+			return nil
+		}
+
+		email.Quarantined = admission.Outcome == AliasQuarantined
+		stored := *email
+		if err := tx.Create(&stored).Error; err != nil {
+			return err
+		}
+		email.ID = stored.ID
+		if err := savePOP3UIDL(tx, stored.Source, stored.UIDL); err != nil {
+			return err
+		}
+		return threadEmail(tx, &stored)
+	})
+}
+
+// useAlias counts a mail against the limit of the alias, and tells false
+// when there is none left.
+func useAlias(tx *gorm.DB, alias *Alias, now time.Time) (bool, error) {
+	result := tx.Model(&Alias{}).
+		Where("id = ? AND (max_messages = 0 OR message_count < max_messages)", alias.ID).
+		Update("message_count", gorm.Expr("message_count + 1"))
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	alias.MessageCount++
+	if alias.MaxMessages > 0 && alias.MessageCount >= alias.MaxMessages {
+		alias.ExpiresAt = &now
+		return true, tx.Model(alias).Update("expires_at", now).Error
+	}
+	return true, nil
+}
+
+func (p *Persistence) CreateAliasHit(hit *AliasHit) error {
+	return db.Create(hit).Error
+}
+
+func (p *Persistence) FindAliasHit(emailID uint) (*AliasHit, error) {
+	var hit AliasHit
+	result := db.Where("email_id = ?", emailID).Order("id desc").First(&hit)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &hit, result.Error
+}
+
+func (p *Persistence) ListAliasHits(address string, limit, offset int) ([]AliasHit, error) {
+	var hits []AliasHit
+	result := db.Where("address = ?", normalizeAddress(address)).Order("id desc").Limit(limit).Offset(offset).Find(&hits)
+	return hits, result.Error
+}
+
+func (p *Persistence) PurgeExpiredAliases(before time.Time) (int64, error) {
+	var aliases []Alias
+	if err := db.Where("expires_at < ?", before).Find(&aliases).Error; err != nil {
+		return 0, err
+	}
+	for _, alias := range aliases {
+		if err := p.DeleteAlias(alias.Address); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(aliases)), nil
+}
+
+// RunAliasCleanup deletes aliases that expired longer than retention ago,
+// until the context is done. Their hits are kept.
+func RunAliasCleanup(ctx context.Context, store AliasStore, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			purged, err := store.PurgeExpiredAliases(time.Now().Add(-retention))
+			if err != nil {
+				logrus.Errorf("something happened while deleting expired aliases: %s", err)
+				continue
+			}
+			if purged > 0 {
+				logrus.WithField("aliases", purged).Info("expired aliases are deleted")
+			}
+		}
+	}
+}
+
+// AliasRelay forwards mail that arrives on aliases and reverse aliases.
+type AliasRelay struct {
+	Deliverer *Deliverer
+	Store     AliasStore
+	// InternalHeaders are removed from relayed mail, defaultInternalHeaders
+	// when empty.
+	InternalHeaders []string
+}
+
+// Admit decides what happens to a mail for an alias before it is stored.
+// The mail is counted against the limit of the alias when it is stored by
+// Persist. Mail to a subaddress of an alias goes to the alias, and mail to
+// a deleted alias is rejected. It returns nil when the recipient is not one.
+func (r *AliasRelay) Admit(email *Email) (*AliasAdmission, error) {
+	addresses := []string{email.To}
+	if email.Mailbox != "" && email.Mailbox != normalizeAddress(email.To) {
+		addresses = append(addresses, email.Mailbox)
+	}
+
+	for _, address := range addresses {
+		alias, err := r.Store.FindAlias(address)
+		if err != nil {
+			return nil, fmt.Errorf("something happened while looking up the alias: %s", err)
+		}
+		if alias != nil {
+			if alias.Active(time.Now()) && (alias.MaxMessages == 0 || alias.MessageCount < alias.MaxMessages) {
+				return &AliasAdmission{Alias: alias, Outcome: AliasForwarded}, nil
+			}
+			return &AliasAdmission{Alias: alias, Outcome: alias.expiredOutcome()}, nil
+		}
+	}
+
+	for _, address := range addresses {
+		tombstone, err := r.Store.FindAliasTombstone(address)
+		if err != nil {
+			return nil, fmt.Errorf("something happened while looking up the deleted alias: %s", err)
+		}
+		if tombstone != nil {
+			alias := &Alias{Model: gorm.Model{ID: tombstone.AliasID}, Address: tombstone.Address, ExpiredAction: AliasRejected}
+			return &AliasAdmission{Alias: alias, Outcome: AliasRejected}, nil
+		}
+	}
+	return nil, nil
+}
+
+// Persist stores a mail admitted for an alias, see PersistAliasEmail.
+func (r *AliasRelay) Persist(email *Email, admission *AliasAdmission) error {
+	return r.Store.PersistAliasEmail(email, admission, time.Now())
+}
+
+// Readmit returns the admission a stored mail got when it arrived, from its
+// hit, or nil when it did not arrive on an alias that still exists.
+func (r *AliasRelay) Readmit(email *Email) (*AliasAdmission, error) {
+	hit, err := r.Store.FindAliasHit(email.ID)
+	if err != nil || hit == nil {
+		return nil, err
+	}
+	alias, err := r.Store.FindAlias(hit.Address)
+	if err != nil || alias == nil {
+		return nil, err
+	}
+	return &AliasAdmission{Alias: alias, Outcome: hit.Outcome}, nil
+}
+
+// RecordHit stores what was done with a mail that arrived on an alias.
+func (r *AliasRelay) RecordHit(admission *AliasAdmission, email *Email) error {
+	logrus.WithFields(logrus.Fields{
+		"alias":   admission.Alias.Address,
+		"sender":  email.From,
+		"outcome": admission.Outcome,
+	}).Info("mail arrived on alias")
+
+	return r.Store.CreateAliasHit(&AliasHit{
+		Address: admission.Alias.Address,
+		AliasID: admission.Alias.ID,
+		EmailID: email.ID,
+		Sender:  email.From,
+		Outcome: admission.Outcome,
+	})
+}
+
+// Relay forwards the stored email when it was admitted for an alias, or
+// when its recipient is a reverse alias, and tells whether it was either.
+func (r *AliasRelay) Relay(ctx context.Context, email *Email, admission *AliasAdmission) (bool, error) {
+	if admission != nil {
+		if admission.Outcome != AliasForwarded {
+			return true, nil
+		}
+		return true, r.forward(ctx, admission.Alias, email)
+	}
+
+	reverse, alias, err := r.Store.FindReverseAlias(email.To)
+	if err != nil {
+		return false, fmt.Errorf("something happened while looking up the reverse alias: %s", err)
+	}
+	if reverse != nil {
+		return true, r.reply(ctx, alias, reverse, email)
+	}
+	return false, nil
+}
+
+// forward sends mail that arrived on an alias to its destination, from a
+// reverse alias of the sender.
+func (r *AliasRelay) forward(ctx context.Context, alias *Alias, email *Email) error {
+	contact, err := aliasContact(email.Content)
+	if err != nil {
+		return fmt.Errorf("cannot read the sender: %s", err)
+	}
+
+	reverse, err := r.Store.ReverseAliasFor(alias, contact.Address)
+	if err != nil {
+		return fmt.Errorf("something happened while creating the reverse alias: %s", err)
+	}
+
+	name := strings.Replace(contact.Address, "@", " at ", 1)
+	if contact.Name != "" {
+		name = contact.Name + " - " + name
+	}
+	content, err := RewriteHeaders(email.Content, HeaderRewrite{
+		StripHeaders: append([]string{"Reply-To"}, r.internalHeaders()...),
+		AddHeaders:   map[string]string{"From": (&mail.Address{Name: name, Address: reverse.Address}).String()},
+	})
+	if err != nil {
+		return err
+	}
+
+	delivery, err := r.Deliverer.Enqueue(ctx, email, alias.Address, alias.Destination, content)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"alias":      alias.Address,
+		"deliveryId": delivery.ID,
+		"status":     delivery.Status,
+	}).Info("mail forwarded through alias")
+	return nil
+}
+
+// reply sends mail the owner wrote to a reverse alias to its contact, from
+// the alias. Nobody but the owner can send through a reverse alias.
+func (r *AliasRelay) reply(ctx context.Context, alias *Alias, reverse *ReverseAlias, email *Email) error {
+	if normalizeAddress(email.From) != normalizeAddress(alias.Destination) {
+		logrus.WithFields(logrus.Fields{
+			"reverseAlias": reverse.Address,
+			"from":         email.From,
+		}).Warn("mail to a reverse alias is not from the owner of the alias")
+		return nil
+	}
+	if !alias.Active(time.Now()) {
+		logrus.WithField("alias", alias.Address).Info("reply through an inactive alias is not sent")
+		return nil
+	}
+
+	content, err := RewriteHeaders(email.Content, HeaderRewrite{
+		StripHeaders: append([]string{"Reply-To", "Sender"}, r.internalHeaders()...),
+		AddHeaders: map[string]string{
+			"From": alias.Address,
+			"To":   reverse.Contact,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	delivery, err := r.Deliverer.Enqueue(ctx, email, alias.Address, reverse.Contact, content)
+	if err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"alias":      alias.Address,
+		"deliveryId": delivery.ID,
+		"status":     delivery.Status,
+	}).Info("reply sent through reverse alias")
+	return nil
+}
+
+func (r *AliasRelay) internalHeaders() []string {
+	if len(r.InternalHeaders) == 0 {
+		return defaultInternalHeaders
+	}
+	return r.InternalHeaders
+}
+
+// aliasContact is who replies to an aliased mail should go to.
+func aliasContact(content []byte) (*mail.Address, error) {
+	parts, err := ReadMailParts(content)
+	if err != nil {
+		return nil, err
+	}
+	if addresses, err := parts.Header.AddressList("Reply-To"); err == nil && len(addresses) > 0 {
+		return addresses[0], nil
+	}
+	addresses, err := parts.Header.AddressList("From")
+	if err != nil {
+		return nil, err
+	}
+	return addresses[0], nil
+}
+
+func randomLocalPart(length int) string {
+	random := make([]byte, length)
+	rand.Read(random)
+	for i := range random {
+		random[i] = aliasAlphabet[int(random[i])%len(aliasAlphabet)]
+	}
+	return string(random)
+}
+
+// validateAliasDestination checks the destination of an alias and returns
+// its bare address. It cannot be on the alias domain, where mail to it would
+// come back to us and loop.
+func (m *mailingServerServer) validateAliasDestination(destination string) (string, error) {
+	address, err := mail.ParseAddress(destination)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid destination: %s", err)
+	}
+	if m.AliasDomain != "" && strings.EqualFold(domainOf(address.Address), m.AliasDomain) {
+		return "", status.Errorf(codes.InvalidArgument, "destination %s is on the alias domain", address.Address)
+	}
+	return address.Address, nil
+}
+
+func (m *mailingServerServer) CreateAlias(ctx context.Context, request *pb.CreateAliasRequest) (*pb.Alias, error) {
+	if m.AliasDomain == "" {
+		return nil, status.Error(codes.FailedPrecondition, "no alias domain is configured")
+	}
+	destination, err := m.validateAliasDestination(request.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	localPart := strings.ToLower(request.LocalPart)
+	if localPart == "" {
+		localPart = randomLocalPart(10)
+	} else if !aliasLocalPart.MatchString(localPart) || strings.HasPrefix(localPart, reverseAliasPrefix) {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid local part %q", request.LocalPart)
+	}
+
+	alias := &Alias{
+		Address:     localPart + "@" + strings.ToLower(m.AliasDomain),
+		Owner:       request.Owner,
+		Destination: destination,
+		Enabled:     true,
+		Description: request.Description,
+		MaxMessages: int(request.MaxMessages),
+	}
+	if request.ExpiresAt != nil {
+		expiresAt := request.ExpiresAt.AsTime()
+		alias.ExpiresAt = &expiresAt
+	}
+	if request.Ttl != nil {
+		if request.Ttl.AsDuration() <= 0 {
+			return nil, status.Error(codes.InvalidArgument, "ttl must be positive")
+		}
+		expiresAt := time.Now().Add(request.Ttl.AsDuration())
+		alias.ExpiresAt = &expiresAt
+	}
+	if request.SingleUse {
+		alias.MaxMessages = 1
+	}
+	if request.ExpiredAction == pb.AliasExpiredAction_ALIAS_EXPIRED_ACTION_REJECT {
+		alias.ExpiredAction = AliasRejected
+	} else {
+		alias.ExpiredAction = AliasQuarantined
+	}
+
+	if existing, err := m.Aliases.FindAlias(alias.Address); err != nil {
+		logrus.Errorf("something happened while looking up the alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if existing != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "alias %s already exists", alias.Address)
+	}
+	if tombstone, err := m.Aliases.FindAliasTombstone(alias.Address); err != nil {
+		logrus.Errorf("something happened while looking up the deleted alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	} else if tombstone != nil {
+		return nil, status.Errorf(codes.AlreadyExists, "alias %s was deleted and cannot be used again", alias.Address)
+	}
+
+	if err := m.Aliases.CreateAlias(alias); err != nil {
+		logrus.Errorf("something happened while creating the alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return aliasToProto(alias), nil
+}
+
+func (m *mailingServerServer) ListAliases(ctx context.Context, request *pb.ListAliasesRequest) (*pb.ListAliasesResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	aliases, err := m.Aliases.ListAliases(request.Owner, limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while listing aliases: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListAliasesResponse{}
+	for i := range aliases {
+		response.Aliases = append(response.Aliases, aliasToProto(&aliases[i]))
+	}
+	return response, nil
+}
+
+func (m *mailingServerServer) UpdateAlias(ctx context.Context, request *pb.UpdateAliasRequest) (*pb.Alias, error) {
+	alias, err := m.Aliases.FindAlias(request.Address)
+	if err != nil {
+		logrus.Errorf("something happened while looking up the alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if alias == nil {
+		return nil, status.Errorf(codes.NotFound, "alias %s is not found", request.Address)
+	}
+
+	if request.Destination != "" {
+		destination, err := m.validateAliasDestination(request.Destination)
+		if err != nil {
+			return nil, err
+		}
+		alias.Destination = destination
+	}
+	if request.Description != "" {
+		alias.Description = request.Description
+	}
+	switch request.State {
+	case pb.AliasState_ALIAS_STATE_ENABLED:
+		alias.Enabled = true
+	case pb.AliasState_ALIAS_STATE_DISABLED:
+		alias.Enabled = false
+	}
+	if request.ClearExpiry {
+		alias.ExpiresAt = nil
+	} else if request.ExpiresAt != nil {
+		expiresAt := request.ExpiresAt.AsTime()
+		alias.ExpiresAt = &expiresAt
+	}
+
+	if err = m.Aliases.SaveAlias(alias); err != nil {
+		logrus.Errorf("something happened while updating the alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return aliasToProto(alias), nil
+}
+
+func (m *mailingServerServer) DeleteAlias(ctx context.Context, request *pb.DeleteAliasRequest) (*pb.DeleteAliasResponse, error) {
+	if err := m.Aliases.DeleteAlias(request.Address); err != nil {
+		logrus.Errorf("something happened while deleting the alias: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DeleteAliasResponse{}, nil
+}
+
+func (m *mailingServerServer) ListAliasHits(ctx context.Context, request *pb.ListAliasHitsRequest) (*pb.ListAliasHitsResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	hits, err := m.Aliases.ListAliasHits(request.Address, limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while listing alias hits: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListAliasHitsResponse{}
+	for _, hit := range hits {
+		response.Hits = append(response.Hits, &pb.AliasHit{
+			Address:   hit.Address,
+			MailId:    uint64(hit.EmailID),
+			Sender:    hit.Sender,
+			Outcome:   hit.Outcome,
+			CreatedAt: timestamppb.New(hit.CreatedAt),
+		})
+	}
+	return response, nil
+}
+
+func aliasToProto(alias *Alias) *pb.Alias {
+	message := &pb.Alias{
+		Address:      alias.Address,
+		Owner:        alias.Owner,
+		Destination:  alias.Destination,
+		Enabled:      alias.Enabled,
+		Description:  alias.Description,
+		CreatedAt:    timestamppb.New(alias.CreatedAt),
+		MaxMessages:  uint32(alias.MaxMessages),
+		MessageCount: uint32(alias.MessageCount),
+	}
+	if alias.ExpiredAction == AliasRejected {
+		message.ExpiredAction = pb.AliasExpiredAction_ALIAS_EXPIRED_ACTION_REJECT
+	}
+	if alias.ExpiresAt != nil {
+		message.ExpiresAt = timestamppb.New(*alias.ExpiresAt)
+	}
+	return message
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAliasRelayHidesTheDestination(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	sender := &FakeMailSender{}
+	relay := &AliasRelay{
+		Deliverer: &Deliverer{Sender: sender, Store: &FakeDeliveryStore{}},
+		Store:     persistence,
+	}
+	alias := &Alias{Address: "shop@alias.test", Destination: "ali@example.com", Enabled: true}
+	if err := persistence.CreateAlias(alias); err != nil {
+		t.Fatalf("cannot create the alias: %s", err)
+	}
+
+	inbound := &Email{
+		From: "news@shop.example",
+		To:   "shop@alias.test",
+		Content: []byte("From: Shop <news@shop.example>\n" +
+			"To: shop@alias.test\n" +
+			"X-Original-To: shop@alias.test\n" +
+			"Subject: Deals\n" +
+			"\n" +
+			"buy now\n"),
+	}
+	admission, err := relay.Admit(inbound)
+	if err != nil || admission == nil || admission.Outcome != AliasForwarded {
+		t.Fatalf("expected the mail to be admitted, but got %+v and %v", admission, err)
+	}
+	if handled, err := relay.Relay(context.Background(), inbound, admission); !handled || err != nil {
+		t.Fatalf("expected the mail to be forwarded, but got %v and %v", handled, err)
+	}
+
+	parts, err := ReadMailParts(sender.mail)
+	if err != nil {
+		t.Fatalf("cannot read the forwarded mail: %s", err)
+	}
+	from, err := parts.Header.AddressList("From")
+	if err != nil || !strings.HasPrefix(from[0].Address, reverseAliasPrefix) || from[0].Name != "Shop - news at shop.example" {
+		t.Fatalf("expected the mail to come from a reverse alias, but got %v", parts.Header.Get("From"))
+	}
+	if sender.recipients[0] != "ali@example.com" || parts.Header.Get("X-Original-To") != "" {
+		t.Errorf("unexpected forward to %v with header %v", sender.recipients, parts.Header)
+	}
+
+	reply := &Email{
+		From: "ali@example.com",
+		To:   from[0].Address,
+		Content: []byte("From: Ali <ali@example.com>\n" +
+			"To: " + from[0].String() + "\n" +
+			"Subject: Re: Deals\n" +
+			"\n" +
+			"no thanks\n"),
+	}
+	if _, err = relay.Relay(context.Background(), reply, nil); err != nil {
+		t.Fatalf("cannot relay the reply: %s", err)
+	}
+	if sender.recipients[1] != "news@shop.example" || strings.Contains(string(sender.mail), "ali@example.com") {
+		t.Errorf("expected the reply to reach the contact without the real address, but got:\n%s", sender.mail)
+	}
+
+	reply.From = "someone@else.example"
+	if _, err = relay.Relay(context.Background(), reply, nil); err != nil || sender.sends != 2 {
+		t.Errorf("expected mail to a reverse alias from anyone but the owner to be dropped")
+	}
+}
+
+func TestSingleUseAliasExpiresAfterItsMail(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	relay := &AliasRelay{Store: persistence}
+	if err := persistence.CreateAlias(&Alias{Address: "signup@alias.test", Destination: "ali@example.com", Enabled: true, MaxMessages: 1, ExpiredAction: AliasRejected}); err != nil {
+		t.Fatalf("cannot create the alias: %s", err)
+	}
+	email := &Email{From: "verify@site.example", To: "Signup@alias.test"}
+
+	first, err := relay.Admit(email)
+	if err != nil || first.Outcome != AliasForwarded {
+		t.Fatalf("expected the first mail to be forwarded, but got %+v and %v", first, err)
+	}
+	second, err := relay.Admit(email)
+	if err != nil || second.Outcome != AliasForwarded {
+		t.Fatalf("expected the alias not to be used before the mail is stored, but got %+v and %v", second, err)
+	}
+
+	// The first mail is stored and takes the only use of the alias.
+	db.Model(&Alias{}).Where("id = ?", first.Alias.ID).Updates(map[string]interface{}{"message_count": 1, "expires_at": time.Now()})
+	if err = relay.RecordHit(first, email); err != nil {
+		t.Fatalf("cannot record the hit: %s", err)
+	}
+
+	if err = relay.Persist(email, second); err != nil || second.Outcome != AliasRejected || email.ID != 0 {
+		t.Fatalf("expected the second mail to be rejected without being stored, but got %+v, %d and %v", second, email.ID, err)
+	}
+	if err = relay.RecordHit(second, email); err != nil {
+		t.Fatalf("cannot record the hit: %s", err)
+	}
+	if third, _ := relay.Admit(email); third.Outcome != AliasRejected {
+		t.Errorf("expected the used up alias to reject mail, but got %+v", third)
+	}
+
+	hits, err := persistence.ListAliasHits("signup@alias.test", 10, 0)
+	if err != nil || len(hits) != 2 || hits[0].Outcome != AliasRejected || hits[1].Outcome != AliasForwarded {
+		t.Errorf("expected both mails to be recorded, but got %+v and %v", hits, err)
+	}
+
+	if purged, err := persistence.PurgeExpiredAliases(time.Now().Add(time.Minute)); err != nil || purged != 1 {
+		t.Errorf("expected the used up alias to be deleted, but got %d and %v", purged, err)
+	}
+	if deleted, err := relay.Admit(email); err != nil || deleted == nil || deleted.Outcome != AliasRejected {
+		t.Errorf("expected mail to the deleted alias to be rejected, but got %+v and %v", deleted, err)
+	}
+
+	server := &mailingServerServer{Aliases: persistence, AliasDomain: "alias.test"}
+	if _, err = server.CreateAlias(context.Background(), &pb.CreateAliasRequest{LocalPart: "signup", Destination: "veli@example.com"}); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("expected the address of a deleted alias not to be used again, but got %v", err)
+	}
+}
+
+func TestAliasRelayDefersFailedForwards(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	store := &FakeDeliveryStore{}
+	sender := &FakeMailSender{err: &SendError{Kind: ConnectionError, Stage: StageConnect, Err: errors.New("connection refused")}}
+	relay := &AliasRelay{
+		Deliverer: &Deliverer{Sender: sender, Store: store},
+		Store:     persistence,
+	}
+	alias := &Alias{Address: "deferred@alias.test", Destination: "ali@example.com", Enabled: true}
+	if err := persistence.CreateAlias(alias); err != nil {
+		t.Fatalf("cannot create the alias: %s", err)
+	}
+
+	inbound := &Email{
+		From:    "news@shop.example",
+		To:      "deferred@alias.test",
+		Content: []byte("From: news@shop.example\nTo: deferred@alias.test\nSubject: Deals\n\nbuy now\n"),
+	}
+	admission, _ := relay.Admit(inbound)
+	if handled, err := relay.Relay(context.Background(), inbound, admission); !handled || err != nil {
+		t.Fatalf("expected a relay that is down not to fail the mail, but got %v and %v", handled, err)
+	}
+	if len(store.deliveries) != 1 || store.deliveries[0].Status != DeliveryDeferred {
+		t.Fatalf("expected the forward to be deferred, but got %+v", store.deliveries)
+	}
+
+	sender.err = nil
+	now := time.Now()
+	store.deliveries[0].NextAttemptAt = &now
+	relay.Deliverer.RetryDeferred(context.Background())
+	if sender.sends != 2 || sender.recipients[1] != "ali@example.com" {
+		t.Errorf("expected the forward to be sent when it is retried, but got %v", sender.recipients)
+	}
+}
+
+func TestAliasDestinationCannotBeOnTheAliasDomain(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	server := &mailingServerServer{Aliases: persistence, AliasDomain: "loop.test"}
+
+	if _, err := server.CreateAlias(context.Background(), &pb.CreateAliasRequest{Destination: "other@Loop.test"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a destination on the alias domain to be refused, but got %v", err)
+	}
+
+	alias, err := server.CreateAlias(context.Background(), &pb.CreateAliasRequest{Destination: "ali@example.com"})
+	if err != nil {
+		t.Fatalf("cannot create the alias: %s", err)
+	}
+	if _, err = server.UpdateAlias(context.Background(), &pb.UpdateAliasRequest{Address: alias.Address, Destination: alias.Address}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected an alias not to be pointed at the alias domain, but got %v", err)
+	}
+}
+
+func TestAliasDestinationIsStoredWithoutItsName(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	server := &mailingServerServer{Aliases: persistence, AliasDomain: "named.test"}
+
+	alias, err := server.CreateAlias(context.Background(), &pb.CreateAliasRequest{Destination: "Bob <bob@example.org>"})
+	if err != nil {
+		t.Fatalf("cannot create the alias: %s", err)
+	}
+	if alias.Destination != "bob@example.org" {
+		t.Errorf("expected the destination to be the bare address, but got %q", alias.Destination)
+	}
+
+	alias, err = server.UpdateAlias(context.Background(), &pb.UpdateAliasRequest{Address: alias.Address, Destination: "\"Ali Veli\" <ali@example.com>"})
+	if err != nil {
+		t.Fatalf("cannot update the alias: %s", err)
+	}
+	if stored, _ := persistence.FindAlias(alias.Address); stored == nil || stored.Destination != "ali@example.com" {
+		t.Errorf("expected the updated destination to be the bare address, but got %+v", stored)
+	}
+}
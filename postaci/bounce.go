@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const DeliveryBounced = "bounced"
+
+// Bounce is a single recipient of a delivery status notification.
+type Bounce struct {
+	gorm.Model
+	// A report is recorded once, so that a notification that is ingested
+	// again does not bounce the delivery twice.
+	DeliveryID     uint   `gorm:"index;uniqueIndex:idx_bounce_report"`
+	Recipient      string `gorm:"size:320;uniqueIndex:idx_bounce_report"`
+	Action         string
+	Status         string `gorm:"size:32;uniqueIndex:idx_bounce_report"`
+	DiagnosticCode string
+}
+
+// DeliveryReport is what a RFC 3464 delivery status notification says about
+// the mail it refers to.
+type DeliveryReport struct {
+	EnvelopeID        string
+	OriginalMessageID string
+	Recipients        []RecipientStatus
+}
+
+type RecipientStatus struct {
+	FinalRecipient    string
+	OriginalRecipient string
+	Action            string
+	Status            string
+	DiagnosticCode    string
+}
+
+func (r RecipientStatus) Failed() bool {
+	return strings.EqualFold(r.Action, "failed")
+}
+
+// ParseDeliveryReport reads a delivery status notification. It returns nil
+// without an error when the content is some other kind of mail.
+func ParseDeliveryReport(content []byte) (*DeliveryReport, error) {
+	report := &DeliveryReport{}
+	isReport, err := walkReport(content, "delivery-status", func(partType string, body *bufio.Reader) error {
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			return report.readStatusFields(body)
+		case "message/rfc822", "message/global", "text/rfc822-headers", "message/global-headers":
+			header, _ := textproto.NewReader(body).ReadMIMEHeader()
+			report.OriginalMessageID = trimMessageID(header.Get("Message-Id"))
+		}
+		return nil
+	})
+	if err != nil || !isReport {
+		return nil, err
+	}
+	return report, nil
+}
+
+// walkReport calls visit with the decoded body of every part of a RFC 6522
+// multipart/report of the given report type. It reports false when the
+// content is not such a report.
+func walkReport(content []byte, reportType string, visit func(partType string, body *bufio.Reader) error) (bool, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return false, err
+	}
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/report" || !strings.EqualFold(params["report-type"], reportType) {
+		return false, nil
+	}
+
+	parts := multipart.NewReader(message.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return true, fmt.Errorf("cannot read the %s report: %s", reportType, err)
+		}
+
+		partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body := bufio.NewReader(decodeTransferEncoding(part.Header.Get("Content-Transfer-Encoding"), part))
+		if err = visit(partType, body); err != nil {
+			return true, err
+		}
+	}
+}
+
+// readStatusFields reads the per-message block followed by one block per
+// recipient, each being a header like list of fields.
+func (r *DeliveryReport) readStatusFields(body *bufio.Reader) error {
+	reader := textproto.NewReader(body)
+
+	for first := true; ; first = false {
+		fields, err := reader.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("cannot read the delivery status fields: %s", err)
+		}
+
+		if first {
+			r.EnvelopeID = fields.Get("Original-Envelope-Id")
+		} else if len(fields) > 0 {
+			r.Recipients = append(r.Recipients, RecipientStatus{
+				FinalRecipient:    typedValue(fields.Get("Final-Recipient")),
+				OriginalRecipient: typedValue(fields.Get("Original-Recipient")),
+				Action:            strings.ToLower(fields.Get("Action")),
+				Status:            fields.Get("Status"),
+				DiagnosticCode:    typedValue(fields.Get("Diagnostic-Code")),
+			})
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// typedValue strips the address or diagnostic type from values like
+// "rfc822; ali@example.com".
+func typedValue(value string) string {
+	if _, v, ok := strings.Cut(value, ";"); ok {
+		return strings.TrimSpace(v)
+	}
+	return strings.TrimSpace(value)
+}
+
+// HandleBounce matches every recipient of the report with the delivery it
+// is about, marks failed deliveries as bounced and emits a bounce event for
+// them. bounceRecipient is the address the notification was sent to, which
+// carries the delivery token when VERP is used. It reports whether the
+// notification belonged to any of our deliveries at all. A notification that
+// is handled again changes and announces nothing.
+func HandleBounce(producer MessageProducer, tokens *DeliveryTokens, bounceRecipient string, report *DeliveryReport) (bool, error) {
+	matched := false
+
+	for _, status := range report.Recipients {
+		delivery, err := FindBouncedDelivery(tokens, bounceRecipient, report, status)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return matched, err
+		}
+		matched = true
+
+		bounced, err := recordBounce(delivery, status)
+		if err != nil {
+			return matched, err
+		}
+		if !bounced {
+			continue
+		}
+
+		// The bounce is recorded already, and would not be announced again
+		// if the notification were ingested again.
+		if err = EmitBounceMessage(producer, delivery.ID, delivery.Recipient, status.Status); err != nil {
+			logrus.WithField("deliveryId", delivery.ID).Errorf("something happened while announcing the bounce: %s", err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"deliveryId": delivery.ID,
+			"recipient":  delivery.Recipient,
+			"status":     status.Status,
+		}).Info("delivery bounced")
+	}
+
+	return matched, nil
+}
+
+// recordBounce records a recipient status of a delivery, and marks the
+// delivery as bounced and suppresses its recipient when the status is a
+// failure. It tells whether the delivery is bounced now, and does nothing
+// when the status is recorded already.
+func recordBounce(delivery *Delivery, status RecipientStatus) (bool, error) {
+	bounced := false
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&Bounce{}).Where("delivery_id = ? AND recipient = ? AND status = ?", delivery.ID, delivery.Recipient, status.Status).Count(&count).Error
+		if err != nil || count > 0 {
+			return err
+		}
+
+		bounce := Bounce{
+			DeliveryID:     delivery.ID,
+			Recipient:      delivery.Recipient,
+			Action:         status.Action,
+			Status:         status.Status,
+			DiagnosticCode: status.DiagnosticCode,
+		}
+		if err = tx.Create(&bounce).Error; err != nil {
+			return err
+		}
+		if !status.Failed() {
+			return nil
+		}
+
+		delivery.Status = DeliveryBounced
+		delivery.LastError = strings.TrimSpace(status.Status + " " + status.DiagnosticCode)
+		if err = tx.Save(delivery).Error; err != nil {
+			return err
+		}
+		if isHardBounce(status.Status) {
+			if err = suppressAddress(tx, delivery.Recipient, delivery.LastError, SuppressionSourceBounce, nil); err != nil {
+				return err
+			}
+		}
+		bounced = true
+		return nil
+	})
+	return bounced, err
+}
+
+// FindBouncedDelivery looks for the delivery a recipient status refers to.
+// The delivery is taken from the signed token of the VERP address or the
+// envelope id when there is one, otherwise the original Message-Id is used
+// to find the email. Either way the delivery must be to the recipient the
+// status is about, so that a notification cannot bounce someone else.
+func FindBouncedDelivery(tokens *DeliveryTokens, bounceRecipient string, report *DeliveryReport, status RecipientStatus) (*Delivery, error) {
+	var ids []uint64
+	if id, ok := tokens.VERPDeliveryID(bounceRecipient); ok {
+		ids = append(ids, id)
+	}
+	if id, ok := tokens.DeliveryID(report.EnvelopeID); ok {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		var delivery Delivery
+		if err := db.First(&delivery, id).Error; err == nil && status.concerns(delivery.Recipient) {
+			return &delivery, nil
+		}
+	}
+
+	if report.OriginalMessageID == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var email Email
+	if err := db.Where("message_id = ?", report.OriginalMessageID).Order("id desc").First(&email).Error; err != nil {
+		return nil, err
+	}
+
+	var deliveries []Delivery
+	if err := db.Where("email_id = ?", email.ID).Order("id desc").Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	for i := range deliveries {
+		if status.concerns(deliveries[i].Recipient) {
+			return &deliveries[i], nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r RecipientStatus) concerns(recipient string) bool {
+	return strings.EqualFold(r.FinalRecipient, recipient) || strings.EqualFold(r.OriginalRecipient, recipient)
+}
+
+// DeliveryTokens signs delivery ids into the envelope ids, and so the VERP
+// addresses, of outgoing mail like "42.1f2e3d4c5b6a7988", so that ids
+// cannot be guessed and notifications can only name deliveries we sent.
+// Nothing is trusted without a Secret.
+type DeliveryTokens struct {
+	Secret []byte
+	// ReturnPath is the VERP return path, like bounces@example.com.
+	ReturnPath string
+}
+
+// Token is the envelope id of a delivery.
+func (t *DeliveryTokens) Token(deliveryID uint) string {
+	id := strconv.FormatUint(uint64(deliveryID), 10)
+	if t == nil || len(t.Secret) == 0 {
+		return id
+	}
+	return id + "." + t.signature(id)
+}
+
+// DeliveryID verifies a token and tells the delivery it was made for.
+func (t *DeliveryTokens) DeliveryID(token string) (uint64, bool) {
+	if t == nil || len(t.Secret) == 0 {
+		return 0, false
+	}
+	id, signature, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(signature), []byte(t.signature(id))) {
+		return 0, false
+	}
+	deliveryID, err := strconv.ParseUint(id, 10, 64)
+	return deliveryID, err == nil
+}
+
+// VERPDeliveryID tells the delivery of a VERP address, which must be the
+// return path with a valid token, like bounces+42.1f2e3d4c5b6a7988@example.com.
+func (t *DeliveryTokens) VERPDeliveryID(addr string) (uint64, bool) {
+	if t == nil || t.ReturnPath == "" {
+		return 0, false
+	}
+	at, returnAt := strings.LastIndex(addr, "@"), strings.LastIndex(t.ReturnPath, "@")
+	if at < 0 || returnAt < 0 || !strings.EqualFold(addr[at:], t.ReturnPath[returnAt:]) {
+		return 0, false
+	}
+	local, token, ok := strings.Cut(addr[:at], "+")
+	if !ok || !strings.EqualFold(local, t.ReturnPath[:returnAt]) {
+		return 0, false
+	}
+	return t.DeliveryID(token)
+}
+
+func (t *DeliveryTokens) signature(id string) string {
+	mac := hmac.New(sha256.New, t.Secret)
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// VERPSender replaces the envelope sender with a VERP address like
+// bounces+42.1f2e3d4c5b6a7988@example.com, where the token is the envelope
+// id of the context, so that bounces can be traced back to the delivery
+// even when the remote server does not support DSN.
+type VERPSender struct {
+	MailSender
+	ReturnPath string
+}
+
+func (v *VERPSender) Send(ctx context.Context, sender, recipientAddr string, mail []byte) error {
+	if envelopeID := envelopeIDFromContext(ctx); envelopeID != "" && v.ReturnPath != "" {
+		sender = verpAddress(v.ReturnPath, envelopeID)
+	}
+	return v.MailSender.Send(ctx, sender, recipientAddr, mail)
+}
+
+func verpAddress(returnPath, envelopeID string) string {
+	at := strings.LastIndex(returnPath, "@")
+	if at < 0 {
+		return returnPath
+	}
+	return fmt.Sprintf("%s+%s%s", returnPath[:at], envelopeID, returnPath[at:])
+}
+
+func EmitBounceMessage(producer MessageProducer, deliveryId uint, recipient, status string) error {
+	return producer.Produce(context.Background(), "bounce", fmt.Sprintf("%v|%s|%s", deliveryId, recipient, status))
+}
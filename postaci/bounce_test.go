@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+const sampleDeliveryStatusNotification = "From: MAILER-DAEMON@relay.example.com\r\n" +
+	"To: bounces+%s@example.com\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status; boundary=\"BOUNDARY\"\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not be delivered.\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; relay.example.com\r\n" +
+	"Original-Envelope-Id: %s\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.org\r\n" +
+	"Original-Recipient: rfc822; nobody@example.org\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 user unknown\r\n" +
+	"\r\n" +
+	"--BOUNDARY\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"Message-Id: <original@example.com>\r\n" +
+	"Subject: hello\r\n" +
+	"\r\n" +
+	"--BOUNDARY--\r\n"
+
+func TestParseDeliveryReport(t *testing.T) {
+	report, err := ParseDeliveryReport([]byte(fmt.Sprintf(sampleDeliveryStatusNotification, "7", "7")))
+	if err != nil || report == nil {
+		t.Fatalf("expected a delivery report, but got %v and %v", report, err)
+	}
+
+	if report.EnvelopeID != "7" || report.OriginalMessageID != "original@example.com" {
+		t.Errorf("unexpected envelope id %s and message id %s", report.EnvelopeID, report.OriginalMessageID)
+	}
+	if len(report.Recipients) != 1 {
+		t.Fatalf("expected a single recipient, but got %d", len(report.Recipients))
+	}
+
+	recipient := report.Recipients[0]
+	if recipient.FinalRecipient != "nobody@example.org" || recipient.Status != "5.1.1" || !recipient.Failed() {
+		t.Errorf("unexpected recipient status %+v", recipient)
+	}
+	if recipient.DiagnosticCode != "550 5.1.1 user unknown" {
+		t.Errorf("unexpected diagnostic code %s", recipient.DiagnosticCode)
+	}
+}
+
+func TestParseDeliveryReportIgnoresOrdinaryMail(t *testing.T) {
+	report, err := ParseDeliveryReport([]byte("From: a@example.com\r\nSubject: hi\r\n\r\nhello\r\n"))
+	if err != nil || report != nil {
+		t.Errorf("expected ordinary mail not to be a delivery report, but got %v and %v", report, err)
+	}
+}
+
+func TestDeliveryTokens(t *testing.T) {
+	tokens := &DeliveryTokens{Secret: []byte("secret"), ReturnPath: "bounces@example.com"}
+
+	token := tokens.Token(42)
+	if id, ok := tokens.DeliveryID(token); !ok || id != 42 {
+		t.Errorf("expected the token %s to be for delivery 42, but got %d", token, id)
+	}
+	if id, ok := tokens.VERPDeliveryID(verpAddress(tokens.ReturnPath, token)); !ok || id != 42 {
+		t.Errorf("expected the VERP address to be for delivery 42, but got %d", id)
+	}
+
+	forged := []string{"42", "43" + token[2:], token + "0"}
+	for _, token := range forged {
+		if _, ok := tokens.DeliveryID(token); ok {
+			t.Errorf("expected the forged token %s to be rejected", token)
+		}
+	}
+	for _, addr := range []string{"anyone+" + token + "@example.com", "bounces+" + token + "@example.org", "bounces+42@example.com"} {
+		if _, ok := tokens.VERPDeliveryID(addr); ok {
+			t.Errorf("expected %s not to be a VERP address of ours", addr)
+		}
+	}
+	if _, ok := (&DeliveryTokens{ReturnPath: "bounces@example.com"}).VERPDeliveryID("bounces+42@example.com"); ok {
+		t.Errorf("expected ids not to be trusted without a secret")
+	}
+}
+
+func TestHandleBounceMarksDeliveryAsBounced(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	delivery := &Delivery{Sender: "contact@example.com", Recipient: "nobody@example.org", Status: DeliverySent}
+	if err := persistence.CreateDelivery(delivery); err != nil {
+		t.Fatalf("cannot create delivery: %s", err)
+	}
+	tokens := &DeliveryTokens{Secret: []byte("secret"), ReturnPath: "bounces@example.com"}
+	token := tokens.Token(delivery.ID)
+
+	content := fmt.Sprintf(sampleDeliveryStatusNotification, token, "0")
+	report, _ := ParseDeliveryReport([]byte(content))
+	producer := &FakeMessageProducer{}
+
+	matched, err := HandleBounce(producer, tokens, verpAddress(tokens.ReturnPath, token), report)
+	if err != nil || !matched {
+		t.Fatalf("expected the bounce to match the delivery, but got %v and %v", matched, err)
+	}
+
+	var bounced Delivery
+	db.First(&bounced, delivery.ID)
+	if bounced.Status != DeliveryBounced {
+		t.Errorf("expected the delivery to be bounced, but got %s", bounced.Status)
+	}
+	if !producer.IsCalledWith("bounce", fmt.Sprintf("%v|nobody@example.org|5.1.1", delivery.ID)) {
+		t.Errorf("bounce event is not emitted with correct arguments")
+	}
+
+	producer = &FakeMessageProducer{}
+	if matched, err = HandleBounce(producer, tokens, verpAddress(tokens.ReturnPath, token), report); err != nil || !matched {
+		t.Fatalf("expected the bounce to match the delivery again, but got %v and %v", matched, err)
+	}
+	var bounces int64
+	db.Model(&Bounce{}).Where("delivery_id = ?", delivery.ID).Count(&bounces)
+	if bounces != 1 || producer.isCalled {
+		t.Errorf("expected a notification ingested again to be recorded and announced once, but got %d bounces", bounces)
+	}
+}
+
+func TestHandleBounceIgnoresForgedReports(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	delivery := &Delivery{Sender: "contact@example.com", Recipient: "someone@example.org", Status: DeliverySent}
+	if err := persistence.CreateDelivery(delivery); err != nil {
+		t.Fatalf("cannot create delivery: %s", err)
+	}
+	tokens := &DeliveryTokens{Secret: []byte("secret"), ReturnPath: "bounces@example.com"}
+	id := fmt.Sprint(delivery.ID)
+
+	reports := map[string]string{
+		// The ids are not signed.
+		"bounces+" + id + "@example.com": fmt.Sprintf(sampleDeliveryStatusNotification, id, id),
+		// The token is valid, but the report is about someone else.
+		verpAddress(tokens.ReturnPath, tokens.Token(delivery.ID)): fmt.Sprintf(sampleDeliveryStatusNotification, tokens.Token(delivery.ID), tokens.Token(delivery.ID)),
+	}
+	for bounceRecipient, content := range reports {
+		report, _ := ParseDeliveryReport([]byte(content))
+		producer := &FakeMessageProducer{}
+		if matched, err := HandleBounce(producer, tokens, bounceRecipient, report); err != nil || matched {
+			t.Errorf("expected the report to %s not to match, but got %v and %v", bounceRecipient, matched, err)
+		}
+	}
+
+	var delivered Delivery
+	db.First(&delivered, delivery.ID)
+	if delivered.Status != DeliverySent {
+		t.Errorf("expected the delivery not to be bounced, but got %s", delivered.Status)
+	}
+}
+
+func TestDelivererSuppressesHardBouncedRecipients(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	rejecting := &FakeMailSender{err: &SendError{Kind: RejectedError, Stage: StageRcpt, Code: 550, EnhancedCode: "5.1.1", Message: "5.1.1 user unknown", Err: errors.New("550 5.1.1 user unknown")}}
+	deliverer := &Deliverer{Sender: rejecting, Store: &FakeDeliveryStore{}, Suppressions: persistence}
+	email := &Email{From: "contact@example.com", Content: []byte("hello")}
+
+	if _, err := deliverer.Deliver(context.Background(), email, email.From, "Gone@Example.org", email.Content); err == nil {
+		t.Fatalf("expected the rejection to be returned")
+	}
+
+	_, err := deliverer.Deliver(context.Background(), email, email.From, "gone@example.org", email.Content)
+	var suppressedErr *SuppressedError
+	if !errors.As(err, &suppressedErr) {
+		t.Fatalf("expected the recipient to be suppressed, but got %v", err)
+	}
+	if rejecting.sends != 1 {
+		t.Errorf("expected the suppressed recipient not to reach the relay again")
+	}
+
+	persistence.Unsuppress("gone@example.org")
+	if suppression, _ := persistence.FindSuppression("gone@example.org"); suppression != nil {
+		t.Errorf("expected the suppression to be removed")
+	}
+}
+
+func TestParseFeedbackReport(t *testing.T) {
+	content := "From: fbl@isp.example\r\n" +
+		"Content-Type: multipart/report; report-type=feedback-report; boundary=\"B\"\r\n" +
+		"\r\n" +
+		"--B\r\n" +
+		"Content-Type: message/feedback-report\r\n" +
+		"\r\n" +
+		"Feedback-Type: abuse\r\n" +
+		"Version: 1\r\n" +
+		"Original-Rcpt-To: <angry@isp.example>\r\n" +
+		"\r\n" +
+		"--B\r\n" +
+		"Content-Type: message/rfc822\r\n" +
+		"\r\n" +
+		"Message-Id: <original@example.com>\r\n" +
+		"To: angry@isp.example\r\n" +
+		"\r\n" +
+		"hello\r\n" +
+		"--B--\r\n"
+
+	report, err := ParseFeedbackReport([]byte(content))
+	if err != nil || report == nil {
+		t.Fatalf("expected a feedback report, but got %v and %v", report, err)
+	}
+	if report.FeedbackType != "abuse" || report.OriginalRecipient != "<angry@isp.example>" || report.OriginalMessageID != "original@example.com" {
+		t.Errorf("unexpected feedback report %+v", report)
+	}
+}
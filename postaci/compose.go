@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Attachment is a file attached to a composed message. Attachments of type
+// message/rfc822 are embedded as they are, anything else is base64 encoded.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// OutgoingMessage is a message composed by us, as opposed to the mail we
+// receive and store as it is.
+type OutgoingMessage struct {
+	From        mail.Address
+	To          []mail.Address
+	Cc          []mail.Address
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []Attachment
+	// Headers are added as they are, after the standard fields.
+	Headers   map[string]string
+	MessageID string
+	Date      time.Time
+	// InReplyTo and References are message ids without angle brackets.
+	InReplyTo  string
+	References []string
+}
+
+// composedHeaders are the fields a message writes itself, which its Headers
+// cannot add a second time.
+var composedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Subject": true, "Date": true,
+	"Message-Id": true, "In-Reply-To": true, "References": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// validateCustomHeader checks a field that is added to a message we compose.
+func validateCustomHeader(name, value string) error {
+	if composedHeaders[textproto.CanonicalMIMEHeaderKey(name)] {
+		return fmt.Errorf("header %s is written by the message itself", name)
+	}
+	return validateHeader(name, value)
+}
+
+// Bytes renders the message as MIME with CRLF line endings. Message-ID and
+// Date are generated when they are not set.
+func (m *OutgoingMessage) Bytes() ([]byte, error) {
+	if m.MessageID == "" {
+		m.MessageID = generateMessageID(m.From.Address)
+	}
+	if m.Date.IsZero() {
+		m.Date = time.Now()
+	}
+
+	// Every value is checked before anything is written, so that a line
+	// break cannot start a field of its own, like a Bcc.
+	fields := [][2]string{
+		{"From", m.From.String()},
+		{"To", addressList(m.To)},
+		{"Cc", addressList(m.Cc)},
+		{"Subject", m.Subject},
+		{"Message-ID", m.MessageID},
+		{"In-Reply-To", m.InReplyTo},
+	}
+	for _, reference := range m.References {
+		fields = append(fields, [2]string{"References", reference})
+	}
+	for _, field := range fields {
+		if err := validateHeader(field[0], field[1]); err != nil {
+			return nil, err
+		}
+	}
+	for name, value := range m.Headers {
+		if err := validateCustomHeader(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	writeField(&out, "From", m.From.String(), "\r\n")
+	if len(m.To) > 0 {
+		writeField(&out, "To", addressList(m.To), "\r\n")
+	}
+	if len(m.Cc) > 0 {
+		writeField(&out, "Cc", addressList(m.Cc), "\r\n")
+	}
+	writeField(&out, "Subject", encodeHeaderValue(m.Subject), "\r\n")
+	writeField(&out, "Date", m.Date.Format(time.RFC1123Z), "\r\n")
+	writeField(&out, "Message-ID", "<"+m.MessageID+">", "\r\n")
+	if m.InReplyTo != "" {
+		writeField(&out, "In-Reply-To", "<"+m.InReplyTo+">", "\r\n")
+	}
+	if len(m.References) > 0 {
+		writeField(&out, "References", "<"+strings.Join(m.References, ">\r\n <")+">", "\r\n")
+	}
+
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(&out, name, encodeHeaderValue(m.Headers[name]), "\r\n")
+	}
+
+	writeField(&out, "MIME-Version", "1.0", "\r\n")
+
+	bodyHeader, body, err := m.body()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(m.Attachments) == 0 {
+		writeMIMEHeader(&out, bodyHeader)
+		out.WriteString("\r\n")
+		out.Write(body)
+		return out.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&out)
+	writeField(&out, "Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mixed.Boundary()}), "\r\n")
+	out.WriteString("\r\n")
+
+	part, err := mixed.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(body); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range m.Attachments {
+		if err = writeAttachment(mixed, attachment); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = mixed.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// body renders the text parts, as multipart/alternative when there is both
+// a text and an HTML version, and returns them with their MIME header.
+func (m *OutgoingMessage) body() (textproto.MIMEHeader, []byte, error) {
+	if m.HTML == "" || m.Text == "" {
+		contentType, content := "text/plain", m.Text
+		if m.HTML != "" {
+			contentType, content = "text/html", m.HTML
+		}
+		return textPart(contentType, content)
+	}
+
+	var out bytes.Buffer
+	alternative := multipart.NewWriter(&out)
+	for _, version := range []struct{ contentType, content string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		header, body, err := textPart(version.contentType, version.content)
+		if err != nil {
+			return nil, nil, err
+		}
+		part, err := alternative.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err = part.Write(body); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type": {mime.FormatMediaType("multipart/alternative", map[string]string{"boundary": alternative.Boundary()})},
+	}
+	return header, out.Bytes(), nil
+}
+
+func textPart(contentType, content string) (textproto.MIMEHeader, []byte, error) {
+	var body bytes.Buffer
+	w := quotedprintable.NewWriter(&body)
+	if _, err := w.Write(toCRLF([]byte(content))); err != nil {
+		return nil, nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	}
+	return header, body.Bytes(), nil
+}
+
+func writeMIMEHeader(out *bytes.Buffer, header textproto.MIMEHeader) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			writeField(out, name, value, "\r\n")
+		}
+	}
+}
+
+func writeAttachment(w *multipart.Writer, attachment Attachment) error {
+	contentType := attachment.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if err := validateHeader("Content-Type", contentType); err != nil {
+		return err
+	}
+
+	disposition := "attachment"
+	if attachment.Filename != "" {
+		disposition = mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename})
+	}
+
+	header := textproto.MIMEHeader{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {disposition},
+	}
+
+	// RFC 2046 does not allow encoding message/rfc822, so it goes as it is
+	// with its line endings made consistent.
+	if strings.EqualFold(contentType, "message/rfc822") {
+		encoding := "7bit"
+		if has8Bit(attachment.Content) {
+			encoding = "8bit"
+		}
+		header.Set("Content-Transfer-Encoding", encoding)
+
+		part, err := w.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		_, err = part.Write(toCRLF(attachment.Content))
+		return err
+	}
+
+	header.Set("Content-Transfer-Encoding", "base64")
+	part, err := w.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	encoded := base64.StdEncoding.EncodeToString(attachment.Content)
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(part, "%s\r\n", encoded)
+	return err
+}
+
+func addressList(addresses []mail.Address) string {
+	formatted := make([]string, len(addresses))
+	for i := range addresses {
+		formatted[i] = addresses[i].String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+func toCRLF(content []byte) []byte {
+	normalized := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(normalized, []byte("\n"), []byte("\r\n"))
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	DeliveryPending  = "pending"
+	DeliverySent     = "sent"
+	DeliveryDeferred = "deferred"
+	DeliveryFailed   = "failed"
+)
+
+const (
+	defaultMaxDeliveryAttempts = 10
+	defaultRetryBackoff        = time.Minute
+	maxRetryBackoff            = 6 * time.Hour
+	defaultRetryInterval       = 15 * time.Second
+)
+
+// Delivery is a single attempt to get an Email to a recipient, including the
+// retries after it was deferred.
+type Delivery struct {
+	gorm.Model
+	EmailID       uint `gorm:"index"`
+	Sender        string
+	Recipient     string
+	Status        string `gorm:"index"`
+	Attempts      int
+	NextAttemptAt *time.Time `gorm:"index"`
+	LastError     string
+	// Content is only kept when the mail sent differs from the content of
+	// the email, like a forward with rewritten headers.
+	Content []byte
+}
+
+type DeliveryStore interface {
+	CreateDelivery(delivery *Delivery) error
+	SaveDelivery(delivery *Delivery) error
+	FindDueDeliveries(now time.Time, limit int) ([]Delivery, error)
+}
+
+// Deliverer sends mail through a MailSender and keeps track of every send as
+// a Delivery. Mail that cannot be sent right now, like mail held back by a
+// rate limit, is deferred and picked up again by RetryDeferred.
+type Deliverer struct {
+	Sender       MailSender
+	Store        DeliveryStore
+	EmailFinder  EmailFinder
+	Suppressions SuppressionList
+	// Tokens sign the envelope ids of the deliveries.
+	Tokens *DeliveryTokens
+
+	MaxAttempts  int
+	RetryBackoff time.Duration
+}
+
+// Deliver sends content, which is the email itself or a mail made from it,
+// to the recipient. A deferred delivery is not an error, the status of the
+// returned delivery tells whether it was sent. Suppressed recipients are
+// refused with a SuppressedError.
+func (d *Deliverer) Deliver(ctx context.Context, email *Email, sender, recipient string, content []byte) (*Delivery, error) {
+	return d.deliver(ctx, email, sender, recipient, content, DeliveryPending)
+}
+
+// Enqueue is Deliver for mail nobody waits on, like mail relayed through an
+// alias. A temporary failure of the first attempt defers the delivery, so
+// that RetryDeferred tries it again, instead of failing it.
+func (d *Deliverer) Enqueue(ctx context.Context, email *Email, sender, recipient string, content []byte) (*Delivery, error) {
+	return d.deliver(ctx, email, sender, recipient, content, DeliveryDeferred)
+}
+
+func (d *Deliverer) deliver(ctx context.Context, email *Email, sender, recipient string, content []byte, status string) (*Delivery, error) {
+	if d.Suppressions != nil {
+		suppression, err := d.Suppressions.FindSuppression(recipient)
+		if err != nil {
+			return nil, fmt.Errorf("something happened while checking the suppression list: %s", err)
+		}
+		if suppression != nil {
+			return nil, &SuppressedError{Suppression: suppression}
+		}
+	}
+
+	delivery := &Delivery{
+		EmailID:   email.ID,
+		Sender:    sender,
+		Recipient: recipient,
+		Status:    status,
+	}
+	if !bytes.Equal(content, email.Content) {
+		delivery.Content = content
+	}
+	if err := d.Store.CreateDelivery(delivery); err != nil {
+		return nil, fmt.Errorf("something happened while recording the delivery: %s", err)
+	}
+
+	err := d.attempt(ctx, delivery, content)
+	return delivery, err
+}
+
+// RetryDeferred makes another attempt at every deferred delivery that is due.
+func (d *Deliverer) RetryDeferred(ctx context.Context) {
+	deliveries, err := d.Store.FindDueDeliveries(time.Now(), 100)
+	if err != nil {
+		logrus.Errorf("something happened while fetching deferred deliveries: %s", err)
+		return
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+
+		content := delivery.Content
+		if content == nil {
+			email, err := d.EmailFinder.FindEmail(uint64(delivery.EmailID))
+			if err != nil {
+				logrus.WithField("deliveryId", delivery.ID).Errorf("something happened while fetching mail content from database: %s", err)
+				continue
+			}
+			content = email.Content
+		}
+		if content == nil {
+			d.discard(delivery, "the content of the mail is purged")
+			continue
+		}
+
+		if err = d.attempt(ctx, delivery, content); err != nil {
+			logrus.WithField("deliveryId", delivery.ID).Warnf("deferred delivery failed: %s", err)
+		}
+	}
+}
+
+// RunRetries calls RetryDeferred once per interval until the context is done.
+func (d *Deliverer) RunRetries(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.RetryDeferred(ctx)
+		}
+	}
+}
+
+func (d *Deliverer) attempt(ctx context.Context, delivery *Delivery, content []byte) error {
+	start := time.Now()
+
+	envelopeCtx := WithEnvelopeID(ctx, d.Tokens.Token(delivery.ID))
+	err := d.Sender.Send(envelopeCtx, delivery.Sender, delivery.Recipient, content)
+	delivery.Attempts++
+
+	var rateLimitErr *RateLimitError
+	var sendErr *SendError
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySent
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	case errors.As(err, &rateLimitErr):
+		// Hitting a limit is not a failed attempt, the mail simply has to wait.
+		delivery.Attempts--
+		d.postpone(delivery, rateLimitErr.RetryAfter, err)
+		err = nil
+	case delivery.Status == DeliveryDeferred && errors.As(err, &sendErr) && sendErr.Temporary() && delivery.Attempts < d.maxAttempts():
+		d.postpone(delivery, d.backoff(delivery.Attempts), err)
+		err = nil
+	default:
+		delivery.Status = DeliveryFailed
+		delivery.NextAttemptAt = nil
+		delivery.LastError = err.Error()
+		d.suppressIfHardBounce(delivery, err)
+	}
+
+	deliveryMetrics.Add(delivery.Status, 1)
+	if saveErr := d.Store.SaveDelivery(delivery); saveErr != nil {
+		logrus.WithField("deliveryId", delivery.ID).Errorf("something happened while updating the delivery: %s", saveErr)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"deliveryId": delivery.ID,
+		"recipient":  delivery.Recipient,
+		"status":     delivery.Status,
+		"attempts":   delivery.Attempts,
+		"elapsed":    time.Since(start),
+	}).Debug("delivery attempted")
+	return err
+}
+
+// discard fails a delivery for good without attempting it.
+func (d *Deliverer) discard(delivery *Delivery, reason string) {
+	delivery.Status = DeliveryFailed
+	delivery.NextAttemptAt = nil
+	delivery.LastError = reason
+	deliveryMetrics.Add(delivery.Status, 1)
+	if err := d.Store.SaveDelivery(delivery); err != nil {
+		logrus.WithField("deliveryId", delivery.ID).Errorf("something happened while updating the delivery: %s", err)
+	}
+	logrus.WithField("deliveryId", delivery.ID).Warnf("deferred delivery failed: %s", reason)
+}
+
+// suppressIfHardBounce puts the recipient on the suppression list when the
+// relay refused it for good.
+func (d *Deliverer) suppressIfHardBounce(delivery *Delivery, err error) {
+	var sendErr *SendError
+	if d.Suppressions == nil || !errors.As(err, &sendErr) || sendErr.Stage != StageRcpt || !sendErr.Permanent() {
+		return
+	}
+	if sendErr.EnhancedCode != "" && !isHardBounce(sendErr.EnhancedCode) {
+		return
+	}
+
+	if err := d.Suppressions.Suppress(delivery.Recipient, sendErr.Message, SuppressionSourceSMTP, nil); err != nil {
+		logrus.WithField("deliveryId", delivery.ID).Errorf("something happened while suppressing the recipient: %s", err)
+	}
+}
+
+func (d *Deliverer) postpone(delivery *Delivery, wait time.Duration, reason error) {
+	next := time.Now().Add(wait)
+	delivery.Status = DeliveryDeferred
+	delivery.NextAttemptAt = &next
+	delivery.LastError = reason.Error()
+}
+
+func (d *Deliverer) backoff(attempts int) time.Duration {
+	base := d.RetryBackoff
+	if base <= 0 {
+		base = defaultRetryBackoff
+	}
+	backoff := time.Duration(float64(base) * math.Pow(2, float64(attempts-1)))
+	if backoff <= 0 || backoff > maxRetryBackoff {
+		return maxRetryBackoff
+	}
+	return backoff
+}
+
+func (d *Deliverer) maxAttempts() int {
+	if d.MaxAttempts <= 0 {
+		return defaultMaxDeliveryAttempts
+	}
+	return d.MaxAttempts
+}
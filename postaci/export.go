@@ -0,0 +1,393 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultExportPageSize = 500
+	exportChunkSize       = 64 * 1024
+
+	exportMboxFilename     = "emails.mbox"
+	exportZipFilename      = "emails.zip"
+	exportManifestFilename = "manifest.json"
+)
+
+// ExportManifest describes an export, with the metadata of every mail in
+// it. File is where the mail is in the export, the .eml file in a zip or
+// "emails.mbox#N" for the Nth message of an mbox. Mail whose content is
+// purged is listed as purged, without a file, and is not counted.
+type ExportManifest struct {
+	ExportedAt time.Time       `json:"exportedAt"`
+	Format     string          `json:"format"`
+	Filter     EmailFilter     `json:"filter"`
+	Count      int             `json:"count"`
+	Emails     []ExportedEmail `json:"emails"`
+}
+
+type ExportedEmail struct {
+	MailID     uint      `json:"mailId"`
+	File       string    `json:"file"`
+	MessageID  string    `json:"messageId"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Mailbox    string    `json:"mailbox"`
+	Subaddress string    `json:"subaddress,omitempty"`
+	Subject    string    `json:"subject"`
+	SentDate   time.Time `json:"sentDate"`
+	Direction  string    `json:"direction"`
+	ThreadID   uint      `json:"threadId,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Size       int       `json:"size"`
+	SHA256     string    `json:"sha256"`
+	Purged     bool      `json:"purged,omitempty"`
+}
+
+// Exporter writes the stored mail that matches a filter to an mbox file or
+// a zip of .eml files. Mail is read a page at a time, so that exporting a
+// whole mailbox does not hold it in memory.
+type Exporter struct {
+	Emails   EmailSearcher
+	PageSize int
+}
+
+// ExportMbox writes the mail as mboxrd, where body lines like "From " and
+// ">From " are quoted with one more '>'.
+func (e *Exporter) ExportMbox(filter EmailFilter, w io.Writer) (*ExportManifest, error) {
+	manifest := newExportManifest("mbox", filter)
+	writer := bufio.NewWriter(w)
+
+	err := e.each(filter, func(email *Email) error {
+		if email.Content == nil {
+			manifest.purged(email)
+			return nil
+		}
+		manifest.add(email, fmt.Sprintf("%s#%d", exportMboxFilename, manifest.Count+1))
+		return writeMboxMessage(writer, email)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, writer.Flush()
+}
+
+// ExportZip writes every mail as a .eml file named after its ID, followed
+// by manifest.json.
+func (e *Exporter) ExportZip(filter EmailFilter, w io.Writer) (*ExportManifest, error) {
+	manifest := newExportManifest("eml", filter)
+	archive := zip.NewWriter(w)
+
+	err := e.each(filter, func(email *Email) error {
+		if email.Content == nil {
+			manifest.purged(email)
+			return nil
+		}
+		filename := fmt.Sprintf("%d.eml", email.ID)
+		manifest.add(email, filename)
+
+		file, err := archive.CreateHeader(&zip.FileHeader{Name: filename, Method: zip.Deflate, Modified: email.SentDate})
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(email.Content)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := archive.Create(exportManifestFilename)
+	if err != nil {
+		return nil, err
+	}
+	if err = manifest.Write(file); err != nil {
+		return nil, err
+	}
+	return manifest, archive.Close()
+}
+
+// each calls cb with every mail that matches the filter, with its content,
+// which is read a page at a time. Pages follow the last mail of the previous
+// page, so that mail arriving or purged during the export does not make
+// another mail be skipped or exported twice.
+func (e *Exporter) each(filter EmailFilter, cb func(email *Email) error) error {
+	pageSize := e.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultExportPageSize
+	}
+
+	for {
+		emails, err := e.Emails.FindEmails(filter, pageSize, 0)
+		if err != nil {
+			return err
+		}
+
+		ids := make([]uint, len(emails))
+		for i := range emails {
+			ids[i] = emails[i].ID
+		}
+		contents, err := e.Emails.FindEmailContents(ids)
+		if err != nil {
+			return fmt.Errorf("cannot read the content of the mail: %w", err)
+		}
+
+		for i := range emails {
+			emails[i].Content = contents[emails[i].ID]
+			if err = cb(&emails[i]); err != nil {
+				return err
+			}
+		}
+
+		if len(emails) < pageSize {
+			return nil
+		}
+		last := emails[len(emails)-1]
+		filter.After = &EmailCursor{SentDate: last.SentDate, ID: last.ID}
+	}
+}
+
+func newExportManifest(format string, filter EmailFilter) *ExportManifest {
+	return &ExportManifest{ExportedAt: time.Now().UTC(), Format: format, Filter: filter, Emails: []ExportedEmail{}}
+}
+
+func (m *ExportManifest) add(email *Email, file string) {
+	sum := sha256.Sum256(email.Content)
+	m.Count++
+	m.Emails = append(m.Emails, ExportedEmail{
+		MailID:     email.ID,
+		File:       file,
+		MessageID:  email.MessageID,
+		From:       email.From,
+		To:         email.To,
+		Mailbox:    email.Mailbox,
+		Subaddress: email.Subaddress,
+		Subject:    email.Subject,
+		SentDate:   email.SentDate,
+		Direction:  email.Direction,
+		ThreadID:   email.ThreadID,
+		Source:     email.Source,
+		Size:       len(email.Content),
+		SHA256:     hex.EncodeToString(sum[:]),
+	})
+}
+
+// purged lists mail whose content is purged, which is not in the export.
+func (m *ExportManifest) purged(email *Email) {
+	m.Emails = append(m.Emails, ExportedEmail{
+		MailID:     email.ID,
+		MessageID:  email.MessageID,
+		From:       email.From,
+		To:         email.To,
+		Mailbox:    email.Mailbox,
+		Subaddress: email.Subaddress,
+		Subject:    email.Subject,
+		SentDate:   email.SentDate,
+		Direction:  email.Direction,
+		ThreadID:   email.ThreadID,
+		Source:     email.Source,
+		Purged:     true,
+	})
+}
+
+func (m *ExportManifest) Write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(m)
+}
+
+func writeMboxMessage(w *bufio.Writer, email *Email) error {
+	sender := email.From
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	fmt.Fprintf(w, "From %s %s\n", sender, email.SentDate.UTC().Format(time.ANSIC))
+
+	content := bytes.ReplaceAll(email.Content, []byte("\r\n"), []byte("\n"))
+	for len(content) > 0 {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); i >= 0 {
+			line = content[:i+1]
+		}
+		content = content[len(line):]
+
+		if mboxQuotedFrom.Match(line) || bytes.HasPrefix(line, []byte("From ")) {
+			w.WriteByte('>')
+		}
+		w.Write(line)
+		if line[len(line)-1] != '\n' {
+			w.WriteByte('\n')
+		}
+	}
+
+	// A blank line separates the message from the next "From " line.
+	_, err := w.WriteString("\n")
+	return err
+}
+
+// chunkWriter sends what is written to it as chunks of a file.
+type chunkWriter struct {
+	filename string
+	stream   pb.MailingServer_ExportEmailsServer
+}
+
+func (c *chunkWriter) Write(data []byte) (int, error) {
+	if err := c.stream.Send(&pb.ExportEmailsChunk{Filename: c.filename, Data: data}); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (m *mailingServerServer) ExportEmails(request *pb.ExportEmailsRequest, stream pb.MailingServer_ExportEmailsServer) error {
+	filter := EmailFilter{
+		Mailbox:    request.Mailbox,
+		Subaddress: request.Subaddress,
+		To:         request.To,
+		From:       request.From,
+		Direction:  request.Direction,
+	}
+	if request.Since != nil {
+		since := request.Since.AsTime()
+		filter.Since = &since
+	}
+	if request.Until != nil {
+		until := request.Until.AsTime()
+		filter.Until = &until
+	}
+
+	exporter := &Exporter{Emails: m.Emails}
+	start := time.Now()
+
+	var manifest *ExportManifest
+	var err error
+	switch request.Format {
+	case pb.ExportFormat_EXPORT_FORMAT_MBOX:
+		archive := bufio.NewWriterSize(&chunkWriter{filename: exportMboxFilename, stream: stream}, exportChunkSize)
+		if manifest, err = exporter.ExportMbox(filter, archive); err == nil {
+			err = archive.Flush()
+		}
+		if err == nil {
+			file := bufio.NewWriterSize(&chunkWriter{filename: exportManifestFilename, stream: stream}, exportChunkSize)
+			if err = manifest.Write(file); err == nil {
+				err = file.Flush()
+			}
+		}
+	case pb.ExportFormat_EXPORT_FORMAT_EML_ZIP:
+		archive := bufio.NewWriterSize(&chunkWriter{filename: exportZipFilename, stream: stream}, exportChunkSize)
+		if manifest, err = exporter.ExportZip(filter, archive); err == nil {
+			err = archive.Flush()
+		}
+	default:
+		return status.Errorf(codes.InvalidArgument, "export format %v is not supported", request.Format)
+	}
+	if err != nil {
+		logrus.Errorf("something happened while exporting emails: %s", err)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"format":  manifest.Format,
+		"count":   manifest.Count,
+		"elapsed": time.Since(start),
+	}).Info("emails are exported")
+	return nil
+}
+
+// runExport is the export subcommand:
+//
+//	postaci export [-format mbox|eml] [-mailbox address] [-since 2024-01-01] -output path
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "mbox", "mbox, or eml for a zip of .eml files")
+	output := flags.String("output", "", "the file the mail is written to")
+	manifestPath := flags.String("manifest", "", "the file the manifest of an mbox export is written to, the output with .json by default")
+	var filter EmailFilter
+	flags.StringVar(&filter.Mailbox, "mailbox", "", "the recipient without its subaddress")
+	flags.StringVar(&filter.Subaddress, "subaddress", "", "the subaddress of the recipient")
+	flags.StringVar(&filter.To, "to", "", "the recipient")
+	flags.StringVar(&filter.From, "from", "", "the sender")
+	flags.StringVar(&filter.Direction, "direction", "", "inbound or outbound")
+	since := flags.String("since", "", "the earliest sent date, like 2024-01-01 or 2024-01-01T00:00:00Z")
+	until := flags.String("until", "", "the sent date mail is sent before")
+	flags.Parse(args)
+	if *output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if filter.Since, err = parseExportDate(*since); err != nil {
+		logrus.Fatalf("cannot read the since date: %s", err)
+	}
+	if filter.Until, err = parseExportDate(*until); err != nil {
+		logrus.Fatalf("cannot read the until date: %s", err)
+	}
+
+	persistence := &Persistence{}
+	persistence.Initialize(os.Getenv("MYSQL_DSN"))
+	exporter := &Exporter{Emails: persistence}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		logrus.Fatalf("cannot create %s: %s", *output, err)
+	}
+	defer file.Close()
+
+	var manifest *ExportManifest
+	switch *format {
+	case "mbox":
+		if manifest, err = exporter.ExportMbox(filter, file); err != nil {
+			break
+		}
+		if *manifestPath == "" {
+			*manifestPath = *output + ".json"
+		}
+		var manifestFile *os.File
+		if manifestFile, err = os.Create(*manifestPath); err != nil {
+			break
+		}
+		defer manifestFile.Close()
+		err = manifest.Write(manifestFile)
+	case "eml":
+		manifest, err = exporter.ExportZip(filter, file)
+	default:
+		logrus.Fatalf("export format %s is not supported", *format)
+	}
+	if err != nil {
+		logrus.Fatalf("something happened while exporting emails: %s", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"format": manifest.Format,
+		"count":  manifest.Count,
+		"output": *output,
+	}).Info("emails are exported")
+}
+
+func parseExportDate(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if date, err = time.Parse("2006-01-02", value); err != nil {
+			return nil, err
+		}
+	}
+	return &date, nil
+}
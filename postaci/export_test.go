@@ -0,0 +1,178 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"google.golang.org/grpc"
+)
+
+func (f *FakeEmailStore) FindEmails(filter EmailFilter, limit, offset int) ([]Email, error) {
+	var emails []Email
+	after := filter.After == nil
+	for _, email := range f.emails {
+		if !after {
+			after = email.ID == filter.After.ID
+			continue
+		}
+		if filter.Mailbox == "" || email.Mailbox == filter.Mailbox || email.Direction == EmailOutbound && email.From == filter.Mailbox {
+			summary := *email
+			summary.Content = nil
+			emails = append(emails, summary)
+		}
+	}
+	if offset >= len(emails) {
+		return nil, nil
+	}
+	if emails = emails[offset:]; len(emails) > limit {
+		emails = emails[:limit]
+	}
+	return emails, nil
+}
+
+func (f *FakeEmailStore) FindEmailContents(ids []uint) (map[uint][]byte, error) {
+	contents := map[uint][]byte{}
+	for _, id := range ids {
+		if content := f.emails[id-1].Content; content != nil {
+			contents[id] = content
+		}
+	}
+	return contents, nil
+}
+
+type FakeExportStream struct {
+	grpc.ServerStream
+	files map[string]*bytes.Buffer
+	order []string
+}
+
+func (f *FakeExportStream) Send(chunk *pb.ExportEmailsChunk) error {
+	if f.files == nil {
+		f.files = map[string]*bytes.Buffer{}
+	}
+	if _, ok := f.files[chunk.Filename]; !ok {
+		f.files[chunk.Filename] = &bytes.Buffer{}
+		f.order = append(f.order, chunk.Filename)
+	}
+	f.files[chunk.Filename].Write(chunk.Data)
+	return nil
+}
+
+func exportTestStore() *FakeEmailStore {
+	store := &FakeEmailStore{}
+	mails := []string{
+		"From: ali@example.org\nX-Original-To: legal@example.com\nMessage-Id: <first@example.org>\nSubject: first\n\nFrom the start\n>From a quote\n",
+		"From: ali@example.org\r\nX-Original-To: legal+case@example.com\r\nMessage-Id: <second@example.org>\r\nSubject: second\r\n\r\nhello\r\n",
+		"From: ali@example.org\nX-Original-To: other@example.com\nMessage-Id: <third@example.org>\nSubject: third\n\nbye",
+	}
+	for _, content := range mails {
+		email, _ := ParseEmail([]byte(content))
+		email.Mailbox, email.Subaddress = splitSubaddress(email.To, defaultSubaddressDelimiters)
+		store.CreateEmail(&email)
+	}
+
+	sent, _ := ParseEmail([]byte("From: legal@example.com\nTo: ali@example.org\nMessage-Id: <sent@example.com>\nSubject: Re: first\n\nnoted\n"))
+	sent.To, sent.Direction = "ali@example.org", EmailOutbound
+	store.CreateEmail(&sent)
+	return store
+}
+
+func TestExportMboxIsImportedBack(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+
+	store := exportTestStore()
+	exporter := &Exporter{Emails: store, PageSize: 1}
+
+	var mbox bytes.Buffer
+	manifest, err := exporter.ExportMbox(EmailFilter{Mailbox: "legal@example.com"}, &mbox)
+	if err != nil {
+		t.Fatalf("cannot export the mail: %s", err)
+	}
+	if manifest.Count != 3 || manifest.Emails[1].File != "emails.mbox#2" || manifest.Emails[1].Subaddress != "case" || manifest.Emails[2].Direction != EmailOutbound {
+		t.Errorf("expected the manifest to list the mails received by the mailbox and sent from it, but got %+v", manifest)
+	}
+
+	filepath := path.Join(directory, "emails.mbox")
+	if err = os.WriteFile(filepath, mbox.Bytes(), 0o600); err != nil {
+		t.Fatalf("cannot write the mbox: %s", err)
+	}
+	imported := &FakeImportStore{}
+	if err = (&Importer{Store: imported}).Import(context.Background(), filepath); err != nil {
+		t.Fatalf("cannot import the mbox: %s", err)
+	}
+
+	if len(imported.emails) != 3 {
+		t.Fatalf("expected 3 mails to be imported back, but got %d", len(imported.emails))
+	}
+	if content := string(imported.emails[0].Content); content != string(store.emails[0].Content) {
+		t.Errorf("expected the quoted lines to survive the round trip, but got %q", content)
+	}
+	if subject := imported.emails[1].Subject; subject != "second" {
+		t.Errorf("expected the second mail to be imported back, but got %q", subject)
+	}
+}
+
+func TestExportEmailsStreamsAZip(t *testing.T) {
+	store := exportTestStore()
+	store.CreateEmail(&Email{From: "ali@example.org", To: "legal@example.com", Mailbox: "legal@example.com", Subject: "purged"})
+	server := &mailingServerServer{EmailFinder: store, Emails: store}
+
+	stream := &FakeExportStream{}
+	if err := server.ExportEmails(&pb.ExportEmailsRequest{Format: pb.ExportFormat_EXPORT_FORMAT_EML_ZIP}, stream); err != nil {
+		t.Fatalf("cannot export the mail: %s", err)
+	}
+	if len(stream.order) != 1 || stream.order[0] != "emails.zip" {
+		t.Fatalf("expected a single zip to be streamed, but got %v", stream.order)
+	}
+
+	data := stream.files["emails.zip"].Bytes()
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("cannot read the zip: %s", err)
+	}
+
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		reader, _ := file.Open()
+		files[file.Name], _ = io.ReadAll(reader)
+		reader.Close()
+	}
+	if !bytes.Equal(files["2.eml"], store.emails[1].Content) {
+		t.Errorf("expected the mail to be exported as it is stored, but got %q", files["2.eml"])
+	}
+
+	var manifest ExportManifest
+	if err = json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("cannot read the manifest: %s", err)
+	}
+	if manifest.Count != 4 || manifest.Format != "eml" || manifest.Emails[2].File != "3.eml" || manifest.Emails[2].MessageID != "third@example.org" {
+		t.Errorf("expected the manifest to list every mail, but got %+v", manifest)
+	}
+	if _, ok := files["5.eml"]; ok || len(manifest.Emails) != 5 || !manifest.Emails[4].Purged || manifest.Emails[4].File != "" {
+		t.Errorf("expected purged mail to be listed as purged without a file, but got %+v", manifest.Emails)
+	}
+	if manifest.ExportedAt.IsZero() || time.Since(manifest.ExportedAt) > time.Minute {
+		t.Errorf("expected the manifest to have the export time, but got %v", manifest.ExportedAt)
+	}
+
+	stream = &FakeExportStream{}
+	if err = server.ExportEmails(&pb.ExportEmailsRequest{Mailbox: "other@example.com"}, stream); err != nil {
+		t.Fatalf("cannot export the mail: %s", err)
+	}
+	if len(stream.order) != 2 || stream.order[0] != "emails.mbox" || stream.order[1] != "manifest.json" {
+		t.Errorf("expected the mbox and then its manifest, but got %v", stream.order)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/mail"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+)
+
+// forwardContent builds the mail that is sent when the email is forwarded
+// as the request asks for, and returns it with the envelope sender to use.
+// Plain redirects send the stored content as it is, from the original sender.
+func (m *mailingServerServer) forwardContent(email *Email, request *pb.ForwardMailRequest) (string, []byte, error) {
+	switch request.Mode {
+	case pb.ForwardMode_FORWARD_MODE_ATTACHMENT, pb.ForwardMode_FORWARD_MODE_INLINE:
+		return m.composeForward(email, request)
+	}
+
+	rewrite := HeaderRewrite{
+		SubjectPrefix: request.SubjectPrefix,
+		AddHeaders:    request.Headers,
+	}
+
+	if request.StripInternalHeaders {
+		rewrite.StripHeaders = m.internalHeaders()
+	}
+
+	sender := email.From
+	if request.Mode == pb.ForwardMode_FORWARD_MODE_RESENT {
+		sender = m.forwardFrom(email)
+		rewrite.Resent = &ResentHeaders{
+			From:      sender,
+			To:        request.Recipient,
+			Date:      time.Now(),
+			MessageID: generateMessageID(sender),
+		}
+	}
+
+	if rewrite.Resent == nil && rewrite.SubjectPrefix == "" && len(rewrite.StripHeaders) == 0 && len(rewrite.AddHeaders) == 0 {
+		return sender, email.Content, nil
+	}
+	content, err := RewriteHeaders(email.Content, rewrite)
+	return sender, content, err
+}
+
+// composeForward writes a new message from us the way a mail client forwards,
+// either with the original attached or quoted below the note.
+func (m *mailingServerServer) composeForward(email *Email, request *pb.ForwardMailRequest) (string, []byte, error) {
+	from := m.forwardFrom(email)
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid forwarding address %q: %s", from, err)
+	}
+	recipient, err := mail.ParseAddress(request.Recipient)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid recipient %q: %s", request.Recipient, err)
+	}
+
+	original := email.Content
+	if request.StripInternalHeaders {
+		if original, err = RewriteHeaders(original, HeaderRewrite{StripHeaders: m.internalHeaders()}); err != nil {
+			return "", nil, err
+		}
+	}
+
+	parts, err := ReadMailParts(original)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot read the original mail: %s", err)
+	}
+
+	subject := forwardSubject(stripLineBreaks(decodeHeader(parts.Header.Get("Subject"))))
+	if request.SubjectPrefix != "" {
+		subject = request.SubjectPrefix + " " + subject
+	}
+
+	message := &OutgoingMessage{
+		From:    *fromAddress,
+		To:      []mail.Address{*recipient},
+		Subject: subject,
+		Headers: request.Headers,
+	}
+
+	if request.Mode == pb.ForwardMode_FORWARD_MODE_ATTACHMENT {
+		message.Text = request.Note
+		message.Attachments = []Attachment{{
+			Filename:    "forwarded-message.eml",
+			ContentType: "message/rfc822",
+			Content:     original,
+		}}
+	} else {
+		block := forwardedBlock(parts.Header)
+		message.Text = joinNote(request.Note, strings.Join(block, "\n")+"\n\n"+parts.Text)
+		if parts.HTML != "" {
+			quoted := "<div>" + strings.Join(escapeLines(block), "<br>\n") + "</div><br>\n" + parts.HTML
+			message.HTML = joinNote(htmlParagraph(request.Note), quoted)
+		}
+		message.Attachments = parts.Attachments
+	}
+
+	content, err := message.Bytes()
+	return fromAddress.Address, content, err
+}
+
+func (m *mailingServerServer) forwardFrom(email *Email) string {
+	if m.ForwardFrom == "" {
+		return email.To
+	}
+	return m.ForwardFrom
+}
+
+func (m *mailingServerServer) internalHeaders() []string {
+	if len(m.InternalHeaders) == 0 {
+		return defaultInternalHeaders
+	}
+	return m.InternalHeaders
+}
+
+// forwardSubject puts "Fwd:" in front of the subject unless it is already
+// marked as forwarded.
+func forwardSubject(subject string) string {
+	lower := strings.ToLower(subject)
+	if strings.HasPrefix(lower, "fwd:") || strings.HasPrefix(lower, "fw:") {
+		return subject
+	}
+	return strings.TrimSpace("Fwd: " + subject)
+}
+
+// forwardedBlock is the summary of the original mail that mail clients put
+// above an inline forward.
+func forwardedBlock(header mail.Header) []string {
+	block := []string{"---------- Forwarded message ---------"}
+	for _, name := range []string{"From", "Date", "Subject", "To"} {
+		if value := header.Get(name); value != "" {
+			block = append(block, name+": "+decodeHeader(value))
+		}
+	}
+	return block
+}
+
+func joinNote(note, forwarded string) string {
+	if note == "" {
+		return forwarded
+	}
+	return note + "\n\n" + forwarded
+}
+
+func escapeLines(lines []string) []string {
+	escaped := make([]string, len(lines))
+	for i, line := range lines {
+		escaped[i] = html.EscapeString(line)
+	}
+	return escaped
+}
+
+func htmlParagraph(text string) string {
+	if text == "" {
+		return ""
+	}
+	return "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>\n") + "</p>"
+}
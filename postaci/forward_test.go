@@ -0,0 +1,184 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+)
+
+const sampleForwardedEmail = "Return-Path: <contact@example.com>\n" +
+	"X-Original-To: ali@example.com\n" +
+	"Delivered-To: ali@internal.localdomain\n" +
+	"Subject: Test email\n" +
+	" subject line\n" +
+	"From: contact@example.com\n" +
+	"Message-Id: <original@example.com>\n" +
+	"\n" +
+	"this is my mail\n"
+
+func TestRewriteHeaders(t *testing.T) {
+	date := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	content, err := RewriteHeaders([]byte(sampleForwardedEmail), HeaderRewrite{
+		Resent:        &ResentHeaders{From: "proxy@example.com", To: "veli@example.org", Date: date, MessageID: "resent@example.com"},
+		SubjectPrefix: "[Fwd]",
+		StripHeaders:  defaultInternalHeaders,
+		AddHeaders:    map[string]string{"X-Ticket": "42"},
+	})
+	if err != nil {
+		t.Fatalf("cannot rewrite headers: %s", err)
+	}
+
+	expected := "Resent-Date: Thu, 01 Sep 2022 12:00:00 +0000\n" +
+		"Resent-From: proxy@example.com\n" +
+		"Resent-To: veli@example.org\n" +
+		"Resent-Message-ID: <resent@example.com>\n" +
+		"Subject: [Fwd] Test email\n" +
+		" subject line\n" +
+		"From: contact@example.com\n" +
+		"Message-Id: <original@example.com>\n" +
+		"X-Ticket: 42\n" +
+		"\n" +
+		"this is my mail\n"
+	if string(content) != expected {
+		t.Errorf("unexpected rewritten mail:\n%s", content)
+	}
+}
+
+func TestRewriteHeadersAddsTheSubjectPrefixToMailWithoutASubject(t *testing.T) {
+	content, err := RewriteHeaders([]byte("From: contact@example.com\n\nhello\n"), HeaderRewrite{SubjectPrefix: "[Fwd]"})
+	if err != nil {
+		t.Fatalf("cannot rewrite headers: %s", err)
+	}
+	if string(content) != "From: contact@example.com\nSubject: [Fwd]\n\nhello\n" {
+		t.Errorf("unexpected rewritten mail:\n%s", content)
+	}
+}
+
+func TestRewriteHeadersRefusesHeaderInjection(t *testing.T) {
+	rewrites := []HeaderRewrite{
+		{AddHeaders: map[string]string{"X-Ticket": "42\nBcc: someone@example.com"}},
+		{SubjectPrefix: "[fwd]\r\nBcc: someone@example.com"},
+		{Resent: &ResentHeaders{From: "proxy@example.com", To: "veli@example.org\nBcc: someone@example.com"}},
+		{Resent: &ResentHeaders{From: "proxy@example.com\r\nBcc: someone@example.com", To: "veli@example.org"}},
+	}
+	for _, rewrite := range rewrites {
+		_, err := RewriteHeaders([]byte(sampleForwardedEmail), rewrite)
+		if err == nil || !strings.Contains(err.Error(), "line break") {
+			t.Errorf("expected a header value with a line break to be refused, but got %v", err)
+		}
+	}
+}
+
+func TestForwardAsAttachment(t *testing.T) {
+	server := &mailingServerServer{ForwardFrom: "proxy@example.com"}
+	email := &Email{From: "contact@example.com", To: "ali@example.com", Content: []byte(sampleForwardedEmail)}
+
+	sender, content, err := server.forwardContent(email, &pb.ForwardMailRequest{
+		Recipient: "veli@example.org",
+		Mode:      pb.ForwardMode_FORWARD_MODE_ATTACHMENT,
+		Note:      "see below",
+	})
+	if err != nil {
+		t.Fatalf("cannot forward as attachment: %s", err)
+	}
+	if sender != "proxy@example.com" {
+		t.Errorf("expected the mail to be sent from the forwarding address, but got %s", sender)
+	}
+
+	parts, err := ReadMailParts(content)
+	if err != nil {
+		t.Fatalf("cannot read the forwarded mail: %s", err)
+	}
+	if subject := parts.Header.Get("Subject"); subject != "Fwd: Test email subject line" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if !strings.HasPrefix(parts.Text, "see below") {
+		t.Errorf("expected the note to be the body, but got %q", parts.Text)
+	}
+	if len(parts.Attachments) != 1 || parts.Attachments[0].ContentType != "message/rfc822" ||
+		!strings.Contains(string(parts.Attachments[0].Content), "Message-Id: <original@example.com>") {
+		t.Errorf("expected the original to be attached, but got %+v", parts.Attachments)
+	}
+}
+
+func TestForwardInline(t *testing.T) {
+	server := &mailingServerServer{}
+	email := &Email{From: "contact@example.com", To: "ali@example.com", Content: []byte(sampleForwardedEmail)}
+
+	sender, content, err := server.forwardContent(email, &pb.ForwardMailRequest{
+		Recipient: "veli@example.org",
+		Mode:      pb.ForwardMode_FORWARD_MODE_INLINE,
+		Note:      "FYI",
+	})
+	if err != nil {
+		t.Fatalf("cannot forward inline: %s", err)
+	}
+	if sender != "ali@example.com" {
+		t.Errorf("expected the mail to be sent from the original recipient, but got %s", sender)
+	}
+
+	parts, err := ReadMailParts(content)
+	if err != nil {
+		t.Fatalf("cannot read the forwarded mail: %s", err)
+	}
+	expected := "FYI\r\n\r\n" +
+		"---------- Forwarded message ---------\r\n" +
+		"From: contact@example.com\r\n" +
+		"Subject: Test email subject line\r\n" +
+		"\r\n" +
+		"this is my mail\r\n"
+	if parts.Text != expected {
+		t.Errorf("unexpected inline forward:\n%q", parts.Text)
+	}
+}
+
+func TestOutgoingMessageRefusesHeaderInjection(t *testing.T) {
+	messages := []*OutgoingMessage{
+		{Subject: "hello\r\nBcc: someone@example.com"},
+		{Subject: "hello", InReplyTo: "first@example.com>\nBcc: <someone@example.com"},
+		{Subject: "hello", References: []string{"first@example.com>\r\nBcc: <someone@example.com"}},
+		{Subject: "hello", Attachments: []Attachment{{ContentType: "text/plain\r\nBcc: someone@example.com", Content: []byte("hi")}}},
+	}
+	for _, message := range messages {
+		message.From = mail.Address{Address: "ali@example.com"}
+		if _, err := message.Bytes(); err == nil || !strings.Contains(err.Error(), "line break") {
+			t.Errorf("expected a header value with a line break to be refused, but got %v", err)
+		}
+	}
+}
+
+func TestOutgoingMessageRefusesHeadersItWritesItself(t *testing.T) {
+	for _, name := range []string{"From", "to", "Message-ID", "BCC"} {
+		message := &OutgoingMessage{From: mail.Address{Address: "ali@example.com"}, Subject: "hello", Headers: map[string]string{name: "someone@example.com"}}
+		if _, err := message.Bytes(); err == nil || !strings.Contains(err.Error(), "written by the message") {
+			t.Errorf("expected a second %s field to be refused, but got %v", name, err)
+		}
+	}
+
+	message := &OutgoingMessage{From: mail.Address{Address: "ali@example.com"}, Subject: "hello", Headers: map[string]string{"Reply-To": "help@example.com"}}
+	if content, err := message.Bytes(); err != nil || !strings.Contains(string(content), "\r\nReply-To: help@example.com\r\n") {
+		t.Errorf("expected other fields to be added, but got %v", err)
+	}
+}
+
+func TestForwardStripsLineBreaksFromTheSubject(t *testing.T) {
+	server := &mailingServerServer{}
+	content := "From: contact@example.com\r\n" +
+		"To: ali@example.com\r\n" +
+		"Subject: =?utf-8?q?hello=0D=0ABcc=3A_someone=40example=2Ecom?=\r\n" +
+		"\r\n" +
+		"this is my mail\r\n"
+	email := &Email{From: "contact@example.com", To: "ali@example.com", Content: []byte(content)}
+
+	_, forwarded, err := server.forwardContent(email, &pb.ForwardMailRequest{Recipient: "veli@example.org", Mode: pb.ForwardMode_FORWARD_MODE_INLINE})
+	if err != nil {
+		t.Fatalf("cannot forward: %s", err)
+	}
+	parts, _ := ReadMailParts(forwarded)
+	if parts.Header.Get("Bcc") != "" || parts.Header.Get("Subject") != "Fwd: hello Bcc: someone@example.com" {
+		t.Errorf("expected the subject to stay a single field, but got %q", parts.Header)
+	}
+}
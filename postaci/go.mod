@@ -3,7 +3,23 @@ module github.com/aliparlakci/mailproxy/postaci
 go 1.19
 
 require (
-	github.com/fsnotify/fsnotify v1.5.4 // indirect
+	github.com/emersion/go-imap v1.2.1
+	github.com/fsnotify/fsnotify v1.5.4
+	github.com/segmentio/kafka-go v0.4.34
+	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/net v0.0.0-20220826154423-83b083e8dc8b
+	golang.org/x/text v0.3.7
+	google.golang.org/grpc v1.49.0
+	google.golang.org/protobuf v1.28.1
+	gorm.io/driver/mysql v1.3.6
+	gorm.io/driver/sqlite v1.3.6
+	gorm.io/gorm v1.23.8
+)
+
+require (
+	github.com/emersion/go-message v0.15.0 // indirect
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	github.com/emersion/go-textwrapper v0.0.0-20200911093747-65d896831594 // indirect
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
@@ -11,18 +27,9 @@ require (
 	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/mattn/go-sqlite3 v1.14.15 // indirect
 	github.com/pierrec/lz4/v4 v4.1.15 // indirect
-	github.com/segmentio/kafka-go v0.4.34 // indirect
-	github.com/sirupsen/logrus v1.9.0 // indirect
 	github.com/xdg/scram v1.0.5 // indirect
 	github.com/xdg/stringprep v1.0.3 // indirect
 	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
-	golang.org/x/net v0.0.0-20220826154423-83b083e8dc8b // indirect
 	golang.org/x/sys v0.0.0-20220829200755-d48e67d00261 // indirect
-	golang.org/x/text v0.3.7 // indirect
 	google.golang.org/genproto v0.0.0-20220829175752-36a9c930ecbf // indirect
-	google.golang.org/grpc v1.49.0 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
-	gorm.io/driver/mysql v1.3.6 // indirect
-	gorm.io/driver/sqlite v1.3.6 // indirect
-	gorm.io/gorm v1.23.8 // indirect
 )
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// commandCounter counts a command in the traffic of an imap server.
+type commandCounter struct {
+	mutex   sync.Mutex
+	command []byte
+	count   int
+}
+
+func (c *commandCounter) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.count += bytes.Count(p, c.command)
+	return len(p), nil
+}
+
+func (c *commandCounter) Reset() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	count := c.count
+	c.count = 0
+	return count
+}
+
+// resetBackend is a memory backend whose folders have the UIDVALIDITY it is
+// given, like a server that rebuilt its folders.
+type resetBackend struct {
+	*memory.Backend
+	validity uint32
+}
+
+type resetUser struct {
+	backend.User
+	backend *resetBackend
+}
+
+type resetMailbox struct {
+	backend.Mailbox
+	backend *resetBackend
+}
+
+func (b *resetBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+	user, err := b.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return &resetUser{User: user, backend: b}, nil
+}
+
+func (u *resetUser) GetMailbox(name string) (backend.Mailbox, error) {
+	mailbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+	return &resetMailbox{Mailbox: mailbox, backend: u.backend}, nil
+}
+
+func (m *resetMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	status, err := m.Mailbox.Status(items)
+	if err == nil && status.UidValidity != 0 {
+		status.UidValidity = atomic.LoadUint32(&m.backend.validity)
+	}
+	return status, err
+}
+
+func TestIMAPSourceIngestsNewMailOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	idles := &commandCounter{command: []byte(" IDLE\r\n")}
+	imapServer := server.New(memory.New())
+	imapServer.AllowInsecureAuth = true
+	imapServer.Debug = idles
+	go imapServer.Serve(listener)
+	defer imapServer.Close()
+
+	connect := func() *client.Client {
+		t.Helper()
+		c, err := client.Dial(listener.Addr().String())
+		if err != nil {
+			t.Fatalf("cannot connect: %s", err)
+		}
+		if err = c.Login("username", "password"); err != nil {
+			t.Fatalf("cannot login: %s", err)
+		}
+		return c
+	}
+	appendMail := func(body string, flags ...string) {
+		t.Helper()
+		c := connect()
+		defer c.Logout()
+		if err := c.Append("INBOX", flags, time.Now(), bytes.NewBufferString(body)); err != nil {
+			t.Fatalf("cannot append: %s", err)
+		}
+	}
+	// The memory backend starts with a mail that is read already, like the
+	// first mail. Reading mail in webmail does not make it taken.
+	appendMail("From: contact@example.org\r\nSubject: first\r\n\r\nhello\r\n", imap.SeenFlag)
+
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer os.RemoveAll(directory)
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	ingester := &FakeIngester{}
+	source := &IMAPSource{
+		Name:         "imap-test",
+		Address:      listener.Addr().String(),
+		Username:     "username",
+		Password:     "password",
+		Recipient:    "ali@example.com",
+		PollInterval: 50 * time.Millisecond,
+		Ingester:     ingester,
+		Failures:     &FailurePolicy{Directory: directory, Store: persistence},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		source.Run(ctx)
+	}()
+
+	waitFor(t, "2 mails to be ingested", func() bool { return ingester.count() >= 2 })
+	appendMail("From: contact@example.org\r\nSubject: second\r\n\r\nhello\r\n")
+	waitFor(t, "3 mails to be ingested", func() bool { return ingester.count() >= 3 })
+
+	// A single folder is waited for with IDLE, which only ends when the
+	// folder changes or the poll interval passes.
+	idles.Reset()
+	time.Sleep(250 * time.Millisecond)
+	if count := idles.Reset(); count == 0 || count > 10 {
+		t.Errorf("expected the source to idle once every poll interval, but it idled %d times", count)
+	}
+	cancel()
+	wg.Wait()
+
+	if len(ingester.emails) != 3 {
+		t.Fatalf("expected every new mail to be ingested once, but got %d", len(ingester.emails))
+	}
+	if ingester.emails[1].To != "ali@example.com" || ingester.emails[1].Subject != "first" || ingester.emails[2].Subject != "second" {
+		t.Errorf("unexpected mail %+v", ingester.emails[1])
+	}
+
+	c := connect()
+	defer c.Logout()
+	if _, err = c.Select("INBOX", true); err != nil {
+		t.Fatalf("cannot select: %s", err)
+	}
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{"$Postaci"}
+	if uids, err := c.UidSearch(criteria); err != nil || len(uids) != 0 {
+		t.Errorf("expected every mail to be flagged, but %v are not: %v", uids, err)
+	}
+}
+
+func TestIMAPSourceQuarantinesMailThatCannotBeParsed(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer os.RemoveAll(directory)
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	ingester := &FakeIngester{}
+	source := &IMAPSource{
+		Name:     "imap-garbage-test",
+		Ingester: ingester,
+		Failures: &FailurePolicy{Directory: directory, Store: persistence},
+	}
+	if !source.ingest("INBOX", 3, 7, []byte("this is not a mail\r\n")) {
+		t.Fatalf("expected the mail to be taken, it would fail again on every scan")
+	}
+	if len(ingester.emails) != 0 {
+		t.Errorf("expected nothing to be ingested, but got %d", len(ingester.emails))
+	}
+
+	quarantined, _ := persistence.ListQuarantinedMail("imap-garbage-test", 10, 0)
+	if len(quarantined) != 1 || quarantined[0].Filename != "INBOX/3/7" {
+		t.Fatalf("expected the mail to be quarantined, but got %+v", quarantined)
+	}
+	if content, err := os.ReadFile(quarantined[0].Path); err != nil || string(content) != "this is not a mail\r\n" {
+		t.Errorf("expected the quarantine to keep the mail, but got %q: %v", content, err)
+	}
+}
+
+func TestIMAPSourceTellsMailApartAfterUIDValidityChanges(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	memoryBackend := memory.New()
+	imapBackend := &resetBackend{Backend: memoryBackend, validity: 1}
+	imapServer := server.New(imapBackend)
+	imapServer.AllowInsecureAuth = true
+	go imapServer.Serve(listener)
+	defer imapServer.Close()
+
+	// The folder is emptied and filled again, so that the new mail has the
+	// uid of the old one.
+	refill := func(subject string) {
+		t.Helper()
+		user, _ := memoryBackend.Login(nil, "username", "password")
+		mailbox, _ := user.GetMailbox("INBOX")
+		inbox := mailbox.(*memory.Mailbox)
+		inbox.Messages = nil
+		content := "From: contact@example.org\r\nSubject: " + subject + "\r\n\r\nhello\r\n"
+		if err := inbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(content)); err != nil {
+			t.Fatalf("cannot append: %s", err)
+		}
+	}
+
+	ingester := &FakeIngester{}
+	source := &IMAPSource{
+		Name:         "imap-validity-test",
+		Address:      listener.Addr().String(),
+		Username:     "username",
+		Password:     "password",
+		Recipient:    "ali@example.com",
+		PollInterval: 50 * time.Millisecond,
+		Ingester:     ingester,
+	}
+	poll := func(count int) {
+		t.Helper()
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			source.Run(ctx)
+		}()
+		waitFor(t, "the mail to be ingested", func() bool { return ingester.count() >= count })
+		cancel()
+		<-done
+	}
+
+	refill("before")
+	poll(1)
+	refill("after")
+	atomic.StoreUint32(&imapBackend.validity, 2)
+	poll(2)
+
+	if len(ingester.emails) != 2 || ingester.emails[1].Subject != "after" {
+		t.Fatalf("expected the new mail to be ingested, but got %d mails", len(ingester.emails))
+	}
+	if before, after := ingester.emails[0].Filename, ingester.emails[1].Filename; before == after || after != "INBOX/2/1" {
+		t.Errorf("expected the mail to be told apart by the UIDVALIDITY, but got %s and %s", before, after)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultImportProgress = 1000
+
+// mboxQuotedFrom matches body lines that mbox quotes so that they are not
+// taken as the start of the next message, like ">From " and ">>From ".
+var mboxQuotedFrom = regexp.MustCompile(`^>+From `)
+
+type ImportStore interface {
+	EmailStore
+	// HasEmail tells whether the mail is stored already.
+	HasEmail(email *Email) (bool, error)
+}
+
+// HasEmail finds mail by its recipient and Message-ID, or by its sender,
+// subject and date when it does not have a Message-ID.
+func (p *Persistence) HasEmail(email *Email) (bool, error) {
+	query := db.Model(&Email{}).Where("`to` = ?", email.To)
+	if email.MessageID != "" {
+		query = query.Where("message_id = ?", email.MessageID)
+	} else {
+		query = query.Where("`from` = ? AND subject = ? AND sent_date = ?", email.From, email.Subject, email.SentDate)
+	}
+
+	var count int64
+	err := query.Count(&count).Error
+	return count > 0, err
+}
+
+// Importer stores existing mail from a Maildir tree, an mbox file or a
+// directory of .eml files. Mail that is stored already is skipped.
+type Importer struct {
+	Store ImportStore
+	// Source is the label the mail is stored with, and Recipient is used
+	// for mail that does not have X-Original-To.
+	Source    string
+	Recipient string
+	// Producer announces the imported mail when it is set, at most as fast
+	// as EmitLimit allows.
+	Producer  MessageProducer
+	EmitLimit Limit
+	// ProgressEvery is how many mails are read between progress reports.
+	ProgressEvery int
+
+	emitBucket *tokenBucket
+	read       int
+	imported   int
+	duplicates int
+	failed     int
+}
+
+// Import reads every mail under root and reports how it went.
+func (i *Importer) Import(ctx context.Context, root string) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	switch {
+	case !info.IsDir() && strings.EqualFold(path.Ext(root), ".eml"):
+		i.importFile(ctx, root, path.Base(root))
+	case !info.IsDir():
+		err = i.importMbox(ctx, root)
+	case isMaildir(root):
+		err = i.importMaildir(ctx, root)
+	default:
+		err = i.importDirectory(ctx, root)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"read":       i.read,
+		"imported":   i.imported,
+		"duplicates": i.duplicates,
+		"failed":     i.failed,
+		"elapsed":    time.Since(start),
+	}).Info("import is finished")
+	return err
+}
+
+// importMaildir imports the mail in cur/ and new/ of a Maildir and of its
+// folders. Mail in tmp/ is not delivered yet.
+func (i *Importer) importMaildir(ctx context.Context, root string) error {
+	return filepath.WalkDir(root, func(filepath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() {
+			if entry.Name() == "tmp" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		folder := path.Dir(filepath)
+		if name := path.Base(folder); name != "cur" && name != "new" {
+			return nil
+		}
+		filename, _ := splitMaildirName(entry.Name())
+		if parent := path.Dir(folder); path.Clean(parent) != path.Clean(root) {
+			filename = path.Join(path.Base(parent), filename)
+		}
+		i.importFile(ctx, filepath, filename)
+		return nil
+	})
+}
+
+// importDirectory imports the .eml files in a directory and below it.
+func (i *Importer) importDirectory(ctx context.Context, root string) error {
+	return filepath.WalkDir(root, func(filepath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if entry.IsDir() || !strings.EqualFold(path.Ext(entry.Name()), ".eml") {
+			return nil
+		}
+
+		filename := strings.TrimPrefix(strings.TrimPrefix(filepath, root), "/")
+		i.importFile(ctx, filepath, filename)
+		return nil
+	})
+}
+
+// importMbox imports the messages of an mbox file. Messages start with a
+// "From " line, and the quoting of body lines like ">From " is undone.
+func (i *Importer) importMbox(ctx context.Context, filepath string) error {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var message bytes.Buffer
+	number, inMessage := 0, false
+	flush := func() {
+		if !inMessage {
+			return
+		}
+		number++
+		// The blank line before the next "From " line is not part of it.
+		content := bytes.TrimSuffix(message.Bytes(), []byte("\n"))
+		i.importContent(ctx, append([]byte(nil), content...), fmt.Sprintf("%s#%d", path.Base(filepath), number))
+		message.Reset()
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				flush()
+				inMessage = true
+			case inMessage:
+				if mboxQuotedFrom.Match(line) {
+					line = line[1:]
+				}
+				message.Write(line)
+			}
+		}
+
+		if err == io.EOF {
+			flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (i *Importer) importFile(ctx context.Context, filepath, filename string) {
+	email, err := ReadAndParseEmailFile(filepath)
+	if err != nil {
+		i.read++
+		i.failed++
+		logrus.WithField("filename", filepath).Warnf("mail cannot be read: %s", err)
+		return
+	}
+	email.Filename = filename
+	i.store(ctx, &email)
+}
+
+func (i *Importer) importContent(ctx context.Context, content []byte, filename string) {
+	email, err := ParseEmail(content)
+	if err != nil {
+		i.read++
+		i.failed++
+		logrus.WithField("filename", filename).Warnf("mail cannot be parsed: %s", err)
+		return
+	}
+	email.Filename = filename
+	i.store(ctx, &email)
+}
+
+func (i *Importer) store(ctx context.Context, email *Email) {
+	i.read++
+	defer i.progress()
+
+	if email.To == "" {
+		email.To = i.Recipient
+	}
+	email.Source = i.Source
+	email.Mailbox, email.Subaddress = splitSubaddress(email.To, defaultSubaddressDelimiters)
+
+	exists, err := i.Store.HasEmail(email)
+	if err != nil {
+		i.failed++
+		logrus.WithField("filename", email.Filename).Errorf("something happened while looking for the mail: %s", err)
+		return
+	}
+	if exists {
+		i.duplicates++
+		return
+	}
+
+	if err = i.Store.CreateEmail(email); err != nil {
+		i.failed++
+		logrus.WithField("filename", email.Filename).Errorf("something happened while storing the mail: %s", err)
+		return
+	}
+	i.imported++
+
+	if i.Producer != nil {
+		i.waitToEmit(ctx)
+		if err = EmitNewEmailMessage(i.Producer, email.ID, email.To, email.Mailbox, email.Subaddress, email.Source); err != nil {
+			logrus.WithField("emailId", email.ID).Errorf("something happened while announcing the mail: %s", err)
+		}
+	}
+}
+
+// waitToEmit waits until the emit limit allows another event.
+func (i *Importer) waitToEmit(ctx context.Context) {
+	if i.EmitLimit.unlimited() {
+		return
+	}
+	if i.emitBucket == nil {
+		i.emitBucket = &tokenBucket{limit: i.EmitLimit, tokens: i.EmitLimit.Burst, last: time.Now()}
+	}
+
+	for {
+		i.emitBucket.refill(time.Now())
+		wait := i.emitBucket.wait()
+		if wait == 0 {
+			i.emitBucket.tokens--
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (i *Importer) progress() {
+	every := i.ProgressEvery
+	if every <= 0 {
+		every = defaultImportProgress
+	}
+	if i.read%every != 0 {
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"read":       i.read,
+		"imported":   i.imported,
+		"duplicates": i.duplicates,
+		"failed":     i.failed,
+	}).Info("import is in progress")
+}
+
+// isMaildir tells whether a directory is a Maildir, which has cur/ and new/.
+func isMaildir(directory string) bool {
+	for _, name := range []string{"cur", "new"} {
+		if info, err := os.Stat(path.Join(directory, name)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// runImport is the import subcommand:
+//
+//	postaci import [-source label] [-recipient address] [-emit] [-emit-limit 100/1s] path...
+func runImport(args []string) {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	source := flags.String("source", "import", "the label the imported mail is stored with")
+	recipient := flags.String("recipient", "", "the recipient of mail without X-Original-To")
+	emit := flags.Bool("emit", false, "announce the imported mail as new mail")
+	emitLimit := flags.String("emit-limit", "", "the most announcements in a period, like 100/1s")
+	progressEvery := flags.Int("progress", defaultImportProgress, "how many mails are read between progress reports")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s import [flags] path...\n\nImports a Maildir tree, an mbox file or a directory of .eml files.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	limit, err := ParseLimit(*emitLimit)
+	if err != nil {
+		logrus.Fatalf("cannot configure the emit limit: %s", err)
+	}
+
+	persistence := &Persistence{}
+	persistence.Initialize(os.Getenv("MYSQL_DSN"))
+
+	importer := &Importer{
+		Store:         persistence,
+		Source:        *source,
+		Recipient:     *recipient,
+		EmitLimit:     limit,
+		ProgressEvery: *progressEvery,
+	}
+	if *emit {
+		messageBroker := &MessageBroker{}
+		messageBroker.Initialize(os.Getenv("KAFKA_ADDRESS"), os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD"))
+		importer.Producer = messageBroker
+	}
+
+	for _, root := range flags.Args() {
+		if err := importer.Import(context.Background(), root); err != nil {
+			logrus.Fatalf("something happened while importing %s: %s", root, err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type FakeImportStore struct {
+	emails []*Email
+}
+
+func (f *FakeImportStore) CreateEmail(email *Email) error {
+	email.ID = uint(len(f.emails) + 1)
+	f.emails = append(f.emails, email)
+	return nil
+}
+
+func (f *FakeImportStore) HasEmail(email *Email) (bool, error) {
+	for _, stored := range f.emails {
+		if stored.To == email.To && stored.MessageID == email.MessageID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func importTestMail(to, messageID, body string) string {
+	return fmt.Sprintf("From: contact@example.org\nX-Original-To: %s\nMessage-Id: <%s>\nSubject: %s\n\n%s\n", to, messageID, messageID, body)
+}
+
+func TestImportReadsMaildirMboxAndEml(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+
+	files := map[string]string{
+		"maildir/new/first":               importTestMail("user@example.com", "first@example.org", "hello"),
+		"maildir/cur/second:2,S":          importTestMail("user+news@example.com", "second@example.org", "hello"),
+		"maildir/tmp/partial":             importTestMail("user@example.com", "partial@example.org", "hello"),
+		"maildir/.Archive/cur/third:2,S":  importTestMail("user@example.com", "third@example.org", "hello"),
+		"maildir/.Archive/new/first-copy": importTestMail("user@example.com", "first@example.org", "hello"),
+		"export/2024/fourth.eml":          importTestMail("user@example.com", "fourth@example.org", "hello"),
+		"export/notes.txt":                "not mail\n",
+		"archive.mbox": "From contact@example.org Mon Jan  1 00:00:00 2024\n" +
+			importTestMail("user@example.com", "fifth@example.org", ">From the start\n>>From the quote") + "\n" +
+			"From contact@example.org Tue Jan  2 00:00:00 2024\n" +
+			importTestMail("user@example.com", "sixth@example.org", "bye"),
+	}
+	for filename, content := range files {
+		filepath := path.Join(directory, filename)
+		if err := os.MkdirAll(path.Dir(filepath), fs.ModePerm); err != nil {
+			t.Fatalf("cannot create the directory: %s", err)
+		}
+		if err := os.WriteFile(filepath, []byte(content), fs.ModePerm); err != nil {
+			t.Fatalf("cannot write the mail: %s", err)
+		}
+	}
+
+	store := &FakeImportStore{}
+	producer := &FakeMessageProducer{}
+	importer := &Importer{Store: store, Source: "backfill", Producer: producer, EmitLimit: Limit{Rate: 1000, Burst: 1}}
+	for _, root := range []string{"maildir", "export", "archive.mbox", "maildir"} {
+		if err := importer.Import(context.Background(), path.Join(directory, root)); err != nil {
+			t.Fatalf("cannot import %s: %s", root, err)
+		}
+	}
+
+	var imported []string
+	for _, email := range store.emails {
+		imported = append(imported, email.MessageID+" "+email.Filename)
+		if email.Source != "backfill" {
+			t.Errorf("expected %s to be stored with the import source, but got %q", email.MessageID, email.Source)
+		}
+	}
+	sort.Strings(imported)
+	expected := []string{
+		"fifth@example.org archive.mbox#1",
+		"first@example.org .Archive/first-copy",
+		"fourth@example.org 2024/fourth.eml",
+		"second@example.org second",
+		"sixth@example.org archive.mbox#2",
+		"third@example.org .Archive/third",
+	}
+	if fmt.Sprint(imported) != fmt.Sprint(expected) {
+		t.Errorf("expected %v to be imported, but got %v", expected, imported)
+	}
+
+	if importer.imported != 6 || importer.duplicates != 5 || importer.failed != 0 {
+		t.Errorf("expected 6 imported and 5 duplicates, but got %d imported, %d duplicates and %d failed", importer.imported, importer.duplicates, importer.failed)
+	}
+	if !producer.IsCalledWith("newemail", "6|user@example.com|user@example.com||backfill") {
+		t.Errorf("expected the last imported mail to be announced, but got %q", producer.message)
+	}
+
+	for _, email := range store.emails {
+		switch email.MessageID {
+		case "second@example.org":
+			if email.Mailbox != "user@example.com" || email.Subaddress != "news" {
+				t.Errorf("expected the subaddress to be split, but got %q and %q", email.Mailbox, email.Subaddress)
+			}
+		case "fifth@example.org":
+			if body := string(email.Content); !strings.Contains(body, "\nFrom the start\n") || !strings.Contains(body, "\n>From the quote\n") {
+				t.Errorf("expected the mbox quoting to be undone, but got %q", body)
+			}
+		}
+	}
+}
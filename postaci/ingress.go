@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxMessageSize   = 25 << 20
+	defaultIngressTimeout   = 5 * time.Minute
+	maxIngressRecipients    = 100
+	ingressUnixSocketScheme = "unix:"
+)
+
+// EmailIngester takes a received mail into the pipeline, as Ingestor does.
+type EmailIngester interface {
+	IngestEmail(email *Email) error
+}
+
+// IngestSource is a place mail is received from, like a Maildir, an
+// LMTP server or an IMAP mailbox. Its label is stored with the mail it
+// receives.
+type IngestSource interface {
+	Label() string
+	// Run receives mail until the context is done.
+	Run(ctx context.Context)
+}
+
+// RecipientError is the reply refusing a recipient.
+type RecipientError struct {
+	Code         int
+	EnhancedCode string
+	Message      string
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.EnhancedCode, e.Message)
+}
+
+// RoutingRules decide which recipients the ingress server accepts.
+type RoutingRules struct {
+	// Domains are the domains mail is accepted for, any domain when empty.
+	// An SMTP ingress is open to the internet and does not run without
+	// them.
+	Domains []string
+	// Aliases refuses aliases that reject mail after they expire, when set.
+	Aliases AliasStore
+}
+
+// Check returns a RecipientError when the recipient is refused.
+func (r *RoutingRules) Check(recipient string) error {
+	if !strings.Contains(recipient, "@") {
+		return &RecipientError{Code: 501, EnhancedCode: "5.1.3", Message: "bad recipient address syntax"}
+	}
+
+	if len(r.Domains) > 0 {
+		domain, accepted := domainOf(recipient), false
+		for _, d := range r.Domains {
+			if strings.EqualFold(d, domain) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return &RecipientError{Code: 550, EnhancedCode: "5.7.1", Message: "relaying denied"}
+		}
+	}
+
+	if r.Aliases != nil {
+		alias, err := r.Aliases.FindAlias(recipient)
+		if err != nil {
+			logrus.Errorf("something happened while looking up the alias: %s", err)
+			return &RecipientError{Code: 451, EnhancedCode: "4.3.0", Message: "temporary lookup failure"}
+		}
+		if alias != nil && alias.ExpiredAction == AliasRejected && !alias.Active(time.Now()) {
+			return &RecipientError{Code: 550, EnhancedCode: "5.1.1", Message: "mailbox unavailable"}
+		}
+		if alias == nil {
+			tombstone, err := r.Aliases.FindAliasTombstone(recipient)
+			if err != nil {
+				logrus.Errorf("something happened while looking up the deleted alias: %s", err)
+				return &RecipientError{Code: 451, EnhancedCode: "4.3.0", Message: "temporary lookup failure"}
+			}
+			if tombstone != nil {
+				return &RecipientError{Code: 550, EnhancedCode: "5.1.1", Message: "mailbox unavailable"}
+			}
+		}
+	}
+	return nil
+}
+
+// IngressServer receives mail over LMTP, or SMTP, and feeds it to the
+// ingest pipeline. LMTP answers the data of a transaction once for every
+// recipient, so a recipient that fails does not make the others be sent
+// again. SMTP has a single answer, and any failed recipient fails them all.
+// The client then sends the mail again to all of them, and the ingester
+// knows the ones it has stored by the name of the mail.
+type IngressServer struct {
+	Name string
+	// Address is where Run listens, as ListenIngress takes it.
+	Address        string
+	LMTP           bool
+	Hostname       string
+	MaxMessageSize int64
+	Timeout        time.Duration
+	Rules          *RoutingRules
+	Ingester       EmailIngester
+}
+
+// ListenIngress listens on a TCP address, or on a unix socket given as
+// "unix:/path/to/socket".
+func ListenIngress(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, ingressUnixSocketScheme) {
+		path := strings.TrimPrefix(addr, ingressUnixSocketScheme)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (s *IngressServer) Label() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	if s.LMTP {
+		return "lmtp"
+	}
+	return "smtp"
+}
+
+// Run listens on the address and serves until the context is done.
+func (s *IngressServer) Run(ctx context.Context) {
+	if !s.LMTP && (s.Rules == nil || len(s.Rules.Domains) == 0) {
+		logrus.Fatalf("the %s ingress needs the domains it accepts mail for", s.Label())
+	}
+
+	listener, err := ListenIngress(s.Address)
+	if err != nil {
+		logrus.Fatalf("cannot listen on %s for the %s ingress: %s", s.Address, s.Label(), err)
+	}
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	if err = s.Serve(listener); err != nil {
+		logrus.Fatalf("ingress server stopped: %s", err)
+	}
+}
+
+// Serve accepts connections until the listener is closed.
+func (s *IngressServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+type ingressSession struct {
+	server     *IngressServer
+	conn       net.Conn
+	text       *textproto.Conn
+	greeted    bool
+	hasFrom    bool
+	from       string
+	recipients []string
+}
+
+func (s *IngressServer) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	session := &ingressSession{server: s, conn: conn, text: textproto.NewConn(conn)}
+	protocol := "ESMTP"
+	if s.LMTP {
+		protocol = "LMTP"
+	}
+	session.reply(220, "%s %s postaci", s.hostname(), protocol)
+
+	for {
+		conn.SetDeadline(time.Now().Add(s.timeout()))
+		line, err := session.text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, argument := line, ""
+		if space := strings.IndexByte(line, ' '); space >= 0 {
+			verb, argument = line[:space], strings.TrimSpace(line[space+1:])
+		}
+
+		switch strings.ToUpper(verb) {
+		case "LHLO":
+			session.hello(argument, s.LMTP)
+		case "EHLO", "HELO":
+			session.hello(argument, !s.LMTP)
+		case "MAIL":
+			session.mail(argument)
+		case "RCPT":
+			session.rcpt(argument)
+		case "DATA":
+			session.data()
+		case "RSET":
+			session.reset()
+			session.reply(250, "2.0.0 Ok")
+		case "NOOP":
+			session.reply(250, "2.0.0 Ok")
+		case "VRFY":
+			session.reply(252, "2.5.0 Cannot verify the user")
+		case "QUIT":
+			session.reply(221, "2.0.0 Bye")
+			return
+		default:
+			session.reply(502, "5.5.2 Command not recognized")
+		}
+	}
+}
+
+func (s *ingressSession) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *ingressSession) reset() {
+	s.hasFrom, s.from, s.recipients = false, "", nil
+}
+
+func (s *ingressSession) hello(domain string, allowed bool) {
+	if !allowed {
+		greeting := "EHLO"
+		if s.server.LMTP {
+			greeting = "LHLO"
+		}
+		s.reply(500, "5.5.1 Use %s", greeting)
+		return
+	}
+	if domain == "" {
+		s.reply(501, "5.5.4 Domain is required")
+		return
+	}
+
+	s.reset()
+	s.greeted = true
+	lines := []string{s.server.hostname(), "PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "SIZE " + strconv.FormatInt(s.server.maxMessageSize(), 10)}
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		s.text.PrintfLine("250%s%s", separator, line)
+	}
+}
+
+func (s *ingressSession) mail(argument string) {
+	if !s.greeted {
+		s.reply(503, "5.5.1 Say hello first")
+		return
+	}
+	if s.hasFrom {
+		s.reply(503, "5.5.1 Sender already given")
+		return
+	}
+
+	path, params, ok := parsePath(argument, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range params {
+		if name, value, found := strings.Cut(param, "="); found && strings.EqualFold(name, "SIZE") {
+			if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > s.server.maxMessageSize() {
+				s.reply(552, "5.3.4 Message size exceeds fixed limit")
+				return
+			}
+		}
+	}
+
+	s.hasFrom, s.from = true, path
+	s.reply(250, "2.1.0 Ok")
+}
+
+func (s *ingressSession) rcpt(argument string) {
+	if !s.hasFrom {
+		s.reply(503, "5.5.1 Need MAIL before RCPT")
+		return
+	}
+	if len(s.recipients) >= maxIngressRecipients {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+
+	path, _, ok := parsePath(argument, "TO:")
+	if !ok || path == "" {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+
+	if s.server.Rules != nil {
+		var rejection *RecipientError
+		if err := s.server.Rules.Check(path); errors.As(err, &rejection) {
+			logrus.WithField("recipient", path).Infof("recipient is refused: %s", rejection)
+			s.reply(rejection.Code, "%s %s", rejection.EnhancedCode, rejection.Message)
+			return
+		}
+	}
+
+	s.recipients = append(s.recipients, path)
+	s.reply(250, "2.1.5 Ok")
+}
+
+func (s *ingressSession) data() {
+	if len(s.recipients) == 0 {
+		s.reply(503, "5.5.1 Need RCPT before DATA")
+		return
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	s.conn.SetDeadline(time.Now().Add(s.server.timeout()))
+	reader := s.text.DotReader()
+	content, err := io.ReadAll(io.LimitReader(reader, s.server.maxMessageSize()+1))
+	if err != nil {
+		return
+	}
+
+	replies := make([]string, len(s.recipients))
+	if int64(len(content)) > s.server.maxMessageSize() {
+		io.Copy(io.Discard, reader)
+		for i := range replies {
+			replies[i] = "552 5.3.4 Message size exceeds fixed limit"
+		}
+	} else {
+		for i, recipient := range s.recipients {
+			replies[i] = s.ingest(recipient, content)
+		}
+	}
+
+	if s.server.LMTP {
+		for _, reply := range replies {
+			s.text.PrintfLine("%s", reply)
+		}
+	} else {
+		reply := replies[0]
+		for _, r := range replies {
+			if !strings.HasPrefix(r, "250") {
+				reply = r
+				break
+			}
+		}
+		s.text.PrintfLine("%s", reply)
+	}
+	s.reset()
+}
+
+// ingest stores the mail for a single recipient and returns the reply for
+// it. The envelope is kept in the header the way local delivery does.
+func (s *ingressSession) ingest(recipient string, content []byte) string {
+	var message bytes.Buffer
+	// The dot reader has already turned CRLF into LF.
+	fmt.Fprintf(&message, "Return-Path: <%s>\nDelivered-To: %s\n", s.from, recipient)
+	message.Write(content)
+
+	email, err := ParseEmail(message.Bytes())
+	if err != nil {
+		logrus.WithField("recipient", recipient).Warnf("received mail cannot be parsed: %s", err)
+		return "554 5.6.0 Message cannot be parsed"
+	}
+	email.To = recipient
+	email.Source = s.server.Label()
+	// The mail is named after its data, so that a client sending it again
+	// after a failure does not get it stored twice for a recipient.
+	email.Filename = fmt.Sprintf("%x", sha256.Sum256(content))
+
+	if err = s.server.Ingester.IngestEmail(&email); err != nil {
+		logrus.WithField("recipient", recipient).Errorf("something happened while ingesting received mail: %s", err)
+		return "451 4.3.0 Cannot process the message, try again later"
+	}
+	return "250 2.0.0 Ok"
+}
+
+// parsePath reads "FROM:<address> PARAM=value" style arguments.
+func parsePath(argument, prefix string) (string, []string, bool) {
+	if len(argument) < len(prefix) || !strings.EqualFold(argument[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+
+	rest := strings.TrimSpace(argument[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
+
+func (s *IngressServer) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "localhost"
+}
+
+func (s *IngressServer) maxMessageSize() int64 {
+	if s.MaxMessageSize <= 0 {
+		return defaultMaxMessageSize
+	}
+	return s.MaxMessageSize
+}
+
+func (s *IngressServer) timeout() time.Duration {
+	if s.Timeout <= 0 {
+		return defaultIngressTimeout
+	}
+	return s.Timeout
+}
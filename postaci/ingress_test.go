@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type FakeIngester struct {
+	mutex  sync.Mutex
+	emails []*Email
+	fail   map[string]bool
+}
+
+func (f *FakeIngester) IngestEmail(email *Email) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.fail[email.To] {
+		return errors.New("database is down")
+	}
+	f.emails = append(f.emails, email)
+	return nil
+}
+
+func (f *FakeIngester) count() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.emails)
+}
+
+// waitFor waits for a condition of a test that runs in the background, and
+// fails the test when it is not met in 5 seconds.
+func waitFor(t *testing.T, expectation string, met func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !met() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s", expectation)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLMTPRepliesForEveryRecipient(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	ingester := &FakeIngester{fail: map[string]bool{"broken@example.com": true}}
+	server := &IngressServer{
+		LMTP:     true,
+		Hostname: "postaci.test",
+		Rules:    &RoutingRules{Domains: []string{"example.com"}},
+		Ingester: ingester,
+	}
+	go server.Serve(listener)
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	expect := func(code int) string {
+		t.Helper()
+		_, message, err := conn.ReadResponse(code)
+		if err != nil {
+			t.Fatalf("expected %d, but got %s", code, err)
+		}
+		return message
+	}
+	command := func(line string, code int) {
+		t.Helper()
+		conn.PrintfLine("%s", line)
+		expect(code)
+	}
+
+	expect(220)
+	command("EHLO client.test", 500)
+	command("LHLO client.test", 250)
+	command("MAIL FROM:<contact@example.org>", 250)
+	command("RCPT TO:<ali@example.com>", 250)
+	command("RCPT TO:<someone@elsewhere.test>", 550)
+	command("RCPT TO:<broken@example.com>", 250)
+	command("DATA", 354)
+
+	conn.PrintfLine("From: contact@example.org\r\nSubject: Hello\r\n\r\n..leading dot\r\n.")
+	expect(250)
+	expect(451)
+	command("QUIT", 221)
+
+	if len(ingester.emails) != 1 {
+		t.Fatalf("expected a single mail to be ingested, but got %d", len(ingester.emails))
+	}
+	email := ingester.emails[0]
+	if email.To != "ali@example.com" || email.From != "contact@example.org" {
+		t.Errorf("unexpected envelope %s -> %s", email.From, email.To)
+	}
+	if !strings.HasPrefix(string(email.Content), "Return-Path: <contact@example.org>\nDelivered-To: ali@example.com\n") ||
+		!strings.HasSuffix(string(email.Content), "\n.leading dot\n") {
+		t.Errorf("unexpected content:\n%s", email.Content)
+	}
+}
+
+func TestSMTPIngressNamesResentMailTheSame(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	ingester := &FakeIngester{fail: map[string]bool{"broken@example.com": true}}
+	server := &IngressServer{
+		Hostname: "postaci.test",
+		Rules:    &RoutingRules{Domains: []string{"example.com"}},
+		Ingester: ingester,
+	}
+	go server.Serve(listener)
+
+	conn, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("cannot connect: %s", err)
+	}
+	defer conn.Close()
+
+	command := func(line string, code int) {
+		t.Helper()
+		conn.PrintfLine("%s", line)
+		if _, _, err := conn.ReadResponse(code); err != nil {
+			t.Fatalf("expected %d to %s, but got %s", code, line, err)
+		}
+	}
+	send := func(code int) {
+		t.Helper()
+		command("MAIL FROM:<contact@example.org>", 250)
+		command("RCPT TO:<ali@example.com>", 250)
+		command("RCPT TO:<broken@example.com>", 250)
+		command("DATA", 354)
+		command("From: contact@example.org\r\nSubject: Hello\r\n\r\nhello\r\n.", code)
+	}
+
+	if _, _, err = conn.ReadResponse(220); err != nil {
+		t.Fatalf("expected a greeting, but got %s", err)
+	}
+	command("EHLO client.test", 250)
+	send(451)
+	delete(ingester.fail, "broken@example.com")
+	send(250)
+	command("QUIT", 221)
+
+	if len(ingester.emails) != 3 {
+		t.Fatalf("expected the mail to be ingested for every recipient it was sent to, but got %d", len(ingester.emails))
+	}
+	first, resent := ingester.emails[0], ingester.emails[1]
+	if first.To != resent.To || first.Filename == "" || first.Filename != resent.Filename || first.Source != "smtp" {
+		t.Errorf("expected the resent mail to be named the same, but got %s and %s", first.Filename, resent.Filename)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaildirRescanInterval = 5 * time.Minute
+	defaultMaildirSettleDelay    = 200 * time.Millisecond
+	// maildirTmpLifetime is how long a file can be in tmp/ before it is
+	// taken as left over by a delivery that crashed, as the spec has it.
+	maildirTmpLifetime = 36 * time.Hour
+
+	MaildirPassed = "P"
+	MaildirSeen   = "S"
+)
+
+// defaultMaildirExcludedFolders are the special-use folders, which hold
+// mail that is sent, drafted, thrown away or filed, and not new mail.
+var defaultMaildirExcludedFolders = []string{"Sent", "Drafts", "Trash", "Junk", "Archive"}
+
+// MaildirSource ingests mail delivered to the new/ directory of a Maildir.
+// Recursive also takes the Maildir++ folders, the ".Folder" directories
+// next to new/, including the ones that are created later. Ingested mail
+// is moved to cur/ with the Seen flag, and the Passed flag as well when it
+// is relayed.
+type MaildirSource struct {
+	Name      string
+	Path      string
+	Recursive bool
+	// Folders are the Maildir++ folders Recursive takes, every folder when
+	// it is empty, and ExcludeFolders are the ones it leaves out, the
+	// special-use folders when it is nil. Folders are named without the
+	// leading dot, like "Lists.golang", and a folder has its subfolders.
+	Folders        []string
+	ExcludeFolders []string
+	Ingester       EmailIngester
+	// Queue runs the ingestion of the files. Sources share it so that its
+	// workers bound the load on the database and the broker, and a source
+	// has a queue of its own when it is nil.
+	Queue *IngestQueue
+	// Failures retries and quarantines the files that fail, when it is set.
+	Failures *FailurePolicy
+	// RescanInterval is how often new/ is read again for mail the watcher
+	// missed. It is read at once when the watcher overflows.
+	RescanInterval time.Duration
+	// SettleDelay is how long a file in new/ has to stay unchanged before it
+	// is taken. Delivery agents write to tmp/ and rename complete files
+	// into new/, but some write into new/ directly.
+	SettleDelay time.Duration
+
+	rescanning int32
+}
+
+// ParseMaildirSources reads sources from a whitespace or comma separated
+// list of urls like maildir:///var/mail/example.com?name=example.com. Other
+// parameters are recursive, and folder and exclude that can be repeated. An
+// empty exclude takes the special-use folders as well. The path is the name
+// when name is not given.
+func ParseMaildirSources(spec string) ([]*MaildirSource, error) {
+	var sources []*MaildirSource
+
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' }) {
+		u, err := url.Parse(entry)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse maildir source %s: %s", entry, err)
+		}
+		if u.Scheme != "maildir" {
+			return nil, fmt.Errorf("unsupported maildir source scheme %s", u.Scheme)
+		}
+		if u.Path == "" {
+			return nil, fmt.Errorf("maildir source %s has no path", entry)
+		}
+
+		query := u.Query()
+		source := &MaildirSource{
+			Name:      query.Get("name"),
+			Path:      u.Path,
+			Recursive: query.Get("recursive") == "true",
+		}
+		if source.Name == "" {
+			source.Name = u.Path
+		}
+		source.Folders = query["folder"]
+		if excluded, ok := query["exclude"]; ok {
+			source.ExcludeFolders = []string{}
+			for _, folder := range excluded {
+				if folder != "" {
+					source.ExcludeFolders = append(source.ExcludeFolders, folder)
+				}
+			}
+		}
+		sources = append(sources, source)
+	}
+
+	return sources, nil
+}
+
+func (s *MaildirSource) Label() string {
+	return s.Name
+}
+
+// Run ingests the mail that is waiting in the Maildir and then the mail
+// that arrives, until the context is done.
+func (s *MaildirSource) Run(ctx context.Context) {
+	var ingest func(string)
+	ingest = func(filepath string) {
+		err := ingestMaildirFile(s.Ingester, filepath, s.filename(filepath), s.Name)
+		if s.Failures == nil {
+			return
+		}
+		if err != nil {
+			s.Failures.Failed(filepath, s.filename(filepath), s.Name, err, func() { s.submit(ctx, filepath, ingest) })
+		} else {
+			s.Failures.Succeeded(filepath)
+		}
+	}
+	s.listen(ctx, ingest)
+}
+
+// filename is how a file is known once it is stored, its name for mail in
+// the Maildir itself and ".Folder/name" for mail in a Maildir++ folder.
+func (s *MaildirSource) filename(filepath string) string {
+	folder := path.Dir(path.Dir(filepath))
+	if path.Clean(folder) == path.Clean(s.Path) {
+		return path.Base(filepath)
+	}
+	return path.Join(path.Base(folder), path.Base(filepath))
+}
+
+func (s *MaildirSource) listen(ctx context.Context, cb func(string)) {
+	if s.Queue == nil {
+		s.Queue = NewIngestQueue(defaultIngestWorkers, defaultIngestQueueSize)
+		go s.Queue.Run(ctx)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatal("NewWatcher failed: ", err)
+	}
+	defer watcher.Close()
+
+	folders := map[string]bool{}
+	if s.Recursive {
+		if err = watcher.Add(s.Path); err != nil {
+			log.Fatal("Add failed:", err)
+		}
+	}
+	if err = watcher.Add(path.Join(s.Path, "new")); err != nil {
+		log.Fatal("Add failed:", err)
+	}
+	folders[path.Clean(s.Path)] = true
+	go s.drain(ctx, path.Join(s.Path, "new"), cb)
+	s.watchFolders(ctx, watcher, folders, cb)
+
+	rescan := time.NewTicker(s.rescanInterval())
+	defer rescan.Stop()
+
+	// Files are taken once they settle, and settled tells which did.
+	settling := map[string]*time.Timer{}
+	settled := make(chan string)
+	defer func() {
+		for _, timer := range settling {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			logrus.WithField("filename", path.Base(event.Name)).WithField("op", event.Op.String()).Debug("change in the mail directory")
+			if event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+
+			parent, name := path.Dir(event.Name), path.Base(event.Name)
+			switch {
+			case path.Base(parent) == "new":
+				// A file renamed in from tmp/ is complete, and one written
+				// in place has writes after it is created.
+				filepath := event.Name
+				if timer, ok := settling[filepath]; ok {
+					timer.Reset(s.settleDelay())
+					continue
+				}
+				settling[filepath] = time.AfterFunc(s.settleDelay(), func() {
+					select {
+					case settled <- filepath:
+					case <-ctx.Done():
+					}
+				})
+			case event.Op&fsnotify.Create == 0:
+			case s.Recursive && path.Clean(parent) == path.Clean(s.Path) && s.takesFolder(name):
+				// The folder is watched for its new/ directory to appear.
+				if err := watcher.Add(event.Name); err != nil {
+					logrus.WithField("folder", name).Errorf("something happened while watching the maildir folder: %s", err)
+				}
+				s.watchFolder(ctx, watcher, folders, event.Name, cb)
+			case s.Recursive && name == "new" && s.takesFolder(path.Base(parent)):
+				s.watchFolder(ctx, watcher, folders, parent, cb)
+			}
+
+		case filepath := <-settled:
+			delete(settling, filepath)
+			// The watcher does not wait for the queue, its events would
+			// overflow while a backlog is drained.
+			s.Queue.Offer(filepath, func() { cb(filepath) })
+
+		case <-rescan.C:
+			s.rescan(ctx, watcher, folders, cb)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				logrus.WithField("source", s.Name).Warn("the mail directory watcher overflowed, the mail directory is read again")
+				s.rescan(ctx, watcher, folders, cb)
+				continue
+			}
+			logrus.WithField("source", s.Name).Errorf("something happened while watching the mail directory: %s", err)
+		}
+	}
+}
+
+// watchFolders watches the Maildir++ folders that are not watched yet.
+func (s *MaildirSource) watchFolders(ctx context.Context, watcher *fsnotify.Watcher, folders map[string]bool, cb func(string)) {
+	if !s.Recursive {
+		return
+	}
+
+	entries, err := os.ReadDir(s.Path)
+	if err != nil {
+		logrus.WithField("folder", s.Path).Errorf("something happened while reading the directory: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		folder := path.Join(s.Path, entry.Name())
+		if !entry.IsDir() || !s.takesFolder(entry.Name()) || folders[folder] {
+			continue
+		}
+		if err := watcher.Add(folder); err != nil {
+			logrus.WithField("folder", entry.Name()).Errorf("something happened while watching the maildir folder: %s", err)
+		}
+		s.watchFolder(ctx, watcher, folders, folder, cb)
+	}
+}
+
+// watchFolder watches the new/ directory of a folder, and takes the mail
+// that is already there.
+func (s *MaildirSource) watchFolder(ctx context.Context, watcher *fsnotify.Watcher, folders map[string]bool, folder string, cb func(string)) {
+	newEmailsPath := path.Join(folder, "new")
+	if folders[folder] {
+		return
+	}
+	if _, err := os.Stat(newEmailsPath); err != nil {
+		return
+	}
+
+	if err := watcher.Add(newEmailsPath); err != nil {
+		logrus.WithField("folder", folder).Errorf("something happened while watching the maildir folder: %s", err)
+		return
+	}
+	folders[folder] = true
+
+	// The backlog is drained while the watcher goes on, which finds the
+	// new mail in the meantime.
+	go s.drain(ctx, newEmailsPath, cb)
+}
+
+// rescan reads every folder again for mail and folders the watcher missed,
+// and cleans up tmp/. A rescan is skipped while the last one is running.
+func (s *MaildirSource) rescan(ctx context.Context, watcher *fsnotify.Watcher, folders map[string]bool, cb func(string)) {
+	if !atomic.CompareAndSwapInt32(&s.rescanning, 0, 1) {
+		return
+	}
+
+	s.watchFolders(ctx, watcher, folders, cb)
+	var paths []string
+	for folder := range folders {
+		paths = append(paths, folder)
+	}
+	sort.Strings(paths)
+
+	go func() {
+		defer atomic.StoreInt32(&s.rescanning, 0)
+		for _, folder := range paths {
+			cleanMaildirTmp(path.Join(folder, "tmp"))
+			s.drain(ctx, path.Join(folder, "new"), cb)
+		}
+	}()
+}
+
+// drain submits the mail waiting in a new/ directory, the oldest first.
+// Files that are still being written are left to the watcher, and files
+// waiting for a retry are left to their retry.
+func (s *MaildirSource) drain(ctx context.Context, newEmailsPath string, cb func(string)) {
+	entries, err := os.ReadDir(newEmailsPath)
+	if err != nil {
+		logrus.WithField("folder", newEmailsPath).Errorf("something happened while reading the directory: %s", err)
+	}
+
+	type backlogFile struct {
+		name    string
+		modTime time.Time
+	}
+	var backlog []backlogFile
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// It has been taken by the watcher.
+			continue
+		}
+		backlog = append(backlog, backlogFile{entry.Name(), info.ModTime()})
+	}
+	sort.Slice(backlog, func(i, j int) bool {
+		if !backlog[i].modTime.Equal(backlog[j].modTime) {
+			return backlog[i].modTime.Before(backlog[j].modTime)
+		}
+		return backlog[i].name < backlog[j].name
+	})
+
+	if len(backlog) > 0 {
+		logrus.WithField("folder", newEmailsPath).Infof("%d mails are waiting in the mail directory", len(backlog))
+	}
+	for _, file := range backlog {
+		if ctx.Err() != nil {
+			return
+		}
+
+		filepath := path.Join(newEmailsPath, file.name)
+		if s.Failures != nil && s.Failures.Waiting(filepath) {
+			continue
+		}
+		if wait := time.Until(file.modTime.Add(s.settleDelay())); wait > 0 {
+			time.Sleep(wait)
+			if info, err := os.Stat(filepath); err != nil || !info.ModTime().Equal(file.modTime) {
+				continue
+			}
+		}
+		s.submit(ctx, filepath, cb)
+	}
+}
+
+func (s *MaildirSource) submit(ctx context.Context, filepath string, cb func(string)) {
+	s.Queue.Submit(ctx, filepath, func() { cb(filepath) })
+}
+
+func (s *MaildirSource) rescanInterval() time.Duration {
+	if s.RescanInterval <= 0 {
+		return defaultMaildirRescanInterval
+	}
+	return s.RescanInterval
+}
+
+func (s *MaildirSource) settleDelay() time.Duration {
+	if s.SettleDelay <= 0 {
+		return defaultMaildirSettleDelay
+	}
+	return s.SettleDelay
+}
+
+// takesFolder tells whether Recursive takes a directory in the Maildir++
+// root.
+func (s *MaildirSource) takesFolder(name string) bool {
+	if !isMaildirFolder(name) {
+		return false
+	}
+	name = strings.TrimPrefix(name, ".")
+
+	excluded := s.ExcludeFolders
+	if excluded == nil {
+		excluded = defaultMaildirExcludedFolders
+	}
+	if hasMaildirFolder(excluded, name) {
+		return false
+	}
+	return len(s.Folders) == 0 || hasMaildirFolder(s.Folders, name)
+}
+
+// isMaildirFolder tells whether a directory in a Maildir++ root is a
+// folder, like ".Sent" or ".Lists.golang".
+func isMaildirFolder(name string) bool {
+	return len(name) > 1 && strings.HasPrefix(name, ".") && name != ".."
+}
+
+// hasMaildirFolder tells whether a folder, or a folder it is in, is in the
+// list. Folder names are compared without case.
+func hasMaildirFolder(folders []string, name string) bool {
+	for _, folder := range folders {
+		folder = strings.TrimPrefix(folder, ".")
+		if strings.EqualFold(name, folder) || len(name) > len(folder) && strings.EqualFold(name[:len(folder)+1], folder+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanMaildirTmp removes the files that deliveries left in tmp/.
+func cleanMaildirTmp(tmpPath string) {
+	entries, err := os.ReadDir(tmpPath)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() || time.Since(info.ModTime()) < maildirTmpLifetime {
+			continue
+		}
+		if err = os.Remove(path.Join(tmpPath, entry.Name())); err != nil {
+			logrus.WithField("filename", entry.Name()).Errorf("something happened while removing the stale file: %s", err)
+			continue
+		}
+		logrus.WithField("filename", entry.Name()).Info("stale file is removed from tmp")
+	}
+}
+
+// ingestMaildirFile processes a mail file in a Maildir and marks it as
+// read. Files that cannot be processed are left where they are, and the
+// error tells why. A file that is gone has been taken already.
+func ingestMaildirFile(ingester EmailIngester, filepath, filename, source string) error {
+	email, err := ReadAndParseEmailFile(filepath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return ingestError(err)
+	}
+	if filename != "" {
+		email.Filename = filename
+	}
+	email.Source = source
+
+	if err = ingester.IngestEmail(&email); err != nil {
+		log.Printf("Cannot process the email %s: %s\n", email.Filename, err)
+		return err
+	}
+
+	flags := MaildirSeen
+	if email.Passed {
+		flags += MaildirPassed
+	}
+	if err = markMaildirFile(filepath, flags); err != nil {
+		log.Printf("Cannot mark the email as read: %s\n", err)
+	}
+	return nil
+}
+
+// markMaildirFile moves a file from new/ to cur/ with the given flags.
+func markMaildirFile(filepath, flags string) error {
+	folder := path.Dir(path.Dir(filepath))
+	return os.Rename(filepath, path.Join(folder, "cur", withMaildirFlags(path.Base(filepath), flags)))
+}
+
+// flagMaildirFile adds flags to a mail in cur/, by the filename it is
+// stored with. The flags it already has are kept, even if they were
+// changed since it was ingested.
+func flagMaildirFile(root, filename, flags string) error {
+	current, err := findMaildirFile(root, filename)
+	if err != nil {
+		return err
+	}
+
+	flagged := path.Join(path.Dir(current), withMaildirFlags(path.Base(current), flags))
+	if flagged == current {
+		return nil
+	}
+	return os.Rename(current, flagged)
+}
+
+// removeMaildirFile removes a mail from cur/, by the filename it is stored
+// with.
+func removeMaildirFile(root, filename string) error {
+	current, err := findMaildirFile(root, filename)
+	if err != nil {
+		return err
+	}
+	return os.Remove(current)
+}
+
+// findMaildirFile finds the path of a mail in cur/, whatever its flags are.
+func findMaildirFile(root, filename string) (string, error) {
+	curPath := path.Join(root, path.Dir(filename), "cur")
+	unique, _ := splitMaildirName(path.Base(filename))
+
+	for _, candidate := range []string{withMaildirFlags(unique, MaildirSeen), withMaildirFlags(unique, MaildirSeen+MaildirPassed)} {
+		if _, err := os.Stat(path.Join(curPath, candidate)); err == nil {
+			return path.Join(curPath, candidate), nil
+		}
+	}
+
+	entries, err := os.ReadDir(curPath)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if name, _ := splitMaildirName(entry.Name()); name == unique {
+			return path.Join(curPath, entry.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("%s is not in %s: %w", unique, curPath, fs.ErrNotExist)
+}
+
+// splitMaildirName splits a Maildir file name into its unique part and its
+// flags, "1660000000.M1P2.host:2,RS" into "1660000000.M1P2.host" and "RS".
+func splitMaildirName(name string) (string, string) {
+	if i := strings.Index(name, ":2,"); i >= 0 {
+		return name[:i], name[i+len(":2,"):]
+	}
+	return name, ""
+}
+
+// withMaildirFlags adds flags to a Maildir file name. The flags are kept
+// in ASCII order, as the spec requires.
+func withMaildirFlags(name, flags string) string {
+	unique, current := splitMaildirName(name)
+
+	set := map[rune]bool{}
+	for _, flag := range current + flags {
+		set[flag] = true
+	}
+	var sorted []string
+	for flag := range set {
+		sorted = append(sorted, string(flag))
+	}
+	sort.Strings(sorted)
+	return unique + ":2," + strings.Join(sorted, "")
+}
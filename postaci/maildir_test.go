@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMaildirSourceIngestsFolders(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+
+	makeFolder := func(folder string) {
+		t.Helper()
+		for _, name := range []string{"tmp", "cur", "new"} {
+			if err := os.MkdirAll(path.Join(directory, folder, name), fs.ModePerm); err != nil {
+				t.Fatalf("cannot create the maildir: %s", err)
+			}
+		}
+	}
+	deliver := func(folder, filename, subject string) {
+		t.Helper()
+		content := "From: contact@example.org\nX-Original-To: ali@example.com\nSubject: " + subject + "\n\nhello\n"
+		if err := os.WriteFile(path.Join(directory, folder, "tmp", filename), []byte(content), fs.ModePerm); err != nil {
+			t.Fatalf("cannot write the mail: %s", err)
+		}
+		if err := os.Rename(path.Join(directory, folder, "tmp", filename), path.Join(directory, folder, "new", filename)); err != nil {
+			t.Fatalf("cannot deliver the mail: %s", err)
+		}
+	}
+	makeFolder("")
+	makeFolder(".Lists")
+	deliver(".Lists", "waiting", "waiting")
+	makeFolder(".Sent")
+	deliver(".Sent", "sent", "sent")
+	makeFolder(".Trash.old")
+	deliver(".Trash.old", "thrown", "thrown")
+
+	stale := path.Join(directory, "tmp", "crashed")
+	if err := os.WriteFile(stale, []byte("From: contact@example.org\n"), fs.ModePerm); err != nil {
+		t.Fatalf("cannot write the stale file: %s", err)
+	}
+	staleTime := time.Now().Add(-2 * maildirTmpLifetime)
+	if err := os.Chtimes(stale, staleTime, staleTime); err != nil {
+		t.Fatalf("cannot set the time of the stale file: %s", err)
+	}
+
+	ingester := &FakeIngester{}
+	source := &MaildirSource{
+		Name:           "example.com",
+		Path:           directory,
+		Recursive:      true,
+		Ingester:       ingester,
+		RescanInterval: 50 * time.Millisecond,
+		SettleDelay:    10 * time.Millisecond,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx)
+
+	waitFor(t, "1 mail to be ingested", func() bool { return ingester.count() >= 1 })
+	deliver("", "inbox", "inbox")
+	waitFor(t, "2 mails to be ingested", func() bool { return ingester.count() >= 2 })
+	makeFolder(".Later")
+	makeFolder(".Drafts")
+	time.Sleep(100 * time.Millisecond)
+	deliver(".Drafts", "draft", "draft")
+	deliver(".Later", "later", "later")
+	waitFor(t, "3 mails to be ingested", func() bool { return ingester.count() >= 3 })
+	time.Sleep(100 * time.Millisecond)
+
+	ingester.mutex.Lock()
+	defer ingester.mutex.Unlock()
+	var subjects []string
+	for _, email := range ingester.emails {
+		subjects = append(subjects, email.Subject)
+		if email.Source != "example.com" {
+			t.Errorf("expected the source to be example.com, but got %q", email.Source)
+		}
+		if email.Subject == "later" && email.Filename != ".Later/later" {
+			t.Errorf("expected the filename to have its folder, but got %q", email.Filename)
+		}
+	}
+	sort.Strings(subjects)
+	if len(subjects) != 3 || subjects[0] != "inbox" || subjects[1] != "later" || subjects[2] != "waiting" {
+		t.Errorf("unexpected mails %v", subjects)
+	}
+	if _, err := os.Stat(path.Join(directory, ".Later", "cur", "later:2,S")); err != nil {
+		t.Errorf("expected the mail to be marked as seen: %s", err)
+	}
+	if _, err := os.Stat(stale); err == nil {
+		t.Errorf("expected the stale file in tmp to be removed")
+	}
+}
+
+func TestMaildirSourceDrainsTheBacklogInOrder(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+
+	for _, name := range []string{"tmp", "cur", "new"} {
+		if err := os.Mkdir(path.Join(directory, name), fs.ModePerm); err != nil {
+			t.Fatalf("cannot create the maildir: %s", err)
+		}
+	}
+	arrival := time.Now().Add(-time.Hour)
+	for i, filename := range []string{"c", "a", "d", "b"} {
+		filepath := path.Join(directory, "new", filename)
+		content := "From: contact@example.org\nX-Original-To: ali@example.com\nSubject: " + filename + "\n\nhello\n"
+		if err := os.WriteFile(filepath, []byte(content), fs.ModePerm); err != nil {
+			t.Fatalf("cannot write the mail: %s", err)
+		}
+		modTime := arrival.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(filepath, modTime, modTime); err != nil {
+			t.Fatalf("cannot set the arrival time: %s", err)
+		}
+	}
+
+	ingester := &FakeIngester{}
+	queue := NewIngestQueue(1, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+	go (&MaildirSource{Name: "backlog", Path: directory, Ingester: ingester, Queue: queue}).Run(ctx)
+
+	waitFor(t, "the backlog to be ingested", func() bool { return ingester.count() >= 4 })
+
+	ingester.mutex.Lock()
+	defer ingester.mutex.Unlock()
+	var subjects []string
+	for _, email := range ingester.emails {
+		subjects = append(subjects, email.Subject)
+	}
+	if len(subjects) != 4 || subjects[0] != "c" || subjects[1] != "a" || subjects[2] != "d" || subjects[3] != "b" {
+		t.Errorf("expected the backlog to be ingested once in the order it arrived, but got %v", subjects)
+	}
+}
+
+func TestMaildirFlags(t *testing.T) {
+	if name := withMaildirFlags("1660000000.M1P2.host", MaildirSeen); name != "1660000000.M1P2.host:2,S" {
+		t.Errorf("unexpected name %s", name)
+	}
+	if name := withMaildirFlags("1660000000.M1P2.host:2,S", MaildirPassed); name != "1660000000.M1P2.host:2,PS" {
+		t.Errorf("unexpected name %s", name)
+	}
+
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+	if err := os.MkdirAll(path.Join(directory, ".Lists", "cur"), fs.ModePerm); err != nil {
+		t.Fatalf("cannot create the maildir: %s", err)
+	}
+	if err := os.WriteFile(path.Join(directory, ".Lists", "cur", "1660000000.M1P2.host:2,RS"), nil, fs.ModePerm); err != nil {
+		t.Fatalf("cannot write the mail: %s", err)
+	}
+
+	if err := flagMaildirFile(directory, ".Lists/1660000000.M1P2.host", MaildirPassed); err != nil {
+		t.Fatalf("cannot flag the mail: %s", err)
+	}
+	if _, err := os.Stat(path.Join(directory, ".Lists", "cur", "1660000000.M1P2.host:2,PRS")); err != nil {
+		t.Errorf("expected the flags to be added to the ones the mail has: %s", err)
+	}
+}
+
+func TestMaildirSourceFolders(t *testing.T) {
+	sources, err := ParseMaildirSources("maildir:///var/mail/a maildir:///var/mail/b?folder=Lists&folder=Work maildir:///var/mail/c?exclude=")
+	if err != nil || len(sources) != 3 {
+		t.Fatalf("cannot parse the sources: %v", err)
+	}
+
+	cases := []struct {
+		source int
+		folder string
+		takes  bool
+	}{
+		{0, ".Lists.golang", true},
+		{0, ".Sent", false},
+		{0, ".sent", false},
+		{0, ".Trash.2022", false},
+		{0, ".Sentinel", true},
+		{1, ".Lists", true},
+		{1, ".Work.Reports", true},
+		{1, ".Family", false},
+		{2, ".Sent", true},
+		{2, "new", false},
+	}
+	for _, c := range cases {
+		if takes := sources[c.source].takesFolder(c.folder); takes != c.takes {
+			t.Errorf("expected source %d to take %s %v, but got %v", c.source, c.folder, c.takes, takes)
+		}
+	}
+}
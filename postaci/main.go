@@ -1,35 +1,90 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
-	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"gorm.io/gorm"
 	"log"
 	"net"
 	"net/mail"
 	"os"
 	"path"
-	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	EmailInbound  = "inbound"
+	EmailOutbound = "outbound"
+)
+
 type Email struct {
 	gorm.Model
-	From     string
-	To       string
-	Filename string
-	SentDate time.Time
-	Content  []byte
+	From      string
+	To        string
+	Filename  string `gorm:"size:255;index"`
+	MessageID string `gorm:"size:255;index"`
+	SentDate  time.Time
+	Content   []byte
+	// Direction tells received mail from the mail we composed and sent.
+	Direction string `gorm:"size:16;default:inbound;index"`
+	Subject   string
+	// InReplyTo is a message id without angle brackets, while ReferenceIDs
+	// keeps the References field as "<id> <id>" so that it can be searched.
+	InReplyTo    string `gorm:"size:255;index"`
+	ReferenceIDs string
+	ThreadID     uint `gorm:"index"`
+	// Mailbox is the recipient without its subaddress, "user@domain" for
+	// mail to "user+tag@domain", and Subaddress is the tag.
+	Mailbox    string `gorm:"size:320;index"`
+	Subaddress string `gorm:"size:255;index"`
+	// Quarantined mail is kept but not announced, like mail that arrives on
+	// an expired alias.
+	Quarantined bool `gorm:"index"`
+	// Source is the label of the ingest source the mail came from.
+	Source string `gorm:"size:255;index"`
+	// Announced tells that the newemail event was emitted, so that mail
+	// received again is not announced twice.
+	Announced bool
+	// Passed tells the source that the mail was sent on while it was
+	// ingested.
+	Passed bool `gorm:"-"`
+	// UIDL is the id a POP3 server gives the mail, which is recorded with
+	// it.
+	UIDL string `gorm:"-"`
 }
 
 type mailingServerServer struct {
 	pb.UnimplementedMailingServerServer
-	MailSender
+	*Deliverer
 	EmailFinder
+	EmailStore
+	Threads      ThreadStore
+	Emails       EmailSearcher
+	Aliases      AliasStore
+	Suppressions SuppressionList
+
+	// ForwardFrom is the address forwards are sent on behalf of, and
+	// InternalHeaders are the headers that stripping internal headers removes.
+	ForwardFrom     string
+	InternalHeaders []string
+	// AliasDomain is the domain new aliases are created on.
+	AliasDomain string
+	// Quarantine holds the mail files that failed, and Ingester takes them
+	// when they are reprocessed.
+	Quarantine QuarantineStore
+	Ingester   EmailIngester
+	// Maildirs are the paths of the Maildir sources by their labels, where
+	// forwarded mail gets the Passed flag.
+	Maildirs map[string]string
 }
 
 func (m *mailingServerServer) ForwardMail(ctx context.Context, request *pb.ForwardMailRequest) (*pb.ForwardMailResponse, error) {
@@ -41,48 +96,68 @@ func (m *mailingServerServer) ForwardMail(ctx context.Context, request *pb.Forwa
 	email, err := m.EmailFinder.FindEmail(mailId)
 	if err != nil {
 		logrus.Errorf("something happened while fetching mail content from database: %s", err)
-		return &pb.ForwardMailResponse{
-			Error:      err.Error(),
-			Successful: false,
-		}, err
+		return nil, findEmailStatus(err)
+	}
+	if email.Content == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "the content of mail %d is purged", mailId)
 	}
 
-	sender := email.From
-	content := email.Content
+	sender, content, err := m.forwardContent(email, request)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot rewrite the mail: %s", err)
+	}
 
-	err = m.MailSender.Send(ctx, sender, recipient, content)
+	delivery, err := m.Deliverer.Deliver(ctx, email, sender, recipient, content)
 	if err != nil {
 		logrus.Errorf("something happened while sending mail: %s", err)
-		return &pb.ForwardMailResponse{
-			Error:      err.Error(),
-			Successful: false,
-		}, err
+		return nil, sendErrorStatus(err)
+	}
+
+	if root, ok := m.Maildirs[email.Source]; ok && email.Filename != "" {
+		if err := flagMaildirFile(root, email.Filename, MaildirPassed); err != nil {
+			logrus.WithField("mailId", mailId).Warnf("cannot flag the mail file as passed: %s", err)
+		}
 	}
 
 	elapsed := time.Since(start)
 	logrus.WithFields(logrus.Fields{
-		"mailId":    mailId,
-		"recipient": recipient,
-		"sender":    sender,
-		"elapsed":   elapsed,
+		"mailId":     mailId,
+		"deliveryId": delivery.ID,
+		"recipient":  recipient,
+		"sender":     sender,
+		"status":     delivery.Status,
+		"elapsed":    elapsed,
 	}).Info("mail forwarded")
 	return &pb.ForwardMailResponse{
 		Error:      "",
 		Successful: true,
+		Deferred:   delivery.Status == DeliveryDeferred,
+		DeliveryId: uint64(delivery.ID),
 	}, nil
 }
 
 func ReadAndParseEmailFile(filepath string) (Email, error) {
-	file, err := os.Open(filepath)
+	content, err := os.ReadFile(filepath)
 	if err != nil {
+		log.Printf("Cannot read email file.")
 		return Email{}, err
 	}
 
-	message, err := mail.ReadMessage(file)
+	email, err := ParseEmail(content)
+	if err != nil {
+		return Email{}, err
+	}
+	email.Filename = path.Base(filepath)
+	return email, nil
+}
+
+// ParseEmail reads a received mail. Its recipient is taken from
+// X-Original-To, which sources that know the envelope recipient override.
+func ParseEmail(content []byte) (Email, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
 	if err != nil {
 		return Email{}, err
 	}
-	file.Close()
 
 	sentDate, err := message.Header.Date()
 	if err != nil {
@@ -104,130 +179,295 @@ func ReadAndParseEmailFile(filepath string) (Email, error) {
 		log.Printf("Cannot read the sender address: %s", err)
 	}
 
-	content, err := os.ReadFile(filepath)
-	if err != nil {
-		log.Printf("Cannot read email file.")
-		return Email{}, err
-	}
-
 	return Email{
-		Content:  content,
-		Filename: path.Base(file.Name()),
-		To:       receiverAddress.Address,
-		From:     senderAddress.Address,
-		SentDate: sentDate,
+		Content:      content,
+		To:           receiverAddress.Address,
+		From:         senderAddress.Address,
+		MessageID:    trimMessageID(message.Header.Get("Message-Id")),
+		SentDate:     sentDate,
+		Direction:    EmailInbound,
+		Subject:      decodeHeader(message.Header.Get("Subject")),
+		InReplyTo:    firstMessageID(message.Header.Get("In-Reply-To")),
+		ReferenceIDs: formatMessageIDs(parseMessageIDs(message.Header.Get("References"))),
 	}, nil
 }
 
+// FindIngestedEmail returns the mail stored from a file of a source for the
+// recipient, or nil when there is none.
+func FindIngestedEmail(source, filename, to string) (*Email, error) {
+	var email Email
+	result := db.Omit("content").Where("source = ? AND filename = ? AND `to` = ?", source, filename, to).First(&email)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &email, result.Error
+}
+
+func hasDeliveries(emailId uint) (bool, error) {
+	var count int64
+	err := db.Model(&Delivery{}).Where("email_id = ?", emailId).Count(&count).Error
+	return count > 0, err
+}
+
 func PersistEmail(email Email) (uint, error) {
-	result := db.Create(&email)
-	return email.ID, result.Error
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&email).Error; err != nil {
+			return err
+		}
+		if err := savePOP3UIDL(tx, email.Source, email.UIDL); err != nil {
+			return err
+		}
+		return threadEmail(tx, &email)
+	})
+	return email.ID, err
 }
 
+// MarkEmailAsRead moves a mail file from new/ to cur/ with the Seen flag.
 func MarkEmailAsRead(filepath string) error {
-	filename := path.Base(filepath)
-	newFolderPath := path.Dir(filepath)
-	postFixPath := path.Dir(newFolderPath)
+	return markMaildirFile(filepath, MaildirSeen)
+}
 
-	newPath := path.Join(postFixPath, "cur", filename)
+// EmitNewEmailMessage announces a stored mail as
+// "id|to|mailbox|subaddress|source".
+func EmitNewEmailMessage(producer MessageProducer, mailId uint, receiver, mailbox, subaddress, source string) error {
+	return producer.Produce(context.Background(), "newemail", fmt.Sprintf("%v|%s|%s|%s|%s", mailId, receiver, mailbox, subaddress, source))
+}
 
-	return os.Rename(filepath, newPath)
+// ListenIncomingEmails calls cb with the mail files that are in, or arrive
+// in, the new/ directory of a Maildir.
+func ListenIncomingEmails(postfixPath string, cb func(string)) {
+	(&MaildirSource{Path: postfixPath}).listen(context.Background(), cb)
 }
 
-func EmitNewEmailMessage(producer MessageProducer, mailId uint, receiver string) error {
-	return producer.Produce(context.Background(), "newemail", fmt.Sprintf("%v|%s", mailId, receiver))
+// Ingestor processes mail as it arrives in the mail directory.
+type Ingestor struct {
+	Producer MessageProducer
+	// Tokens verify the deliveries that notifications name.
+	Tokens *DeliveryTokens
+	// Aliases relays mail sent to aliases, when it is set.
+	Aliases *AliasRelay
+	// SubaddressDelimiters split tags off recipients, defaultSubaddressDelimiters
+	// when empty.
+	SubaddressDelimiters string
 }
 
-func ListenIncomingEmails(postfixPath string, cb func(string)) {
-	newEmailsPath := path.Join(postfixPath, "new")
+func OnNewEmail(producer MessageProducer) func(string) {
+	return (&Ingestor{Producer: producer}).Ingest
+}
 
-	filepath.Walk(newEmailsPath, func(path string, info os.FileInfo, err error) error {
-		if info == nil {
-			return nil
+// Ingest processes a mail file in the mail directory and marks it as read.
+// Files that cannot be processed are left where they are.
+func (i *Ingestor) Ingest(filepath string) {
+	ingestMaildirFile(i, filepath, "", "")
+}
+
+// IngestEmail runs a received mail through bounce and complaint handling,
+// aliases, storage and announcement. An error means the mail is not
+// processed and should be tried again. Mail with a filename is stored once
+// for its source and recipient, and a mail that was stored before only
+// goes through the steps it has not finished.
+func (i *Ingestor) IngestEmail(email *Email) error {
+	start := time.Now()
+
+	var err error
+
+	delimiters := i.SubaddressDelimiters
+	if delimiters == "" {
+		delimiters = defaultSubaddressDelimiters
+	}
+	email.Mailbox, email.Subaddress = splitSubaddress(email.To, delimiters)
+
+	if email.Filename != "" {
+		stored, err := FindIngestedEmail(email.Source, email.Filename, email.To)
+		if err != nil {
+			return fmt.Errorf("cannot look up the email in DB: %s", err)
 		}
+		if stored != nil {
+			return i.resume(email, stored, start)
+		}
+	}
 
-		if info.IsDir() {
-			return err
+	if report, err := ParseDeliveryReport(email.Content); err != nil {
+		log.Printf("Cannot parse the delivery status notification: %s\n", err)
+	} else if report != nil {
+		matched, err := HandleBounce(i.Producer, i.Tokens, email.To, report)
+		if err != nil {
+			return fmt.Errorf("cannot process the bounce: %s", err)
 		}
+		if matched {
+			return nil
+		}
+	}
 
+	if report, err := ParseFeedbackReport(email.Content); err != nil {
+		log.Printf("Cannot parse the feedback report: %s\n", err)
+	} else if report != nil {
+		matched, err := HandleComplaint(i.Producer, i.Tokens, report)
 		if err != nil {
-			logrus.WithField("filename", path).Errorf("something happened while reading the directory: %s", err)
+			return fmt.Errorf("cannot process the complaint: %s", err)
 		}
-		go cb(path)
-		return err
-	})
+		if matched {
+			return nil
+		}
+	}
 
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		log.Fatal("NewWatcher failed: ", err)
+	var admission *AliasAdmission
+	if i.Aliases != nil {
+		if admission, err = i.Aliases.Admit(email); err != nil {
+			return fmt.Errorf("cannot check the alias: %s", err)
+		}
 	}
-	defer watcher.Close()
 
-	err = watcher.Add(newEmailsPath)
+	switch {
+	case admission == nil:
+		email.ID, err = PersistEmail(*email)
+	case admission.Outcome != AliasRejected:
+		// The mail can still be rejected when the last use of the alias
+		// was taken in the meantime.
+		err = i.Aliases.Persist(email, admission)
+	}
 	if err != nil {
-		log.Fatal("Add failed:", err)
+		return fmt.Errorf("cannot persist the email to DB: %s", err)
 	}
 
-	for {
-		select {
-		case event, ok := <-watcher.Events:
-			if !ok {
-				return
-			}
-			logrus.WithField("filename", path.Base(event.Name)).WithField("op", event.Op.String()).Debug("change in the mail directory")
-			if event.Op == fsnotify.Create {
-				go cb(event.Name)
-			}
-
-		case err, ok := <-watcher.Errors:
-			if !ok {
-				return
-			}
-			log.Println("error:", err)
+	if admission != nil {
+		if err = i.Aliases.RecordHit(admission, email); err != nil {
+			log.Printf("Cannot record the alias hit: %s\n", err)
+		}
+		if admission.Outcome == AliasRejected {
+			return nil
 		}
 	}
+	return i.finish(email, admission, false, start)
 }
 
-func OnNewEmail(producer MessageProducer) func(string) {
-	return func(filepath string) {
-		start := time.Now()
+// resume finishes a mail that was stored by an earlier attempt, which
+// failed after storing it, or that is received again.
+func (i *Ingestor) resume(email, stored *Email, start time.Time) error {
+	email.ID, email.Quarantined = stored.ID, stored.Quarantined
+	if stored.Announced || stored.Quarantined {
+		logrus.WithFields(logrus.Fields{
+			"filename": email.Filename,
+			"emailId":  email.ID,
+			"source":   email.Source,
+		}).Info("mail is already processed")
+		return nil
+	}
 
+	var admission *AliasAdmission
+	if i.Aliases != nil {
 		var err error
-
-		var email Email
-		if email, err = ReadAndParseEmailFile(filepath); err != nil {
-			return
+		if admission, err = i.Aliases.Readmit(email); err != nil {
+			return fmt.Errorf("cannot check the alias: %s", err)
 		}
+	}
+	return i.finish(email, admission, true, start)
+}
 
-		var emailId uint
-		if emailId, err = PersistEmail(email); err != nil {
-			log.Printf("Cannot persist the email to DB: %s\n", err)
-			return
+// finish relays and announces a stored mail. A resumed mail is not relayed
+// again when it has been.
+func (i *Ingestor) finish(email *Email, admission *AliasAdmission, resumed bool, start time.Time) error {
+	emailId := email.ID
+
+	relayed := false
+	if resumed {
+		var err error
+		if relayed, err = hasDeliveries(emailId); err != nil {
+			return fmt.Errorf("cannot look up the deliveries of the email: %s", err)
 		}
+		email.Passed = relayed
+	}
 
-		if err = EmitNewEmailMessage(producer, emailId, email.To); err != nil {
-			log.Printf("Cannot produce new email message: %s\n", err)
-			return
+	if i.Aliases != nil && !relayed {
+		// Relays that fail for now are deferred and retried. A delivery
+		// the relay refused is recorded as failed, anything else is an
+		// error and the mail is tried again.
+		relayed, err := i.Aliases.Relay(context.Background(), email, admission)
+		var sendErr *SendError
+		var suppressedErr *SuppressedError
+		if errors.As(err, &sendErr) || errors.As(err, &suppressedErr) {
+			logrus.WithField("emailId", emailId).Warnf("mail is not relayed through its alias: %s", err)
+		} else if err != nil {
+			return fmt.Errorf("cannot relay the mail through its alias: %w", err)
 		}
+		email.Passed = err == nil && relayed && (admission == nil || admission.Outcome == AliasForwarded)
+	}
 
-		if err = MarkEmailAsRead(filepath); err != nil {
-			log.Printf("Cannot mark the email as read: %s\n", err)
-			return
+	if !email.Quarantined {
+		if err := EmitNewEmailMessage(i.Producer, emailId, email.To, email.Mailbox, email.Subaddress, email.Source); err != nil {
+			return fmt.Errorf("cannot produce new email message: %s", err)
 		}
+		if err := db.Model(&Email{}).Where("id = ?", emailId).Update("announced", true).Error; err != nil {
+			logrus.WithField("emailId", emailId).Errorf("something happened while marking the mail as announced: %s", err)
+		}
+	}
 
-		elapsed := time.Since(start)
-		logrus.WithFields(logrus.Fields{
-			"filename": email.Filename,
-			"emailId":  emailId,
-			"to":       email.To,
-			"elapsed":  elapsed,
-		}).Infof("mail is processed as received mail")
+	elapsed := time.Since(start)
+	logrus.WithFields(logrus.Fields{
+		"filename": email.Filename,
+		"emailId":  emailId,
+		"to":       email.To,
+		"source":   email.Source,
+		"elapsed":  elapsed,
+	}).Infof("mail is processed as received mail")
+	return nil
+}
+
+func durationFromEnv(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Warnf("cannot parse %s as a duration, %v will be used instead: %s", key, fallback, err)
+		return fallback
+	}
+	return duration
+}
+
+func intFromEnv(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
 	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Warnf("cannot parse %s as a number, %v will be used instead: %s", key, fallback, err)
+		return fallback
+	}
+	return number
+}
+
+func listFromEnv(key string) []string {
+	return strings.FieldsFunc(os.Getenv(key), func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+func limitFromEnv(key string) Limit {
+	limit, err := ParseLimit(os.Getenv(key))
+	if err != nil {
+		logrus.Fatalf("cannot configure %s: %s", key, err)
+	}
+	return limit
+}
+
+// maildirSourcesFromEnv reads MAILDIR_SOURCES, with POSTFIX_PATH as the
+// "postfix" source.
+func maildirSourcesFromEnv() []*MaildirSource {
+	sources, err := ParseMaildirSources(os.Getenv("MAILDIR_SOURCES"))
+	if err != nil {
+		logrus.Fatalf("cannot configure maildir sources: %s", err)
+	}
+	if postfixPath := os.Getenv("POSTFIX_PATH"); postfixPath != "" {
+		sources = append([]*MaildirSource{{Name: "postfix", Path: postfixPath}}, sources...)
+	}
+	return sources
 }
 
 func main() {
 	dsn := os.Getenv("MYSQL_DSN")
-	postfixPath := os.Getenv("POSTFIX_PATH")
 	kafkaAddress := os.Getenv("KAFKA_ADDRESS")
 	kafkaUsername := os.Getenv("KAFKA_USERNAME")
 	kafkaPassword := os.Getenv("KAFKA_PASSWORD")
@@ -236,25 +476,198 @@ func main() {
 	logrus.SetReportCaller(false)
 	logrus.SetFormatter(&logrus.TextFormatter{PadLevelText: true})
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "purge":
+			runPurge(os.Args[2:])
+			return
+		}
+	}
+
 	persistence := &Persistence{}
 	persistence.Initialize(dsn)
 
 	messageBroker := &MessageBroker{}
 	messageBroker.Initialize(kafkaAddress, kafkaUsername, kafkaPassword)
 
-	mailSender := &SMPTService{
-		Host: "127.0.0.1",
-		Port: 25,
+	smtpDefaults := SMPTService{
+		Host:           "127.0.0.1",
+		Port:           25,
+		DialTimeout:    durationFromEnv("SMTP_DIAL_TIMEOUT", defaultDialTimeout),
+		CommandTimeout: durationFromEnv("SMTP_COMMAND_TIMEOUT", defaultCommandTimeout),
+		DataTimeout:    durationFromEnv("SMTP_DATA_TIMEOUT", defaultDataTimeout),
+		LocalName:      os.Getenv("SMTP_LOCAL_NAME"),
+		DSN: DSNOptions{
+			Notify: os.Getenv("SMTP_DSN_NOTIFY"),
+			Return: os.Getenv("SMTP_DSN_RET"),
+		},
+	}
+
+	tokens := &DeliveryTokens{Secret: []byte(os.Getenv("VERP_SECRET")), ReturnPath: os.Getenv("VERP_RETURN_PATH")}
+	if len(tokens.Secret) == 0 {
+		logrus.Warn("VERP_SECRET is not set, bounces are only matched by their Message-Id")
+	}
+
+	relays := []*Relay{{Name: "local", Sender: &smtpDefaults, Weight: 1}}
+	if spec := os.Getenv("SMTP_RELAYS"); spec != "" {
+		var err error
+		if relays, err = ParseRelays(spec, smtpDefaults); err != nil {
+			logrus.Fatalf("cannot configure smtp relays: %s", err)
+		}
+	}
+
+	relayPool := NewRelayPool(relays)
+	relayPool.OpenDuration = durationFromEnv("SMTP_RELAY_OPEN_DURATION", defaultOpenDuration)
+	go relayPool.MonitorHealth(context.Background(), durationFromEnv("SMTP_RELAY_HEALTH_CHECK_INTERVAL", defaultHealthCheckInterval))
+
+	rateLimiter := &RateLimiter{
+		Global:    limitFromEnv("RATE_LIMIT_GLOBAL"),
+		PerSender: limitFromEnv("RATE_LIMIT_PER_SENDER"),
+		PerDomain: limitFromEnv("RATE_LIMIT_PER_DOMAIN"),
+	}
+	var err error
+	if rateLimiter.Domains, err = ParseDomainLimits(os.Getenv("RATE_LIMIT_DOMAINS")); err != nil {
+		logrus.Fatalf("cannot configure rate limits: %s", err)
+	}
+
+	deliverer := &Deliverer{
+		Sender: &ThrottledSender{
+			MailSender: &VERPSender{MailSender: relayPool, ReturnPath: tokens.ReturnPath},
+			Limiter:    rateLimiter,
+		},
+		Store:        persistence,
+		EmailFinder:  persistence,
+		Suppressions: persistence,
+		Tokens:       tokens,
+		RetryBackoff: durationFromEnv("DELIVERY_RETRY_BACKOFF", defaultRetryBackoff),
+	}
+	go deliverer.RunRetries(context.Background(), durationFromEnv("DELIVERY_RETRY_INTERVAL", defaultRetryInterval))
+
+	if metricsAddress := os.Getenv("METRICS_ADDRESS"); metricsAddress != "" {
+		go ServeMetrics(metricsAddress)
+	}
+
+	ingestor := &Ingestor{
+		Producer:             messageBroker,
+		Tokens:               tokens,
+		SubaddressDelimiters: os.Getenv("SUBADDRESS_DELIMITERS"),
+		Aliases: &AliasRelay{
+			Deliverer:       deliverer,
+			Store:           persistence,
+			InternalHeaders: listFromEnv("INTERNAL_HEADERS"),
+		},
+	}
+	ingestQueue := NewIngestQueue(intFromEnv("INGEST_WORKERS", defaultIngestWorkers), intFromEnv("INGEST_QUEUE_SIZE", defaultIngestQueueSize))
+	go ingestQueue.Run(context.Background())
+
+	failurePolicy := &FailurePolicy{
+		MaxAttempts: intFromEnv("INGEST_MAX_ATTEMPTS", defaultIngestAttempts),
+		Backoff:     durationFromEnv("INGEST_RETRY_BACKOFF", defaultIngestRetryBackoff),
+		Directory:   os.Getenv("QUARANTINE_PATH"),
+		Store:       persistence,
+	}
+
+	var sources []IngestSource
+	maildirs := map[string]string{}
+	for _, source := range maildirSourcesFromEnv() {
+		source.Ingester = ingestor
+		source.Queue = ingestQueue
+		source.Failures = failurePolicy
+		source.RescanInterval = durationFromEnv("MAILDIR_RESCAN_INTERVAL", defaultMaildirRescanInterval)
+		source.SettleDelay = durationFromEnv("MAILDIR_SETTLE_DELAY", defaultMaildirSettleDelay)
+		maildirs[source.Name] = source.Path
+		sources = append(sources, source)
+	}
+
+	imapSources, err := ParseIMAPSources(os.Getenv("IMAP_SOURCES"))
+	if err != nil {
+		logrus.Fatalf("cannot configure imap sources: %s", err)
+	}
+	for _, source := range imapSources {
+		source.Ingester = ingestor
+		source.Failures = failurePolicy
+		sources = append(sources, source)
 	}
 
-	go ListenIncomingEmails(postfixPath, OnNewEmail(messageBroker))
+	pop3Sources, err := ParsePOP3Sources(os.Getenv("POP3_SOURCES"))
+	if err != nil {
+		logrus.Fatalf("cannot configure pop3 sources: %s", err)
+	}
+	for _, source := range pop3Sources {
+		source.Store = persistence
+		source.Ingester = ingestor
+		source.Failures = failurePolicy
+		sources = append(sources, source)
+	}
+
+	routingRules := &RoutingRules{Domains: listFromEnv("INGRESS_DOMAINS"), Aliases: persistence}
+	for _, ingress := range []struct {
+		key  string
+		lmtp bool
+	}{{"LMTP_ADDRESS", true}, {"SMTP_INGRESS_ADDRESS", false}} {
+		if address := os.Getenv(ingress.key); address != "" {
+			if !ingress.lmtp && len(routingRules.Domains) == 0 {
+				logrus.Fatalf("%s needs INGRESS_DOMAINS, the domains mail is accepted for", ingress.key)
+			}
+			sources = append(sources, &IngressServer{
+				Address:        address,
+				LMTP:           ingress.lmtp,
+				Hostname:       os.Getenv("INGRESS_HOSTNAME"),
+				MaxMessageSize: int64(intFromEnv("INGRESS_MAX_MESSAGE_SIZE", defaultMaxMessageSize)),
+				Timeout:        durationFromEnv("INGRESS_TIMEOUT", defaultIngressTimeout),
+				Rules:          routingRules,
+				Ingester:       ingestor,
+			})
+		}
+	}
+
+	for _, source := range sources {
+		logrus.WithField("source", source.Label()).Info("receiving mail")
+		go source.Run(context.Background())
+	}
+	go RunAliasCleanup(context.Background(), persistence, defaultAliasCleanupInterval, durationFromEnv("ALIAS_RETENTION", defaultAliasRetention))
+
+	retentionPolicies, err := ParseRetentionPolicies(os.Getenv("RETENTION_POLICIES"))
+	if err != nil {
+		logrus.Fatalf("cannot configure retention policies: %s", err)
+	}
+	if len(retentionPolicies) > 0 {
+		go RunPurger(context.Background(), &Purger{
+			Policies:  retentionPolicies,
+			Store:     persistence,
+			Producer:  messageBroker,
+			Maildirs:  maildirs,
+			DryRun:    os.Getenv("RETENTION_DRY_RUN") == "true",
+			BatchSize: intFromEnv("RETENTION_BATCH_SIZE", defaultRetentionBatchSize),
+		}, durationFromEnv("RETENTION_INTERVAL", defaultRetentionInterval))
+	}
 
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", 5000))
 	if err != nil {
 		logrus.Fatal("Failed to create a listener on port 5000")
 	}
 	server := grpc.NewServer()
-	pb.RegisterMailingServerServer(server, &mailingServerServer{MailSender: mailSender, EmailFinder: persistence})
+	pb.RegisterMailingServerServer(server, &mailingServerServer{
+		Deliverer:       deliverer,
+		EmailFinder:     persistence,
+		EmailStore:      persistence,
+		Threads:         persistence,
+		Emails:          persistence,
+		Aliases:         persistence,
+		Suppressions:    persistence,
+		ForwardFrom:     os.Getenv("FORWARD_FROM"),
+		InternalHeaders: listFromEnv("INTERNAL_HEADERS"),
+		AliasDomain:     os.Getenv("ALIAS_DOMAIN"),
+		Quarantine:      persistence,
+		Ingester:        ingestor,
+		Maildirs:        maildirs,
+	})
 	if err = server.Serve(listener); err != nil {
 		logrus.Fatal("Failed to listen")
 	}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Metrics are published with expvar and can be scraped from /debug/vars.
+var (
+	relayMetrics     = expvar.NewMap("relays")
+	rateLimitMetrics = expvar.NewMap("rateLimits")
+	deliveryMetrics  = expvar.NewMap("deliveries")
+	ingestMetrics    = expvar.NewMap("ingest")
+	retentionMetrics = expvar.NewMap("retention")
+
+	metricsMutex sync.Mutex
+)
+
+// metricsFor returns the map holding the metrics of a single named entity
+// under parent, creating it on first use.
+func metricsFor(parent *expvar.Map, name string) *expvar.Map {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	if existing, ok := parent.Get(name).(*expvar.Map); ok {
+		return existing
+	}
+
+	metrics := new(expvar.Map).Init()
+	parent.Set(name, metrics)
+	return metrics
+}
+
+func intVar(n int) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(int64(n))
+	return v
+}
+
+func ServeMetrics(address string) {
+	if err := http.ListenAndServe(address, nil); err != nil {
+		logrus.Errorf("something happened while serving metrics: %s", err)
+	}
+}
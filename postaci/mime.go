@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// decodeTransferEncoding undoes the Content-Transfer-Encoding of a body.
+// Identity encodings are passed through untouched.
+func decodeTransferEncoding(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
+}
+
+// trimMessageID turns "<id@host>" into "id@host".
+func trimMessageID(id string) string {
+	return strings.Trim(strings.TrimSpace(id), "<>")
+}
+
+// parseMessageIDs returns the ids in a field like References, in order and
+// without angle brackets.
+func parseMessageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			return ids
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			return ids
+		}
+		if id := strings.TrimSpace(value[start+1 : start+end]); id != "" {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+func firstMessageID(value string) string {
+	if ids := parseMessageIDs(value); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+func formatMessageIDs(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	return "<" + strings.Join(ids, "> <") + ">"
+}
+
+// generateMessageID returns a new globally unique Message-Id, without the
+// angle brackets, for the domain of the given address.
+func generateMessageID(address string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		domain = address[at+1:]
+	}
+
+	random := make([]byte, 8)
+	rand.Read(random)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(random), domain)
+}
+
+// encodeHeaderValue turns non ASCII text into RFC 2047 encoded words.
+func encodeHeaderValue(value string) string {
+	if isASCII([]byte(value)) {
+		return value
+	}
+	return mime.QEncoding.Encode("utf-8", value)
+}
+
+// MailParts is the readable content of a stored mail: its header, the first
+// text and HTML versions of the body decoded to UTF-8, and its attachments.
+type MailParts struct {
+	Header      mail.Header
+	Text        string
+	HTML        string
+	Attachments []Attachment
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+// ReadMailParts walks the MIME structure of content.
+func ReadMailParts(content []byte) (*MailParts, error) {
+	message, err := mail.ReadMessage(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	parts := &MailParts{Header: message.Header}
+	err = parts.walk(textproto.MIMEHeader(message.Header), message.Body)
+	return parts, err
+}
+
+func (p *MailParts) walk(header textproto.MIMEHeader, body io.Reader) error {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	disposition, dispositionParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispositionParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err = p.walk(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	decoded, err := io.ReadAll(decodeTransferEncoding(header.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	isAttachment := disposition == "attachment" || filename != ""
+	switch {
+	case mediaType == "text/plain" && !isAttachment && p.Text == "":
+		p.Text = decodeCharset(params["charset"], decoded)
+	case mediaType == "text/html" && !isAttachment && p.HTML == "":
+		p.HTML = decodeCharset(params["charset"], decoded)
+	case isAttachment || !strings.HasPrefix(mediaType, "text/"):
+		p.Attachments = append(p.Attachments, Attachment{
+			Filename:    decodeHeader(filename),
+			ContentType: mediaType,
+			Content:     decoded,
+		})
+	}
+	return nil
+}
+
+// decodeHeader turns RFC 2047 encoded words into UTF-8, leaving the value as
+// it is when it cannot be decoded.
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// stripLineBreaks turns the line breaks of a decoded header value into
+// spaces, so that it can be written to a header again.
+func stripLineBreaks(value string) string {
+	return strings.Join(strings.FieldsFunc(value, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+func decodeCharset(charset string, content []byte) string {
+	if charset == "" || strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(content)
+	}
+
+	reader, err := charsetReader(charset, bytes.NewReader(content))
+	if err != nil {
+		return string(content)
+	}
+	decoded, err := io.ReadAll(reader)
+	if err != nil {
+		return string(content)
+	}
+	return string(decoded)
+}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	encoding, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, err
+	}
+	return encoding.NewDecoder().Reader(input), nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"time"
+
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
@@ -18,10 +20,40 @@ type EmailFinder interface {
 
 func (p *Persistence) FindEmail(emailId uint64) (*Email, error) {
 	var email Email
-	result := db.Find(&email, emailId)
+	result := db.First(&email, emailId)
 	return &email, result.Error
 }
 
+type EmailStore interface {
+	CreateEmail(email *Email) error
+}
+
+func (p *Persistence) CreateEmail(email *Email) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(email).Error; err != nil {
+			return err
+		}
+		return threadEmail(tx, email)
+	})
+}
+
+func (p *Persistence) CreateDelivery(delivery *Delivery) error {
+	return db.Create(delivery).Error
+}
+
+func (p *Persistence) SaveDelivery(delivery *Delivery) error {
+	return db.Save(delivery).Error
+}
+
+func (p *Persistence) FindDueDeliveries(now time.Time, limit int) ([]Delivery, error) {
+	var deliveries []Delivery
+	result := db.Where("status = ? AND next_attempt_at <= ?", DeliveryDeferred, now).
+		Order("next_attempt_at").
+		Limit(limit).
+		Find(&deliveries)
+	return deliveries, result.Error
+}
+
 func (p *Persistence) Initialize(dsn string) {
 	var err error
 	db, err = gorm.Open(mysql.Open(dsn), &gorm.Config{
@@ -32,7 +64,10 @@ func (p *Persistence) Initialize(dsn string) {
 		log.Fatal(err.Error())
 		return
 	}
-	db.AutoMigrate(&Email{})
+	db.AutoMigrate(&Email{}, &Thread{}, &Delivery{}, &Bounce{}, &Suppression{}, &Alias{}, &ReverseAlias{}, &AliasHit{}, &AliasTombstone{}, &POP3Message{}, &QuarantinedMail{})
+	if err = migrateEmailReferences(db); err != nil {
+		log.Fatal(err.Error())
+	}
 }
 
 func (p *Persistence) InitializeTesting() {
@@ -45,5 +80,8 @@ func (p *Persistence) InitializeTesting() {
 		log.Fatal(err.Error())
 		return
 	}
-	db.AutoMigrate(&Email{})
+	db.AutoMigrate(&Email{}, &Thread{}, &Delivery{}, &Bounce{}, &Suppression{}, &Alias{}, &ReverseAlias{}, &AliasHit{}, &AliasTombstone{}, &POP3Message{}, &QuarantinedMail{})
+	if err = migrateEmailReferences(db); err != nil {
+		log.Fatal(err.Error())
+	}
 }
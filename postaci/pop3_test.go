@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type FakePOP3Store struct {
+	uidls map[string]bool
+}
+
+func (f *FakePOP3Store) FindPOP3UIDLs(source string) (map[string]bool, error) {
+	seen := map[string]bool{}
+	for uidl := range f.uidls {
+		seen[uidl] = true
+	}
+	return seen, nil
+}
+
+func (f *FakePOP3Store) SavePOP3UIDL(source, uidl string) error {
+	f.uidls[uidl] = true
+	return nil
+}
+
+func (f *FakePOP3Store) ForgetPOP3UIDLs(source string, keep []string) error {
+	kept := map[string]bool{}
+	for _, uidl := range keep {
+		kept[uidl] = true
+	}
+	for uidl := range f.uidls {
+		if !kept[uidl] {
+			delete(f.uidls, uidl)
+		}
+	}
+	return nil
+}
+
+// fakePOP3Server serves a mailbox of messages keyed by their uidl, and
+// removes the deleted ones when the session ends with QUIT.
+type fakePOP3Server struct {
+	mutex    sync.Mutex
+	uidls    []string
+	messages map[string]string
+}
+
+func (f *fakePOP3Server) add(uidl, message string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.uidls = append(f.uidls, uidl)
+	f.messages[uidl] = message
+}
+
+func (f *fakePOP3Server) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		f.session(textproto.NewConn(conn))
+	}
+}
+
+func (f *fakePOP3Server) session(text *textproto.Conn) {
+	defer text.Close()
+
+	f.mutex.Lock()
+	uidls := append([]string(nil), f.uidls...)
+	f.mutex.Unlock()
+	deleted := map[string]bool{}
+
+	text.PrintfLine("+OK ready")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		number := 0
+		if len(fields) > 1 {
+			number, _ = strconv.Atoi(fields[1])
+		}
+
+		switch fields[0] {
+		case "USER", "PASS":
+			text.PrintfLine("+OK")
+		case "UIDL":
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			for i, uidl := range uidls {
+				if !deleted[uidl] {
+					fmt.Fprintf(w, "%d %s\n", i+1, uidl)
+				}
+			}
+			w.Close()
+		case "RETR":
+			text.PrintfLine("+OK")
+			w := text.DotWriter()
+			f.mutex.Lock()
+			fmt.Fprint(w, f.messages[uidls[number-1]])
+			f.mutex.Unlock()
+			w.Close()
+		case "DELE":
+			deleted[uidls[number-1]] = true
+			text.PrintfLine("+OK")
+		case "QUIT":
+			f.mutex.Lock()
+			var kept []string
+			for _, uidl := range f.uidls {
+				if !deleted[uidl] {
+					kept = append(kept, uidl)
+				}
+			}
+			f.uidls = kept
+			f.mutex.Unlock()
+			text.PrintfLine("+OK bye")
+			return
+		default:
+			text.PrintfLine("-ERR unknown command")
+		}
+	}
+}
+
+func TestPOP3SourceIngestsEveryMessageOnce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	server := &fakePOP3Server{messages: map[string]string{}}
+	server.add("a1", "From: contact@example.org\nSubject: first\n\nhello\n.dotted line\n")
+	server.add("b2", "From: contact@example.org\nSubject: second\n\nhello\n")
+	go server.serve(listener)
+
+	ingester := &FakeIngester{}
+	store := &FakePOP3Store{uidls: map[string]bool{}}
+	source := &POP3Source{
+		Name:      "pop3-test",
+		Address:   listener.Addr().String(),
+		Insecure:  true,
+		Recipient: "ali@example.com",
+		Store:     store,
+		Ingester:  ingester,
+	}
+
+	if err = source.Poll(); err != nil {
+		t.Fatalf("cannot poll: %s", err)
+	}
+	server.add("c3", "From: contact@example.org\nSubject: third\n\nhello\n")
+	if err = source.Poll(); err != nil {
+		t.Fatalf("cannot poll: %s", err)
+	}
+
+	if len(ingester.emails) != 3 {
+		t.Fatalf("expected every message to be ingested once, but got %d", len(ingester.emails))
+	}
+	if ingester.emails[0].To != "ali@example.com" || ingester.emails[2].Subject != "third" {
+		t.Errorf("unexpected mail %+v", ingester.emails[0])
+	}
+	if !strings.Contains(string(ingester.emails[0].Content), "\n.dotted line") {
+		t.Errorf("expected the dot stuffing to be removed, but got %q", ingester.emails[0].Content)
+	}
+	if len(server.uidls) != 3 {
+		t.Errorf("expected the messages to be kept on the server, but got %v", server.uidls)
+	}
+
+	source.Delete = true
+	if err = source.Poll(); err != nil {
+		t.Fatalf("cannot poll: %s", err)
+	}
+	if len(ingester.emails) != 3 || len(server.uidls) != 0 {
+		t.Errorf("expected ingested messages to be deleted without ingesting them again, but got %d and %v", len(ingester.emails), server.uidls)
+	}
+	if err = source.Poll(); err != nil {
+		t.Fatalf("cannot poll: %s", err)
+	}
+	if len(store.uidls) != 0 {
+		t.Errorf("expected the records of deleted messages to be forgotten, but got %v", store.uidls)
+	}
+}
+
+func TestPOP3SourceQuarantinesMailThatCannotBeParsed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	server := &fakePOP3Server{messages: map[string]string{}}
+	server.add("x9", "this is not a mail\n")
+	go server.serve(listener)
+
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer os.RemoveAll(directory)
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	ingester := &FakeIngester{}
+	source := &POP3Source{
+		Name:     "pop3-garbage-test",
+		Address:  listener.Addr().String(),
+		Insecure: true,
+		Delete:   true,
+		Store:    &FakePOP3Store{uidls: map[string]bool{}},
+		Ingester: ingester,
+		Failures: &FailurePolicy{Directory: directory, Store: persistence},
+	}
+	for i := 0; i < 2; i++ {
+		if err = source.Poll(); err != nil {
+			t.Fatalf("cannot poll: %s", err)
+		}
+	}
+
+	quarantined, _ := persistence.ListQuarantinedMail("pop3-garbage-test", 10, 0)
+	if len(quarantined) != 1 || quarantined[0].Filename != "x9" {
+		t.Fatalf("expected the mail to be quarantined once, but got %+v", quarantined)
+	}
+	if len(ingester.emails) != 0 || len(server.uidls) != 0 {
+		t.Errorf("expected the quarantined mail to be deleted from the server, but got %v", server.uidls)
+	}
+}
+
+func TestPOP3SourceDoesNotSendCredentialsInCleartext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	defer listener.Close()
+
+	sources, err := ParsePOP3Sources("pop3://user:secret@" + listener.Addr().String())
+	if err != nil || len(sources) != 1 {
+		t.Fatalf("cannot parse the source: %v", err)
+	}
+	if err = sources[0].Poll(); err == nil {
+		t.Fatalf("expected a source without TLS to be refused")
+	}
+
+	listener.(*net.TCPListener).SetDeadline(time.Now().Add(50 * time.Millisecond))
+	if conn, err := listener.Accept(); err == nil {
+		conn.Close()
+		t.Errorf("expected the source not to connect to the server")
+	}
+
+	sources, _ = ParsePOP3Sources("pop3://user:secret@" + listener.Addr().String() + "?insecure=true")
+	if !sources[0].Insecure {
+		t.Errorf("expected insecure=true to let the source send the credentials")
+	}
+}
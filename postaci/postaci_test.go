@@ -83,7 +83,7 @@ func TestListenNewEmailFile(t *testing.T) {
 				t.Errorf("expected recipient to be %s, but got %s", "sample_email", email.From)
 			}
 
-			if !fakeMessageProducer.IsCalledWith("newemail", fmt.Sprintf("%v|%s", email.ID, email.To)) {
+			if !fakeMessageProducer.IsCalledWith("newemail", fmt.Sprintf("%v|%s|%s||", email.ID, email.To, email.To)) {
 				t.Errorf("message broker is not called with correct arguments")
 			}
 
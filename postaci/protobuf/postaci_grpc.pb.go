@@ -23,6 +23,23 @@ const _ = grpc.SupportPackageIsVersion7
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MailingServerClient interface {
 	ForwardMail(ctx context.Context, in *ForwardMailRequest, opts ...grpc.CallOption) (*ForwardMailResponse, error)
+	SendMail(ctx context.Context, in *SendMailRequest, opts ...grpc.CallOption) (*SendMailResponse, error)
+	ReplyToEmail(ctx context.Context, in *ReplyToEmailRequest, opts ...grpc.CallOption) (*SendMailResponse, error)
+	SearchEmails(ctx context.Context, in *SearchEmailsRequest, opts ...grpc.CallOption) (*SearchEmailsResponse, error)
+	ListThreads(ctx context.Context, in *ListThreadsRequest, opts ...grpc.CallOption) (*ListThreadsResponse, error)
+	GetThread(ctx context.Context, in *GetThreadRequest, opts ...grpc.CallOption) (*GetThreadResponse, error)
+	CreateAlias(ctx context.Context, in *CreateAliasRequest, opts ...grpc.CallOption) (*Alias, error)
+	ListAliases(ctx context.Context, in *ListAliasesRequest, opts ...grpc.CallOption) (*ListAliasesResponse, error)
+	UpdateAlias(ctx context.Context, in *UpdateAliasRequest, opts ...grpc.CallOption) (*Alias, error)
+	DeleteAlias(ctx context.Context, in *DeleteAliasRequest, opts ...grpc.CallOption) (*DeleteAliasResponse, error)
+	ListAliasHits(ctx context.Context, in *ListAliasHitsRequest, opts ...grpc.CallOption) (*ListAliasHitsResponse, error)
+	ListSuppressions(ctx context.Context, in *ListSuppressionsRequest, opts ...grpc.CallOption) (*ListSuppressionsResponse, error)
+	AddSuppression(ctx context.Context, in *AddSuppressionRequest, opts ...grpc.CallOption) (*Suppression, error)
+	RemoveSuppression(ctx context.Context, in *RemoveSuppressionRequest, opts ...grpc.CallOption) (*RemoveSuppressionResponse, error)
+	ListQuarantinedMail(ctx context.Context, in *ListQuarantinedMailRequest, opts ...grpc.CallOption) (*ListQuarantinedMailResponse, error)
+	ReprocessQuarantinedMail(ctx context.Context, in *ReprocessQuarantinedMailRequest, opts ...grpc.CallOption) (*ReprocessQuarantinedMailResponse, error)
+	DiscardQuarantinedMail(ctx context.Context, in *DiscardQuarantinedMailRequest, opts ...grpc.CallOption) (*DiscardQuarantinedMailResponse, error)
+	ExportEmails(ctx context.Context, in *ExportEmailsRequest, opts ...grpc.CallOption) (MailingServer_ExportEmailsClient, error)
 }
 
 type mailingServerClient struct {
@@ -42,11 +59,204 @@ func (c *mailingServerClient) ForwardMail(ctx context.Context, in *ForwardMailRe
 	return out, nil
 }
 
+func (c *mailingServerClient) SendMail(ctx context.Context, in *SendMailRequest, opts ...grpc.CallOption) (*SendMailResponse, error) {
+	out := new(SendMailResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/SendMail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ReplyToEmail(ctx context.Context, in *ReplyToEmailRequest, opts ...grpc.CallOption) (*SendMailResponse, error) {
+	out := new(SendMailResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ReplyToEmail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) SearchEmails(ctx context.Context, in *SearchEmailsRequest, opts ...grpc.CallOption) (*SearchEmailsResponse, error) {
+	out := new(SearchEmailsResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/SearchEmails", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ListThreads(ctx context.Context, in *ListThreadsRequest, opts ...grpc.CallOption) (*ListThreadsResponse, error) {
+	out := new(ListThreadsResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ListThreads", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) GetThread(ctx context.Context, in *GetThreadRequest, opts ...grpc.CallOption) (*GetThreadResponse, error) {
+	out := new(GetThreadResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/GetThread", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) CreateAlias(ctx context.Context, in *CreateAliasRequest, opts ...grpc.CallOption) (*Alias, error) {
+	out := new(Alias)
+	err := c.cc.Invoke(ctx, "/MailingServer/CreateAlias", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ListAliases(ctx context.Context, in *ListAliasesRequest, opts ...grpc.CallOption) (*ListAliasesResponse, error) {
+	out := new(ListAliasesResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ListAliases", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) UpdateAlias(ctx context.Context, in *UpdateAliasRequest, opts ...grpc.CallOption) (*Alias, error) {
+	out := new(Alias)
+	err := c.cc.Invoke(ctx, "/MailingServer/UpdateAlias", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) DeleteAlias(ctx context.Context, in *DeleteAliasRequest, opts ...grpc.CallOption) (*DeleteAliasResponse, error) {
+	out := new(DeleteAliasResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/DeleteAlias", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ListAliasHits(ctx context.Context, in *ListAliasHitsRequest, opts ...grpc.CallOption) (*ListAliasHitsResponse, error) {
+	out := new(ListAliasHitsResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ListAliasHits", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ListSuppressions(ctx context.Context, in *ListSuppressionsRequest, opts ...grpc.CallOption) (*ListSuppressionsResponse, error) {
+	out := new(ListSuppressionsResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ListSuppressions", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) AddSuppression(ctx context.Context, in *AddSuppressionRequest, opts ...grpc.CallOption) (*Suppression, error) {
+	out := new(Suppression)
+	err := c.cc.Invoke(ctx, "/MailingServer/AddSuppression", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) RemoveSuppression(ctx context.Context, in *RemoveSuppressionRequest, opts ...grpc.CallOption) (*RemoveSuppressionResponse, error) {
+	out := new(RemoveSuppressionResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/RemoveSuppression", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ListQuarantinedMail(ctx context.Context, in *ListQuarantinedMailRequest, opts ...grpc.CallOption) (*ListQuarantinedMailResponse, error) {
+	out := new(ListQuarantinedMailResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ListQuarantinedMail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ReprocessQuarantinedMail(ctx context.Context, in *ReprocessQuarantinedMailRequest, opts ...grpc.CallOption) (*ReprocessQuarantinedMailResponse, error) {
+	out := new(ReprocessQuarantinedMailResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/ReprocessQuarantinedMail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) DiscardQuarantinedMail(ctx context.Context, in *DiscardQuarantinedMailRequest, opts ...grpc.CallOption) (*DiscardQuarantinedMailResponse, error) {
+	out := new(DiscardQuarantinedMailResponse)
+	err := c.cc.Invoke(ctx, "/MailingServer/DiscardQuarantinedMail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *mailingServerClient) ExportEmails(ctx context.Context, in *ExportEmailsRequest, opts ...grpc.CallOption) (MailingServer_ExportEmailsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MailingServer_ServiceDesc.Streams[0], "/MailingServer/ExportEmails", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &mailingServerExportEmailsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MailingServer_ExportEmailsClient interface {
+	Recv() (*ExportEmailsChunk, error)
+	grpc.ClientStream
+}
+
+type mailingServerExportEmailsClient struct {
+	grpc.ClientStream
+}
+
+func (x *mailingServerExportEmailsClient) Recv() (*ExportEmailsChunk, error) {
+	m := new(ExportEmailsChunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // MailingServerServer is the server API for MailingServer service.
 // All implementations must embed UnimplementedMailingServerServer
 // for forward compatibility
 type MailingServerServer interface {
 	ForwardMail(context.Context, *ForwardMailRequest) (*ForwardMailResponse, error)
+	SendMail(context.Context, *SendMailRequest) (*SendMailResponse, error)
+	ReplyToEmail(context.Context, *ReplyToEmailRequest) (*SendMailResponse, error)
+	SearchEmails(context.Context, *SearchEmailsRequest) (*SearchEmailsResponse, error)
+	ListThreads(context.Context, *ListThreadsRequest) (*ListThreadsResponse, error)
+	GetThread(context.Context, *GetThreadRequest) (*GetThreadResponse, error)
+	CreateAlias(context.Context, *CreateAliasRequest) (*Alias, error)
+	ListAliases(context.Context, *ListAliasesRequest) (*ListAliasesResponse, error)
+	UpdateAlias(context.Context, *UpdateAliasRequest) (*Alias, error)
+	DeleteAlias(context.Context, *DeleteAliasRequest) (*DeleteAliasResponse, error)
+	ListAliasHits(context.Context, *ListAliasHitsRequest) (*ListAliasHitsResponse, error)
+	ListSuppressions(context.Context, *ListSuppressionsRequest) (*ListSuppressionsResponse, error)
+	AddSuppression(context.Context, *AddSuppressionRequest) (*Suppression, error)
+	RemoveSuppression(context.Context, *RemoveSuppressionRequest) (*RemoveSuppressionResponse, error)
+	ListQuarantinedMail(context.Context, *ListQuarantinedMailRequest) (*ListQuarantinedMailResponse, error)
+	ReprocessQuarantinedMail(context.Context, *ReprocessQuarantinedMailRequest) (*ReprocessQuarantinedMailResponse, error)
+	DiscardQuarantinedMail(context.Context, *DiscardQuarantinedMailRequest) (*DiscardQuarantinedMailResponse, error)
+	ExportEmails(*ExportEmailsRequest, MailingServer_ExportEmailsServer) error
 	mustEmbedUnimplementedMailingServerServer()
 }
 
@@ -57,6 +267,57 @@ type UnimplementedMailingServerServer struct {
 func (UnimplementedMailingServerServer) ForwardMail(context.Context, *ForwardMailRequest) (*ForwardMailResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ForwardMail not implemented")
 }
+func (UnimplementedMailingServerServer) SendMail(context.Context, *SendMailRequest) (*SendMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMail not implemented")
+}
+func (UnimplementedMailingServerServer) ReplyToEmail(context.Context, *ReplyToEmailRequest) (*SendMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReplyToEmail not implemented")
+}
+func (UnimplementedMailingServerServer) SearchEmails(context.Context, *SearchEmailsRequest) (*SearchEmailsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchEmails not implemented")
+}
+func (UnimplementedMailingServerServer) ListThreads(context.Context, *ListThreadsRequest) (*ListThreadsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListThreads not implemented")
+}
+func (UnimplementedMailingServerServer) GetThread(context.Context, *GetThreadRequest) (*GetThreadResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetThread not implemented")
+}
+func (UnimplementedMailingServerServer) CreateAlias(context.Context, *CreateAliasRequest) (*Alias, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateAlias not implemented")
+}
+func (UnimplementedMailingServerServer) ListAliases(context.Context, *ListAliasesRequest) (*ListAliasesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAliases not implemented")
+}
+func (UnimplementedMailingServerServer) UpdateAlias(context.Context, *UpdateAliasRequest) (*Alias, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateAlias not implemented")
+}
+func (UnimplementedMailingServerServer) DeleteAlias(context.Context, *DeleteAliasRequest) (*DeleteAliasResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteAlias not implemented")
+}
+func (UnimplementedMailingServerServer) ListAliasHits(context.Context, *ListAliasHitsRequest) (*ListAliasHitsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAliasHits not implemented")
+}
+func (UnimplementedMailingServerServer) ListSuppressions(context.Context, *ListSuppressionsRequest) (*ListSuppressionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListSuppressions not implemented")
+}
+func (UnimplementedMailingServerServer) AddSuppression(context.Context, *AddSuppressionRequest) (*Suppression, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddSuppression not implemented")
+}
+func (UnimplementedMailingServerServer) RemoveSuppression(context.Context, *RemoveSuppressionRequest) (*RemoveSuppressionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveSuppression not implemented")
+}
+func (UnimplementedMailingServerServer) ListQuarantinedMail(context.Context, *ListQuarantinedMailRequest) (*ListQuarantinedMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListQuarantinedMail not implemented")
+}
+func (UnimplementedMailingServerServer) ReprocessQuarantinedMail(context.Context, *ReprocessQuarantinedMailRequest) (*ReprocessQuarantinedMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ReprocessQuarantinedMail not implemented")
+}
+func (UnimplementedMailingServerServer) DiscardQuarantinedMail(context.Context, *DiscardQuarantinedMailRequest) (*DiscardQuarantinedMailResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DiscardQuarantinedMail not implemented")
+}
+func (UnimplementedMailingServerServer) ExportEmails(*ExportEmailsRequest, MailingServer_ExportEmailsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportEmails not implemented")
+}
 func (UnimplementedMailingServerServer) mustEmbedUnimplementedMailingServerServer() {}
 
 // UnsafeMailingServerServer may be embedded to opt out of forward compatibility for this service.
@@ -88,6 +349,315 @@ func _MailingServer_ForwardMail_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MailingServer_SendMail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendMailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).SendMail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/SendMail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).SendMail(ctx, req.(*SendMailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ReplyToEmail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReplyToEmailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ReplyToEmail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ReplyToEmail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ReplyToEmail(ctx, req.(*ReplyToEmailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_SearchEmails_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchEmailsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).SearchEmails(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/SearchEmails",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).SearchEmails(ctx, req.(*SearchEmailsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ListThreads_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListThreadsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ListThreads(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ListThreads",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ListThreads(ctx, req.(*ListThreadsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_GetThread_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetThreadRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).GetThread(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/GetThread",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).GetThread(ctx, req.(*GetThreadRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_CreateAlias_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateAliasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).CreateAlias(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/CreateAlias",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).CreateAlias(ctx, req.(*CreateAliasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ListAliases_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAliasesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ListAliases(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ListAliases",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ListAliases(ctx, req.(*ListAliasesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_UpdateAlias_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateAliasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).UpdateAlias(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/UpdateAlias",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).UpdateAlias(ctx, req.(*UpdateAliasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_DeleteAlias_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteAliasRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).DeleteAlias(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/DeleteAlias",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).DeleteAlias(ctx, req.(*DeleteAliasRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ListAliasHits_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAliasHitsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ListAliasHits(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ListAliasHits",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ListAliasHits(ctx, req.(*ListAliasHitsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ListSuppressions_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListSuppressionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ListSuppressions(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ListSuppressions",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ListSuppressions(ctx, req.(*ListSuppressionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_AddSuppression_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddSuppressionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).AddSuppression(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/AddSuppression",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).AddSuppression(ctx, req.(*AddSuppressionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_RemoveSuppression_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveSuppressionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).RemoveSuppression(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/RemoveSuppression",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).RemoveSuppression(ctx, req.(*RemoveSuppressionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ListQuarantinedMail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListQuarantinedMailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ListQuarantinedMail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ListQuarantinedMail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ListQuarantinedMail(ctx, req.(*ListQuarantinedMailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ReprocessQuarantinedMail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReprocessQuarantinedMailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).ReprocessQuarantinedMail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/ReprocessQuarantinedMail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).ReprocessQuarantinedMail(ctx, req.(*ReprocessQuarantinedMailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_DiscardQuarantinedMail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DiscardQuarantinedMailRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MailingServerServer).DiscardQuarantinedMail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/MailingServer/DiscardQuarantinedMail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MailingServerServer).DiscardQuarantinedMail(ctx, req.(*DiscardQuarantinedMailRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MailingServer_ExportEmails_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportEmailsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MailingServerServer).ExportEmails(m, &mailingServerExportEmailsServer{stream})
+}
+
+type MailingServer_ExportEmailsServer interface {
+	Send(*ExportEmailsChunk) error
+	grpc.ServerStream
+}
+
+type mailingServerExportEmailsServer struct {
+	grpc.ServerStream
+}
+
+func (x *mailingServerExportEmailsServer) Send(m *ExportEmailsChunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 // MailingServer_ServiceDesc is the grpc.ServiceDesc for MailingServer service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -99,7 +669,77 @@ var MailingServer_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ForwardMail",
 			Handler:    _MailingServer_ForwardMail_Handler,
 		},
+		{
+			MethodName: "SendMail",
+			Handler:    _MailingServer_SendMail_Handler,
+		},
+		{
+			MethodName: "ReplyToEmail",
+			Handler:    _MailingServer_ReplyToEmail_Handler,
+		},
+		{
+			MethodName: "SearchEmails",
+			Handler:    _MailingServer_SearchEmails_Handler,
+		},
+		{
+			MethodName: "ListThreads",
+			Handler:    _MailingServer_ListThreads_Handler,
+		},
+		{
+			MethodName: "GetThread",
+			Handler:    _MailingServer_GetThread_Handler,
+		},
+		{
+			MethodName: "CreateAlias",
+			Handler:    _MailingServer_CreateAlias_Handler,
+		},
+		{
+			MethodName: "ListAliases",
+			Handler:    _MailingServer_ListAliases_Handler,
+		},
+		{
+			MethodName: "UpdateAlias",
+			Handler:    _MailingServer_UpdateAlias_Handler,
+		},
+		{
+			MethodName: "DeleteAlias",
+			Handler:    _MailingServer_DeleteAlias_Handler,
+		},
+		{
+			MethodName: "ListAliasHits",
+			Handler:    _MailingServer_ListAliasHits_Handler,
+		},
+		{
+			MethodName: "ListSuppressions",
+			Handler:    _MailingServer_ListSuppressions_Handler,
+		},
+		{
+			MethodName: "AddSuppression",
+			Handler:    _MailingServer_AddSuppression_Handler,
+		},
+		{
+			MethodName: "RemoveSuppression",
+			Handler:    _MailingServer_RemoveSuppression_Handler,
+		},
+		{
+			MethodName: "ListQuarantinedMail",
+			Handler:    _MailingServer_ListQuarantinedMail_Handler,
+		},
+		{
+			MethodName: "ReprocessQuarantinedMail",
+			Handler:    _MailingServer_ReprocessQuarantinedMail_Handler,
+		},
+		{
+			MethodName: "DiscardQuarantinedMail",
+			Handler:    _MailingServer_DiscardQuarantinedMail_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportEmails",
+			Handler:       _MailingServer_ExportEmails_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "protocols/postaci.proto",
 }
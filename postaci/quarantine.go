@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultIngestAttempts     = 5
+	defaultIngestRetryBackoff = 30 * time.Second
+	quarantineDirectory       = "quarantine"
+)
+
+// errUnparseable marks mail that fails the same way however many times it
+// is tried.
+var errUnparseable = errors.New("mail cannot be parsed")
+
+// QuarantinedMail is a received mail file that failed to be ingested. The
+// file is moved to Path, out of the new/ directory it was found in.
+type QuarantinedMail struct {
+	gorm.Model
+	Source       string `gorm:"size:255;index"`
+	Filename     string
+	OriginalPath string
+	Path         string
+	// Recipient is who the mail is for when it does not tell, like the
+	// recipient of the remote mailbox it came from.
+	Recipient string
+	Reason    string
+	Attempts  int
+}
+
+type QuarantineStore interface {
+	CreateQuarantinedMail(mail *QuarantinedMail) error
+	SaveQuarantinedMail(mail *QuarantinedMail) error
+	FindQuarantinedMail(id uint64) (*QuarantinedMail, error)
+	ListQuarantinedMail(source string, limit, offset int) ([]QuarantinedMail, error)
+	DeleteQuarantinedMail(id uint64) error
+}
+
+func (p *Persistence) CreateQuarantinedMail(mail *QuarantinedMail) error {
+	return db.Create(mail).Error
+}
+
+func (p *Persistence) SaveQuarantinedMail(mail *QuarantinedMail) error {
+	return db.Save(mail).Error
+}
+
+func (p *Persistence) FindQuarantinedMail(id uint64) (*QuarantinedMail, error) {
+	var mail QuarantinedMail
+	result := db.First(&mail, id)
+	return &mail, result.Error
+}
+
+func (p *Persistence) ListQuarantinedMail(source string, limit, offset int) ([]QuarantinedMail, error) {
+	query := db.Order("id desc").Limit(limit).Offset(offset)
+	if source != "" {
+		query = query.Where("source = ?", source)
+	}
+
+	var mails []QuarantinedMail
+	result := query.Find(&mails)
+	return mails, result.Error
+}
+
+func (p *Persistence) DeleteQuarantinedMail(id uint64) error {
+	return db.Unscoped().Delete(&QuarantinedMail{}, id).Error
+}
+
+// FailurePolicy decides what happens to a mail file that fails to be
+// ingested. It is tried again after Backoff, which doubles with every
+// attempt, and is quarantined after MaxAttempts. Mail that cannot be parsed
+// is quarantined at once.
+type FailurePolicy struct {
+	MaxAttempts int
+	Backoff     time.Duration
+	// Directory is where quarantined files are moved, the quarantine
+	// directory next to new/ when empty.
+	Directory string
+	Store     QuarantineStore
+
+	mutex    sync.Mutex
+	attempts map[string]int
+}
+
+// Succeeded forgets the failures of a file.
+func (p *FailurePolicy) Succeeded(filepath string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.attempts, filepath)
+}
+
+// Waiting tells whether a file has failed and waits to be tried again.
+func (p *FailurePolicy) Waiting(filepath string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.attempts[filepath] > 0
+}
+
+// Failed schedules retry, or quarantines the file when it is out of attempts.
+// The filename is how the source names the mail when it stores it, which
+// reprocessing names it again so that it is not stored twice.
+func (p *FailurePolicy) Failed(filepath, filename, source string, err error, retry func()) {
+	p.mutex.Lock()
+	if p.attempts == nil {
+		p.attempts = map[string]int{}
+	}
+	p.attempts[filepath]++
+	attempts := p.attempts[filepath]
+	p.mutex.Unlock()
+
+	if attempts < p.maxAttempts() && !errors.Is(err, errUnparseable) {
+		backoff := p.backoff() << (attempts - 1)
+		logrus.WithField("filename", path.Base(filepath)).Warnf("mail will be tried again in %v: %s", backoff, err)
+		time.AfterFunc(backoff, retry)
+		return
+	}
+
+	p.Succeeded(filepath)
+	if err := p.quarantine(filepath, filename, source, err.Error(), attempts); err != nil {
+		logrus.WithField("filename", path.Base(filepath)).Errorf("something happened while quarantining the mail: %s", err)
+	}
+}
+
+// quarantine records the file and then moves it, so that a file is never
+// in the quarantine without a record. The record is removed again when the
+// file cannot be moved.
+func (p *FailurePolicy) quarantine(filepath, filename, source, reason string, attempts int) error {
+	directory := p.Directory
+	if directory == "" {
+		directory = path.Join(path.Dir(path.Dir(filepath)), quarantineDirectory)
+	}
+	if err := os.MkdirAll(directory, 0o750); err != nil {
+		return err
+	}
+
+	mail := &QuarantinedMail{
+		Source:       source,
+		Filename:     filename,
+		OriginalPath: filepath,
+		Path:         quarantinePath(directory, source, filename),
+		Reason:       reason,
+		Attempts:     attempts,
+	}
+	if err := p.Store.CreateQuarantinedMail(mail); err != nil {
+		return err
+	}
+	if err := os.Rename(filepath, mail.Path); err != nil {
+		if err := p.Store.DeleteQuarantinedMail(uint64(mail.ID)); err != nil {
+			logrus.WithField("filename", filename).Errorf("something happened while removing the quarantined mail: %s", err)
+		}
+		return err
+	}
+
+	quarantined(mail)
+	return nil
+}
+
+// Keep quarantines mail that is not a file of its own, like the mail of a
+// remote mailbox. It is written to Directory, or to the quarantine directory
+// of the working directory when that is empty. The recipient is who the mail
+// is for when it does not tell.
+func (p *FailurePolicy) Keep(source, filename, recipient, reason string, content []byte) error {
+	directory := p.Directory
+	if directory == "" {
+		directory = quarantineDirectory
+	}
+	if err := os.MkdirAll(directory, 0o750); err != nil {
+		return err
+	}
+
+	mail := &QuarantinedMail{
+		Source:    source,
+		Filename:  filename,
+		Path:      quarantinePath(directory, source, filename),
+		Recipient: recipient,
+		Reason:    reason,
+		Attempts:  1,
+	}
+	if err := os.WriteFile(mail.Path, content, 0o640); err != nil {
+		return err
+	}
+	if err := p.Store.CreateQuarantinedMail(mail); err != nil {
+		os.Remove(mail.Path)
+		return err
+	}
+
+	quarantined(mail)
+	return nil
+}
+
+// quarantinePath names a quarantined file after its source and the name the
+// source gives the mail, with its folder, so that the mail of every source
+// can share a quarantine directory.
+func quarantinePath(directory, source, filename string) string {
+	return path.Join(directory, strings.ReplaceAll(source+"."+filename, "/", "_"))
+}
+
+func quarantined(mail *QuarantinedMail) {
+	ingestMetrics.Add("quarantined", 1)
+	logrus.WithFields(logrus.Fields{
+		"filename": mail.Filename,
+		"source":   mail.Source,
+		"attempts": mail.Attempts,
+		"reason":   mail.Reason,
+	}).Warn("mail is quarantined")
+}
+
+func (p *FailurePolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return defaultIngestAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *FailurePolicy) backoff() time.Duration {
+	if p.Backoff <= 0 {
+		return defaultIngestRetryBackoff
+	}
+	return p.Backoff
+}
+
+func (m *mailingServerServer) ListQuarantinedMail(ctx context.Context, request *pb.ListQuarantinedMailRequest) (*pb.ListQuarantinedMailResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	mails, err := m.Quarantine.ListQuarantinedMail(request.Source, limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while listing quarantined mail: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListQuarantinedMailResponse{}
+	for _, mail := range mails {
+		response.Mails = append(response.Mails, &pb.QuarantinedMail{
+			Id:        uint64(mail.ID),
+			Source:    mail.Source,
+			Filename:  mail.Filename,
+			Reason:    mail.Reason,
+			Attempts:  uint32(mail.Attempts),
+			CreatedAt: timestamppb.New(mail.CreatedAt),
+		})
+	}
+	return response, nil
+}
+
+func (m *mailingServerServer) ReprocessQuarantinedMail(ctx context.Context, request *pb.ReprocessQuarantinedMailRequest) (*pb.ReprocessQuarantinedMailResponse, error) {
+	quarantined, err := m.findQuarantinedMail(request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	email, err := ReadAndParseEmailFile(quarantined.Path)
+	if err == nil {
+		email.Filename = quarantined.Filename
+		email.Source = quarantined.Source
+		if email.To == "" {
+			email.To = quarantined.Recipient
+		}
+		err = m.Ingester.IngestEmail(&email)
+	}
+	if err != nil {
+		quarantined.Reason = err.Error()
+		quarantined.Attempts++
+		if err := m.Quarantine.SaveQuarantinedMail(quarantined); err != nil {
+			logrus.Errorf("something happened while saving the quarantined mail: %s", err)
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot ingest the mail: %s", err)
+	}
+
+	if err = os.Remove(quarantined.Path); err != nil {
+		logrus.Errorf("something happened while removing the quarantined file: %s", err)
+	}
+	if err = m.Quarantine.DeleteQuarantinedMail(request.Id); err != nil {
+		logrus.Errorf("something happened while removing the quarantined mail: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"filename": quarantined.Filename,
+		"emailId":  email.ID,
+	}).Info("quarantined mail is reprocessed")
+	return &pb.ReprocessQuarantinedMailResponse{MailId: uint64(email.ID)}, nil
+}
+
+func (m *mailingServerServer) DiscardQuarantinedMail(ctx context.Context, request *pb.DiscardQuarantinedMailRequest) (*pb.DiscardQuarantinedMailResponse, error) {
+	quarantined, err := m.findQuarantinedMail(request.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.Remove(quarantined.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logrus.Errorf("something happened while removing the quarantined file: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err = m.Quarantine.DeleteQuarantinedMail(request.Id); err != nil {
+		logrus.Errorf("something happened while removing the quarantined mail: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.DiscardQuarantinedMailResponse{}, nil
+}
+
+func (m *mailingServerServer) findQuarantinedMail(id uint64) (*QuarantinedMail, error) {
+	quarantined, err := m.Quarantine.FindQuarantinedMail(id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, status.Errorf(codes.NotFound, "quarantined mail %d is not found", id)
+	}
+	if err != nil {
+		logrus.Errorf("something happened while fetching the quarantined mail: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return quarantined, nil
+}
+
+// ingestError sorts out the errors of reading a mail file, which can be
+// tried again, from the errors of parsing it.
+func ingestError(err error) error {
+	var pathError *fs.PathError
+	if errors.As(err, &pathError) {
+		return err
+	}
+	return fmt.Errorf("%w: %s", errUnparseable, err)
+}
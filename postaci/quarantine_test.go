@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FlakyMessageProducer fails the first messages it is given.
+type FlakyMessageProducer struct {
+	failures int
+	produced []string
+}
+
+func (f *FlakyMessageProducer) Produce(ctx context.Context, topic, message string) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("broker is down")
+	}
+	f.produced = append(f.produced, message)
+	return nil
+}
+
+func TestFailedMailIsRetriedAndQuarantined(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+	for _, name := range []string{"tmp", "cur", "new"} {
+		if err := os.Mkdir(path.Join(directory, name), fs.ModePerm); err != nil {
+			t.Fatalf("cannot create the maildir: %s", err)
+		}
+	}
+
+	mails := map[string]string{
+		"garbage": "this is not a mail\n",
+		"broken":  "From: contact@example.org\nX-Original-To: broken@example.com\nSubject: broken\n\nhello\n",
+	}
+	for filename, content := range mails {
+		if err := os.WriteFile(path.Join(directory, "new", filename), []byte(content), fs.ModePerm); err != nil {
+			t.Fatalf("cannot write the mail: %s", err)
+		}
+	}
+
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	ingester := &FakeIngester{fail: map[string]bool{"broken@example.com": true}}
+	source := &MaildirSource{
+		Name:     "quarantine-test",
+		Path:     directory,
+		Ingester: ingester,
+		Failures: &FailurePolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond, Store: persistence},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go source.Run(ctx)
+
+	var quarantined []QuarantinedMail
+	waitFor(t, "both mails to be quarantined", func() bool {
+		quarantined, _ = persistence.ListQuarantinedMail("quarantine-test", 10, 0)
+		return len(quarantined) >= 2
+	})
+
+	byFilename := map[string]QuarantinedMail{}
+	for _, mail := range quarantined {
+		byFilename[mail.Filename] = mail
+		if _, err := os.Stat(path.Join(directory, "quarantine", "quarantine-test."+mail.Filename)); err != nil {
+			t.Errorf("expected %s to be moved to the quarantine: %s", mail.Filename, err)
+		}
+	}
+	if byFilename["garbage"].Attempts != 1 {
+		t.Errorf("expected unparseable mail to be quarantined at once, but got %d attempts", byFilename["garbage"].Attempts)
+	}
+	if byFilename["broken"].Attempts != 3 || byFilename["broken"].Reason != "database is down" {
+		t.Errorf("expected failing mail to be tried 3 times, but got %+v", byFilename["broken"])
+	}
+
+	server := &mailingServerServer{Quarantine: persistence, Ingester: ingester}
+
+	ingester.mutex.Lock()
+	ingester.fail = nil
+	ingester.mutex.Unlock()
+	if _, err := server.ReprocessQuarantinedMail(ctx, &pb.ReprocessQuarantinedMailRequest{Id: uint64(byFilename["broken"].ID)}); err != nil {
+		t.Fatalf("cannot reprocess the mail: %s", err)
+	}
+	if len(ingester.emails) != 1 || ingester.emails[0].Source != "quarantine-test" {
+		t.Errorf("expected the mail to be ingested with its source, but got %+v", ingester.emails)
+	}
+
+	_, err := server.ReprocessQuarantinedMail(ctx, &pb.ReprocessQuarantinedMailRequest{Id: uint64(byFilename["garbage"].ID)})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected unparseable mail to fail again, but got %v", err)
+	}
+	if _, err = server.DiscardQuarantinedMail(ctx, &pb.DiscardQuarantinedMailRequest{Id: uint64(byFilename["garbage"].ID)}); err != nil {
+		t.Fatalf("cannot discard the mail: %s", err)
+	}
+
+	if quarantined, _ = persistence.ListQuarantinedMail("quarantine-test", 10, 0); len(quarantined) != 0 {
+		t.Errorf("expected the quarantine to be empty, but got %+v", quarantined)
+	}
+	if entries, _ := os.ReadDir(path.Join(directory, "quarantine")); len(entries) != 0 {
+		t.Errorf("expected the quarantine directory to be empty, but got %d files", len(entries))
+	}
+}
+
+func TestQuarantineKeepsMailOfEverySourceApart(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+	for _, folder := range []string{"first/new", "second/.Lists/new"} {
+		if err := os.MkdirAll(path.Join(directory, folder), fs.ModePerm); err != nil {
+			t.Fatalf("cannot create the maildir: %s", err)
+		}
+		if err := os.WriteFile(path.Join(directory, folder, "same"), []byte(folder), fs.ModePerm); err != nil {
+			t.Fatalf("cannot write the mail: %s", err)
+		}
+	}
+
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	policy := &FailurePolicy{Directory: path.Join(directory, "quarantine"), Store: persistence}
+	policy.Failed(path.Join(directory, "first/new/same"), "same", "shared-first", ingestError(errors.New("garbage")), nil)
+	policy.Failed(path.Join(directory, "second/.Lists/new/same"), ".Lists/same", "shared-second", ingestError(errors.New("garbage")), nil)
+	content := []byte("From: contact@example.org\nSubject: kept\n\nhello\n")
+	if err := policy.Keep("shared-remote", "INBOX/1/1", "ali@example.com", "broker is down", content); err != nil {
+		t.Fatalf("cannot keep the mail: %s", err)
+	}
+
+	var quarantined []QuarantinedMail
+	for _, source := range []string{"shared-first", "shared-second", "shared-remote"} {
+		mails, _ := persistence.ListQuarantinedMail(source, 10, 0)
+		quarantined = append(quarantined, mails...)
+	}
+	if len(quarantined) != 3 {
+		t.Fatalf("expected every mail to be quarantined, but got %+v", quarantined)
+	}
+	for _, mail := range quarantined[:2] {
+		if content, err := os.ReadFile(mail.Path); err != nil || !strings.HasSuffix(path.Dir(mail.OriginalPath), string(content)) {
+			t.Errorf("expected %s to be kept apart, but got %q: %v", mail.OriginalPath, content, err)
+		}
+	}
+
+	ingester := &FakeIngester{}
+	server := &mailingServerServer{Quarantine: persistence, Ingester: ingester}
+	if _, err := server.ReprocessQuarantinedMail(context.Background(), &pb.ReprocessQuarantinedMailRequest{Id: uint64(quarantined[2].ID)}); err != nil {
+		t.Fatalf("cannot reprocess the mail: %s", err)
+	}
+	if len(ingester.emails) != 1 || ingester.emails[0].To != "ali@example.com" {
+		t.Errorf("expected the mail to be ingested for the recipient of its source, but got %+v", ingester.emails)
+	}
+}
+
+func TestRetriedMailIsStoredAndAnnouncedOnce(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	producer := &FlakyMessageProducer{failures: 1}
+	ingestor := &Ingestor{Producer: producer}
+	ingest := func() (*Email, error) {
+		email, err := ParseEmail([]byte("From: contact@example.org\nX-Original-To: ali@example.com\nSubject: retried\n\nhello\n"))
+		if err != nil {
+			t.Fatalf("cannot parse the mail: %s", err)
+		}
+		email.Source, email.Filename = "retry-test", "retried"
+		return &email, ingestor.IngestEmail(&email)
+	}
+
+	first, err := ingest()
+	if err == nil {
+		t.Fatalf("expected the first attempt to fail to announce the mail")
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		email, err := ingest()
+		if err != nil {
+			t.Fatalf("cannot ingest the mail again: %s", err)
+		}
+		if email.ID != first.ID {
+			t.Errorf("expected the stored mail %d to be taken again, but got %d", first.ID, email.ID)
+		}
+	}
+
+	var count int64
+	db.Model(&Email{}).Where("source = ?", "retry-test").Count(&count)
+	if count != 1 || len(producer.produced) != 1 {
+		t.Errorf("expected the mail to be stored and announced once, but got %d and %d", count, len(producer.produced))
+	}
+}
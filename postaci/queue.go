@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	defaultIngestWorkers   = 4
+	defaultIngestQueueSize = 1000
+)
+
+// IngestQueue runs ingest jobs on a fixed number of workers. Jobs are
+// started in the order they are submitted, and submitting waits while the
+// queue is full, so that a large backlog is drained a few files at a time
+// instead of all at once. Offered jobs do not wait, they are kept in a list
+// of their own while the queue is full.
+type IngestQueue struct {
+	workers int
+	jobs    chan ingestJob
+
+	mutex    sync.Mutex
+	pending  map[string]bool
+	overflow []ingestJob
+}
+
+type ingestJob struct {
+	key      string
+	run      func()
+	queuedAt time.Time
+}
+
+func NewIngestQueue(workers, size int) *IngestQueue {
+	if workers <= 0 {
+		workers = defaultIngestWorkers
+	}
+	if size <= 0 {
+		size = defaultIngestQueueSize
+	}
+	return &IngestQueue{
+		workers: workers,
+		jobs:    make(chan ingestJob, size),
+		pending: map[string]bool{},
+	}
+}
+
+// Submit queues a job, waiting while the queue is full. A job is dropped
+// when a job with the same key is still waiting or running, since the
+// startup walk and the watcher can find the same file. It tells whether
+// the job is queued.
+func (q *IngestQueue) Submit(ctx context.Context, key string, run func()) bool {
+	q.mutex.Lock()
+	if q.pending[key] {
+		q.mutex.Unlock()
+		return false
+	}
+	q.pending[key] = true
+	q.mutex.Unlock()
+
+	ingestMetrics.Add("queueDepth", 1)
+	select {
+	case q.jobs <- ingestJob{key: key, run: run, queuedAt: time.Now()}:
+		return true
+	case <-ctx.Done():
+		ingestMetrics.Add("queueDepth", -1)
+		q.done(key)
+		return false
+	}
+}
+
+// Offer queues a job like Submit, but does not wait while the queue is full.
+// The job is kept until the workers make room for it, so that the watcher
+// goes on reading its events while a large backlog is drained.
+func (q *IngestQueue) Offer(key string, run func()) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.pending[key] {
+		return false
+	}
+	q.pending[key] = true
+
+	ingestMetrics.Add("queueDepth", 1)
+	job := ingestJob{key: key, run: run, queuedAt: time.Now()}
+	if len(q.overflow) == 0 {
+		select {
+		case q.jobs <- job:
+			return true
+		default:
+		}
+	}
+	q.overflow = append(q.overflow, job)
+	return true
+}
+
+// Run processes jobs until the context is done.
+func (q *IngestQueue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < q.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-q.jobs:
+					q.process(job)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *IngestQueue) process(job ingestJob) {
+	ingestMetrics.Add("queueDepth", -1)
+	ingestMetrics.AddFloat("waitSeconds", time.Since(job.queuedAt).Seconds())
+
+	start := time.Now()
+	job.run()
+	ingestMetrics.AddFloat("processSeconds", time.Since(start).Seconds())
+	ingestMetrics.Add("processed", 1)
+
+	q.done(job.key)
+	q.refill()
+}
+
+// refill moves the offered jobs that are kept to the queue, as many as it
+// has room for.
+func (q *IngestQueue) refill() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for len(q.overflow) > 0 {
+		select {
+		case q.jobs <- q.overflow[0]:
+			q.overflow = q.overflow[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (q *IngestQueue) done(key string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.pending, key)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIngestQueueBoundsTheWorkers(t *testing.T) {
+	queue := NewIngestQueue(2, 3)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go queue.Run(ctx)
+
+	var mutex sync.Mutex
+	running, most, processed := 0, 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		queue.Submit(ctx, fmt.Sprint(i), func() {
+			defer wg.Done()
+			mutex.Lock()
+			running++
+			if running > most {
+				most = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(5 * time.Millisecond)
+
+			mutex.Lock()
+			running--
+			processed++
+			mutex.Unlock()
+		})
+	}
+	wg.Wait()
+
+	if most != 2 {
+		t.Errorf("expected 2 jobs to run at once, but got %d", most)
+	}
+	if processed != 20 {
+		t.Errorf("expected every job to be processed, but got %d", processed)
+	}
+}
+
+func TestIngestQueueKeepsTheOrderAndDropsDuplicates(t *testing.T) {
+	queue := NewIngestQueue(1, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var order []string
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "a", "c"} {
+		key := key
+		wg.Add(1)
+		if !queue.Submit(ctx, key, func() {
+			defer wg.Done()
+			order = append(order, key)
+		}) {
+			wg.Done()
+		}
+	}
+	go queue.Run(ctx)
+	wg.Wait()
+
+	if fmt.Sprint(order) != "[a b c]" {
+		t.Errorf("expected the jobs to run once in order, but got %v", order)
+	}
+
+	wg.Add(1)
+	if !queue.Submit(ctx, "a", func() { wg.Done() }) {
+		t.Errorf("expected a processed key to be queued again")
+	}
+	wg.Wait()
+}
+
+func TestIngestQueueOffersWithoutWaiting(t *testing.T) {
+	queue := NewIngestQueue(1, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var order []string
+	var wg sync.WaitGroup
+	for _, key := range []string{"a", "b", "c", "b", "d"} {
+		key := key
+		wg.Add(1)
+		if !queue.Offer(key, func() {
+			defer wg.Done()
+			order = append(order, key)
+		}) {
+			wg.Done()
+		}
+	}
+	go queue.Run(ctx)
+	wg.Wait()
+
+	if fmt.Sprint(order) != "[a b c d]" {
+		t.Errorf("expected the offered jobs to run once in order, but got %v", order)
+	}
+}
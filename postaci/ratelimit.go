@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate sends per second on average with bursts of up to Burst.
+// The zero Limit means unlimited.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l Limit) unlimited() bool {
+	return l.Rate <= 0
+}
+
+// ParseLimit reads limits written as count/duration with an optional burst,
+// like 600/1m or 600/1m:50. The burst defaults to the count, and must be at
+// least 1.
+func ParseLimit(spec string) (Limit, error) {
+	if spec == "" {
+		return Limit{}, nil
+	}
+
+	rate, burst, hasBurst := strings.Cut(spec, ":")
+	count, per, ok := strings.Cut(rate, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("limit %s is not in count/duration form", spec)
+	}
+
+	n, err := strconv.ParseFloat(count, 64)
+	if err != nil {
+		return Limit{}, fmt.Errorf("cannot parse the count of limit %s: %s", spec, err)
+	}
+	duration, err := time.ParseDuration(per)
+	if err != nil {
+		return Limit{}, fmt.Errorf("cannot parse the duration of limit %s: %s", spec, err)
+	}
+	if duration <= 0 {
+		return Limit{}, fmt.Errorf("the duration of limit %s is not positive", spec)
+	}
+
+	limit := Limit{Rate: n / duration.Seconds(), Burst: n}
+	if hasBurst {
+		if limit.Burst, err = strconv.ParseFloat(burst, 64); err != nil {
+			return Limit{}, fmt.Errorf("cannot parse the burst of limit %s: %s", spec, err)
+		}
+	}
+	// A bucket that never holds a whole token would never let a send through.
+	if limit.Burst < 1 {
+		return Limit{}, fmt.Errorf("the burst of limit %s is less than 1", spec)
+	}
+	return limit, nil
+}
+
+// ParseDomainLimits reads per domain overrides like
+// "gmail.com=100/1m yahoo.com=20/1m:5".
+func ParseDomainLimits(spec string) (map[string]Limit, error) {
+	limits := map[string]Limit{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		domain, limitSpec, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("domain limit %s is not in domain=limit form", entry)
+		}
+		limit, err := ParseLimit(limitSpec)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.ToLower(domain)] = limit
+	}
+	return limits, nil
+}
+
+type tokenBucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.limit.Burst, b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+}
+
+// wait tells how long it takes until a token is available.
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// RateLimiter keeps token buckets for all outgoing mail, for every recipient
+// domain and for every sender address. A send must get a token from each of
+// them, and takes none unless all of them have one to give.
+type RateLimiter struct {
+	Global    Limit
+	PerSender Limit
+	PerDomain Limit
+	// Domains overrides PerDomain for specific recipient domains.
+	Domains map[string]Limit
+
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	sweptAt time.Time
+}
+
+// Reserve takes a token for the given sender and recipient. When a limit is
+// reached nothing is taken and the scope of the limit is returned together
+// with the time until it allows the send.
+func (r *RateLimiter) Reserve(sender, recipientAddr string) (string, time.Duration, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.sweep(now)
+
+	domain := domainOf(recipientAddr)
+	domainLimit, ok := r.Domains[domain]
+	if !ok {
+		domainLimit = r.PerDomain
+	}
+
+	scopes := []struct {
+		scope string
+		key   string
+		limit Limit
+	}{
+		{"global", "global", r.Global},
+		{"domain", "domain:" + domain, domainLimit},
+		{"sender", "sender:" + strings.ToLower(sender), r.PerSender},
+	}
+
+	var buckets []*tokenBucket
+	for _, s := range scopes {
+		if s.limit.unlimited() {
+			continue
+		}
+
+		bucket := r.bucket(s.key, s.limit, now)
+		if wait := bucket.wait(); wait > 0 {
+			rateLimitMetrics.Add(s.scope+"Deferred", 1)
+			if s.scope == "domain" {
+				metricsFor(rateLimitMetrics, "domains").Add(domain, 1)
+			}
+			return s.scope, wait, false
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	rateLimitMetrics.Add("allowed", 1)
+	return "", 0, true
+}
+
+func (r *RateLimiter) bucket(key string, limit Limit, now time.Time) *tokenBucket {
+	if r.buckets == nil {
+		r.buckets = map[string]*tokenBucket{}
+	}
+
+	bucket, ok := r.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{limit: limit, tokens: limit.Burst, last: now}
+		r.buckets[key] = bucket
+	}
+	bucket.refill(now)
+	return bucket
+}
+
+// sweep forgets buckets that have filled up again, since a fresh bucket
+// would behave exactly the same. This keeps one-off senders and domains from
+// piling up.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.sweptAt) < time.Minute {
+		return
+	}
+	r.sweptAt = now
+
+	for key, bucket := range r.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.limit.Burst {
+			delete(r.buckets, key)
+		}
+	}
+	rateLimitMetrics.Set("buckets", intVar(len(r.buckets)))
+}
+
+// RateLimitError is returned instead of sending when a limit is reached. The
+// mail should be tried again after RetryAfter.
+type RateLimitError struct {
+	Scope      string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("%s rate limit is reached, retry after %v", e.Scope, e.RetryAfter.Round(time.Millisecond))
+}
+
+// ThrottledSender is a MailSender that consults a RateLimiter before handing
+// mail over to the underlying sender.
+type ThrottledSender struct {
+	MailSender
+	Limiter *RateLimiter
+}
+
+func (t *ThrottledSender) Send(ctx context.Context, sender, recipientAddr string, mail []byte) error {
+	if scope, wait, ok := t.Limiter.Reserve(sender, recipientAddr); !ok {
+		return &RateLimitError{Scope: scope, RetryAfter: wait}
+	}
+	return t.MailSender.Send(ctx, sender, recipientAddr, mail)
+}
+
+func domainOf(addr string) string {
+	return strings.ToLower(addr[strings.LastIndex(addr, "@")+1:])
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type FakeDeliveryStore struct {
+	deliveries []*Delivery
+}
+
+func (f *FakeDeliveryStore) CreateDelivery(delivery *Delivery) error {
+	f.deliveries = append(f.deliveries, delivery)
+	delivery.ID = uint(len(f.deliveries))
+	return nil
+}
+
+func (f *FakeDeliveryStore) SaveDelivery(delivery *Delivery) error {
+	if stored := f.deliveries[delivery.ID-1]; stored != delivery {
+		*stored = *delivery
+	}
+	return nil
+}
+
+func (f *FakeDeliveryStore) FindDueDeliveries(now time.Time, limit int) ([]Delivery, error) {
+	var due []Delivery
+	for _, delivery := range f.deliveries {
+		if delivery.Status == DeliveryDeferred && !delivery.NextAttemptAt.After(now) {
+			due = append(due, *delivery)
+		}
+	}
+	return due, nil
+}
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("600/1m:50")
+	if err != nil {
+		t.Fatalf("cannot parse limit: %s", err)
+	}
+	if limit.Rate != 10 || limit.Burst != 50 {
+		t.Errorf("expected 10 per second with a burst of 50, but got %v", limit)
+	}
+
+	for _, spec := range []string{"600", "5/0s", "5/-1m", "5/1m:0.5", "0/1m"} {
+		if _, err = ParseLimit(spec); err == nil {
+			t.Errorf("expected limit %s to be refused", spec)
+		}
+	}
+}
+
+func TestRateLimiterAppliesDomainOverrides(t *testing.T) {
+	limiter := &RateLimiter{
+		PerDomain: Limit{Rate: 100, Burst: 100},
+		Domains:   map[string]Limit{"gmail.com": {Rate: 1, Burst: 1}},
+	}
+
+	if _, _, ok := limiter.Reserve("a@example.com", "b@gmail.com"); !ok {
+		t.Fatalf("expected the first mail to gmail.com to be allowed")
+	}
+	scope, wait, ok := limiter.Reserve("a@example.com", "c@GMAIL.com")
+	if ok || scope != "domain" || wait <= 0 {
+		t.Errorf("expected the second mail to gmail.com to wait for the domain limit, but got %s %v %v", scope, wait, ok)
+	}
+	if _, _, ok := limiter.Reserve("a@example.com", "b@example.org"); !ok {
+		t.Errorf("expected other domains not to be affected")
+	}
+}
+
+func TestDelivererDefersRateLimitedMail(t *testing.T) {
+	sender := &FakeMailSender{}
+	store := &FakeDeliveryStore{}
+	deliverer := &Deliverer{
+		Sender: &ThrottledSender{MailSender: sender, Limiter: &RateLimiter{PerSender: Limit{Rate: 0.001, Burst: 1}}},
+		Store:  store,
+	}
+	email := &Email{From: "contact@example.com", Content: []byte("hello")}
+
+	first, err := deliverer.Deliver(context.Background(), email, email.From, "ali@example.com", email.Content)
+	if err != nil || first.Status != DeliverySent {
+		t.Fatalf("expected the first mail to be sent, but got %v and %v", first, err)
+	}
+
+	second, err := deliverer.Deliver(context.Background(), email, email.From, "ali@example.com", email.Content)
+	if err != nil {
+		t.Fatalf("expected a rate limited mail not to be an error, but got %s", err)
+	}
+	if second.Status != DeliveryDeferred || second.NextAttemptAt == nil || second.Attempts != 0 {
+		t.Errorf("expected the second mail to be deferred, but got %+v", second)
+	}
+	if sender.sends != 1 {
+		t.Errorf("expected a single send to reach the relay, but got %d", sender.sends)
+	}
+}
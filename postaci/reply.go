@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"html"
+	"net/mail"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (m *mailingServerServer) ReplyToEmail(ctx context.Context, request *pb.ReplyToEmailRequest) (*pb.SendMailResponse, error) {
+	start := time.Now()
+
+	email, err := m.EmailFinder.FindEmail(request.MailId)
+	if err != nil {
+		logrus.Errorf("something happened while fetching mail content from database: %s", err)
+		return nil, findEmailStatus(err)
+	}
+
+	parts, err := ReadMailParts(email.Content)
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot read the original mail: %s", err)
+	}
+
+	from := request.From
+	if from == "" {
+		from = email.To
+		if email.Direction == EmailOutbound {
+			from = email.From
+		}
+	}
+	fromAddress, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sender %q: %s", from, err)
+	}
+
+	to, cc := replyRecipients(email, parts.Header, fromAddress.Address, request.ReplyAll)
+	if len(to) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "the mail has no one to reply to")
+	}
+	if err = validateRequestHeaders(request.Headers, request.Attachments); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	message := &OutgoingMessage{
+		From:        *fromAddress,
+		To:          to,
+		Cc:          cc,
+		Subject:     replySubject(stripLineBreaks(decodeHeader(parts.Header.Get("Subject")))),
+		Text:        request.Text,
+		HTML:        request.Html,
+		Attachments: attachmentsFromProto(request.Attachments),
+		Headers:     request.Headers,
+		InReplyTo:   email.MessageID,
+		References:  replyReferences(parts.Header, email.MessageID),
+	}
+
+	if request.Quote {
+		attribution := quoteAttribution(email, parts.Header)
+		message.Text = joinNote(request.Text, attribution+"\n"+quoteText(parts.Text))
+		if request.Html != "" {
+			original := parts.HTML
+			if original == "" {
+				original = strings.ReplaceAll(html.EscapeString(parts.Text), "\n", "<br>\n")
+			}
+			message.HTML = request.Html + "<div>" + html.EscapeString(attribution) + "</div><blockquote>" + original + "</blockquote>"
+		}
+	}
+
+	reply, results, err := m.sendMessage(ctx, message, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	logrus.WithFields(logrus.Fields{
+		"mailId":     reply.ID,
+		"inReplyTo":  email.ID,
+		"messageId":  reply.MessageID,
+		"sender":     reply.From,
+		"recipients": len(results),
+		"elapsed":    elapsed,
+	}).Info("reply sent")
+	return &pb.SendMailResponse{
+		MailId:     uint64(reply.ID),
+		MessageId:  reply.MessageID,
+		Deliveries: results,
+	}, nil
+}
+
+// replyRecipients answers received mail to its Reply-To, or its sender, and
+// mail we sent to its recipients. Reply-all copies the rest of the original
+// recipients. The replying address never gets its own reply.
+func replyRecipients(email *Email, header mail.Header, self string, replyAll bool) ([]mail.Address, []mail.Address) {
+	var to, others []*mail.Address
+	if email.Direction == EmailOutbound {
+		to, _ = header.AddressList("To")
+		others, _ = header.AddressList("Cc")
+	} else {
+		if to, _ = header.AddressList("Reply-To"); len(to) == 0 {
+			to, _ = header.AddressList("From")
+		}
+		originalTo, _ := header.AddressList("To")
+		originalCc, _ := header.AddressList("Cc")
+		others = append(originalTo, originalCc...)
+	}
+
+	seen := map[string]bool{normalizeAddress(self): true}
+	pick := func(addresses []*mail.Address) []mail.Address {
+		var picked []mail.Address
+		for _, address := range addresses {
+			if seen[normalizeAddress(address.Address)] {
+				continue
+			}
+			seen[normalizeAddress(address.Address)] = true
+			picked = append(picked, *address)
+		}
+		return picked
+	}
+
+	replyTo := pick(to)
+	if !replyAll {
+		return replyTo, nil
+	}
+	return replyTo, pick(others)
+}
+
+func replySubject(subject string) string {
+	if strings.HasPrefix(strings.ToLower(subject), "re:") {
+		return subject
+	}
+	return strings.TrimSpace("Re: " + subject)
+}
+
+// replyReferences follows RFC 5322 section 3.6.4: the references of the
+// original, or its In-Reply-To when it has none, followed by its own id.
+func replyReferences(header mail.Header, messageID string) []string {
+	references := parseMessageIDs(header.Get("References"))
+	if len(references) == 0 {
+		if inReplyTo := parseMessageIDs(header.Get("In-Reply-To")); len(inReplyTo) == 1 {
+			references = inReplyTo
+		}
+	}
+	if messageID != "" {
+		references = append(references, messageID)
+	}
+	return references
+}
+
+func quoteAttribution(email *Email, header mail.Header) string {
+	from := decodeHeader(header.Get("From"))
+	if from == "" {
+		from = email.From
+	}
+	return "On " + email.SentDate.Format("Mon, 2 Jan 2006 at 15:04") + ", " + from + " wrote:"
+}
+
+func quoteText(text string) string {
+	lines := strings.Split(strings.TrimRight(strings.ReplaceAll(text, "\r\n", "\n"), "\n"), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ">") {
+			lines[i] = ">" + line
+		} else {
+			lines[i] = "> " + line
+		}
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
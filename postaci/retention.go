@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 500
+
+	// PurgedContent and PurgedMetadata tell what a purge removed, the
+	// content of a mail or the whole mail.
+	PurgedContent  = "content"
+	PurgedMetadata = "metadata"
+)
+
+// RetentionPolicy tells how long mail is kept. Its content, and its file
+// in the Maildir, is removed after Content, and the mail is deleted after
+// Metadata. Zero keeps them forever.
+type RetentionPolicy struct {
+	Content  time.Duration
+	Metadata time.Duration
+}
+
+// RetentionPolicies are the policies by the address or the domain of the
+// mailbox they apply to, with "*" for every other mailbox.
+type RetentionPolicies map[string]RetentionPolicy
+
+// ParseRetentionPolicies reads policies written as match=content:metadata,
+// like "example.com=30d:365d,legal@example.com=0:0,*=:730d". Durations are
+// Go durations or days, and an empty or zero duration keeps mail forever.
+func ParseRetentionPolicies(spec string) (RetentionPolicies, error) {
+	policies := RetentionPolicies{}
+	for _, entry := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' }) {
+		match, durations, ok := strings.Cut(entry, "=")
+		if !ok || match == "" {
+			return nil, fmt.Errorf("retention policy %s is not in match=content:metadata form", entry)
+		}
+		content, metadata, _ := strings.Cut(durations, ":")
+
+		var policy RetentionPolicy
+		var err error
+		if policy.Content, err = parseRetentionDuration(content); err != nil {
+			return nil, fmt.Errorf("cannot parse the content retention of %s: %s", entry, err)
+		}
+		if policy.Metadata, err = parseRetentionDuration(metadata); err != nil {
+			return nil, fmt.Errorf("cannot parse the metadata retention of %s: %s", entry, err)
+		}
+		policies[normalizeAddress(strings.TrimPrefix(match, "@"))] = policy
+	}
+	return policies, nil
+}
+
+func parseRetentionDuration(value string) (time.Duration, error) {
+	if value == "" || value == "0" {
+		return 0, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// For finds the policy of a mailbox, by its address, then by its domain
+// and then "*". It tells which of them matched, and is empty when none did.
+func (r RetentionPolicies) For(mailbox string) (string, RetentionPolicy) {
+	mailbox = normalizeAddress(mailbox)
+	if policy, ok := r[mailbox]; ok {
+		return mailbox, policy
+	}
+	if at := strings.LastIndex(mailbox, "@"); at >= 0 {
+		if policy, ok := r[mailbox[at+1:]]; ok {
+			return mailbox[at+1:], policy
+		}
+	}
+	if policy, ok := r["*"]; ok {
+		return "*", policy
+	}
+	return "", RetentionPolicy{}
+}
+
+// shortest is the shortest retention of the policies, and zero when all of
+// them keep mail forever. Mail younger than it is kept by every policy.
+func (r RetentionPolicies) shortest(retention func(RetentionPolicy) time.Duration) time.Duration {
+	var shortest time.Duration
+	for _, policy := range r {
+		if d := retention(policy); d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
+	}
+	return shortest
+}
+
+type RetentionStore interface {
+	// FindRetentionCandidates lists mail received before a date, without its
+	// content, in the order of their IDs after afterID. withContent skips
+	// mail whose content is purged already.
+	FindRetentionCandidates(before time.Time, withContent bool, afterID uint, limit int) ([]Email, error)
+	PurgeEmailContent(ids []uint) error
+	DeleteEmails(ids []uint) error
+}
+
+func (p *Persistence) FindRetentionCandidates(before time.Time, withContent bool, afterID uint, limit int) ([]Email, error) {
+	query := db.Unscoped().Omit("content").Where("created_at < ? AND id > ?", before, afterID).Order("id").Limit(limit)
+	if withContent {
+		query = query.Where("content IS NOT NULL")
+	}
+
+	var emails []Email
+	result := query.Find(&emails)
+	return emails, result.Error
+}
+
+// PurgeEmailContent removes the content of the mail, with the rewritten
+// copies of it that its deliveries keep.
+func (p *Persistence) PurgeEmailContent(ids []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Model(&Delivery{}).Where("email_id IN ?", ids).Update("content", nil).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Model(&Email{}).Where("id IN ?", ids).Update("content", nil).Error
+	})
+}
+
+// DeleteEmails deletes the rows of the mail, rather than marking them as
+// deleted like gorm does, with the deliveries, bounces, alias hits and
+// references of the mail. Its threads are counted again, and are deleted
+// when they are left without mail.
+func (p *Persistence) DeleteEmails(ids []uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var threadIds, deliveryIds []uint
+		if err := tx.Unscoped().Model(&Email{}).Where("id IN ? AND thread_id <> 0", ids).Distinct().Pluck("thread_id", &threadIds).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Model(&Delivery{}).Where("email_id IN ?", ids).Pluck("id", &deliveryIds).Error; err != nil {
+			return err
+		}
+
+		if len(deliveryIds) > 0 {
+			if err := tx.Unscoped().Where("delivery_id IN ?", deliveryIds).Delete(&Bounce{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&Delivery{}, deliveryIds).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("email_id IN ?", ids).Delete(&AliasHit{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("email_id IN ?", ids).Delete(&EmailReference{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&Email{}, ids).Error; err != nil {
+			return err
+		}
+
+		for _, threadId := range threadIds {
+			if err := pruneThread(tx, threadId); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PurgeReport counts what a purge removed, or would remove in a dry run,
+// in total and by the policy that matched.
+type PurgeReport struct {
+	DryRun        bool
+	ContentPurged int
+	Deleted       int
+	FilesRemoved  int
+	Policies      map[string]*PurgeCount
+}
+
+type PurgeCount struct {
+	ContentPurged int
+	Deleted       int
+}
+
+func (r *PurgeReport) count(match, purged string) {
+	if r.Policies == nil {
+		r.Policies = map[string]*PurgeCount{}
+	}
+	if r.Policies[match] == nil {
+		r.Policies[match] = &PurgeCount{}
+	}
+
+	if purged == PurgedMetadata {
+		r.Deleted++
+		r.Policies[match].Deleted++
+	} else {
+		r.ContentPurged++
+		r.Policies[match].ContentPurged++
+	}
+}
+
+// Purger removes mail that is older than its retention policy. Deleted mail
+// is gone from the database with its file in the Maildir it came from, and
+// purged mail keeps its row without its content. Every purge is announced.
+type Purger struct {
+	Policies RetentionPolicies
+	Store    RetentionStore
+	Producer MessageProducer
+	// Maildirs are the paths of the Maildir sources by their labels.
+	Maildirs map[string]string
+	// DryRun only reports what would be purged.
+	DryRun    bool
+	BatchSize int
+}
+
+// Purge removes the mail that is past its retention at now.
+func (p *Purger) Purge(now time.Time) (*PurgeReport, error) {
+	report := &PurgeReport{DryRun: p.DryRun}
+	// Mail is deleted before its content is purged, so that mail past both
+	// retentions is deleted at once.
+	if err := p.purge(now, PurgedMetadata, report); err != nil {
+		return report, err
+	}
+	err := p.purge(now, PurgedContent, report)
+	return report, err
+}
+
+func (p *Purger) purge(now time.Time, purged string, report *PurgeReport) error {
+	retention := func(policy RetentionPolicy) time.Duration { return policy.Metadata }
+	if purged == PurgedContent {
+		retention = func(policy RetentionPolicy) time.Duration { return policy.Content }
+	}
+	shortest := p.Policies.shortest(retention)
+	if shortest == 0 {
+		return nil
+	}
+
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultRetentionBatchSize
+	}
+
+	var afterID uint
+	for {
+		candidates, err := p.Store.FindRetentionCandidates(now.Add(-shortest), purged == PurgedContent, afterID, batchSize)
+		if err != nil {
+			return err
+		}
+
+		var expired []Email
+		var ids []uint
+		// Mail is kept from the time it is received. Its Date field is
+		// written by the sender, who could keep it forever or purge it at
+		// once.
+		for _, email := range candidates {
+			afterID = email.ID
+			match, policy := p.Policies.For(retentionMailbox(&email))
+			// Mail past its metadata retention is deleted, or would be in a
+			// dry run, rather than purged.
+			if purged == PurgedContent && policy.Metadata > 0 && email.CreatedAt.Before(now.Add(-policy.Metadata)) {
+				continue
+			}
+			if d := retention(policy); d > 0 && email.CreatedAt.Before(now.Add(-d)) {
+				report.count(match, purged)
+				expired = append(expired, email)
+				ids = append(ids, email.ID)
+			}
+		}
+
+		if len(ids) > 0 && !p.DryRun {
+			if err = p.remove(expired, ids, purged, report); err != nil {
+				return err
+			}
+		}
+		if len(candidates) < batchSize {
+			return nil
+		}
+	}
+}
+
+// remove purges the mail in the database first, and then removes its
+// files, so that a failed purge does not leave rows without their files.
+func (p *Purger) remove(emails []Email, ids []uint, purged string, report *PurgeReport) error {
+	var err error
+	if purged == PurgedMetadata {
+		err = p.Store.DeleteEmails(ids)
+	} else {
+		err = p.Store.PurgeEmailContent(ids)
+	}
+	if err != nil {
+		return err
+	}
+	retentionMetrics.Add(purged, int64(len(ids)))
+
+	for _, email := range emails {
+		root, ok := p.Maildirs[email.Source]
+		if !ok || email.Filename == "" {
+			continue
+		}
+		err = removeMaildirFile(root, email.Filename)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logrus.WithField("mailId", email.ID).Warnf("cannot remove the mail file: %s", err)
+			continue
+		}
+		report.FilesRemoved++
+		retentionMetrics.Add("filesRemoved", 1)
+	}
+
+	if p.Producer == nil {
+		return nil
+	}
+	for _, email := range emails {
+		if err = EmitEmailPurgedMessage(p.Producer, email.ID, email.To, retentionMailbox(&email), purged); err != nil {
+			logrus.WithField("mailId", email.ID).Errorf("something happened while announcing the purge: %s", err)
+		}
+	}
+	return nil
+}
+
+// retentionMailbox is the mailbox whose policy applies to a mail, the
+// recipient without its subaddress, or the sender of mail that is sent.
+func retentionMailbox(email *Email) string {
+	if email.Direction == EmailOutbound {
+		return normalizeAddress(email.From)
+	}
+	if email.Mailbox != "" {
+		return email.Mailbox
+	}
+	mailbox, _ := splitSubaddress(email.To, defaultSubaddressDelimiters)
+	return mailbox
+}
+
+// EmitEmailPurgedMessage announces a purged mail as
+// "id|to|mailbox|content" or "id|to|mailbox|metadata".
+func EmitEmailPurgedMessage(producer MessageProducer, mailId uint, receiver, mailbox, purged string) error {
+	return producer.Produce(context.Background(), "emailpurged", fmt.Sprintf("%v|%s|%s|%s", mailId, receiver, mailbox, purged))
+}
+
+// RunPurger purges expired mail every interval until the context is done.
+func RunPurger(ctx context.Context, purger *Purger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := purger.Purge(time.Now())
+			if err != nil {
+				logrus.Errorf("something happened while purging expired mail: %s", err)
+			}
+			if report.ContentPurged > 0 || report.Deleted > 0 {
+				report.log()
+			}
+		}
+	}
+}
+
+func (r *PurgeReport) log() {
+	message := "expired mail is purged"
+	if r.DryRun {
+		message = "expired mail would be purged"
+	}
+
+	for match, count := range r.Policies {
+		logrus.WithFields(logrus.Fields{
+			"policy":        match,
+			"contentPurged": count.ContentPurged,
+			"deleted":       count.Deleted,
+		}).Info(message)
+	}
+	logrus.WithFields(logrus.Fields{
+		"contentPurged": r.ContentPurged,
+		"deleted":       r.Deleted,
+		"filesRemoved":  r.FilesRemoved,
+	}).Info(message)
+}
+
+// runPurge is the purge subcommand, which purges expired mail once with the
+// policies of RETENTION_POLICIES:
+//
+//	postaci purge [-dry-run]
+func runPurge(args []string) {
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only report what would be purged")
+	emit := flags.Bool("emit", false, "announce the purged mail")
+	flags.Parse(args)
+
+	policies, err := ParseRetentionPolicies(os.Getenv("RETENTION_POLICIES"))
+	if err != nil {
+		logrus.Fatalf("cannot configure retention policies: %s", err)
+	}
+
+	persistence := &Persistence{}
+	persistence.Initialize(os.Getenv("MYSQL_DSN"))
+
+	purger := &Purger{
+		Policies:  policies,
+		Store:     persistence,
+		Maildirs:  map[string]string{},
+		DryRun:    *dryRun,
+		BatchSize: intFromEnv("RETENTION_BATCH_SIZE", defaultRetentionBatchSize),
+	}
+	for _, source := range maildirSourcesFromEnv() {
+		purger.Maildirs[source.Name] = source.Path
+	}
+	if *emit {
+		messageBroker := &MessageBroker{}
+		messageBroker.Initialize(os.Getenv("KAFKA_ADDRESS"), os.Getenv("KAFKA_USERNAME"), os.Getenv("KAFKA_PASSWORD"))
+		purger.Producer = messageBroker
+	}
+
+	report, err := purger.Purge(time.Now())
+	report.log()
+	if err != nil {
+		logrus.Fatalf("something happened while purging expired mail: %s", err)
+	}
+}
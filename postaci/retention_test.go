@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestParseRetentionPolicies(t *testing.T) {
+	policies, err := ParseRetentionPolicies("example.com=30d:365d, Legal@Example.com=0:0 *=:12h")
+	if err != nil {
+		t.Fatalf("cannot parse the policies: %s", err)
+	}
+
+	tests := []struct {
+		mailbox string
+		match   string
+		policy  RetentionPolicy
+	}{
+		{"ali@example.com", "example.com", RetentionPolicy{Content: 30 * 24 * time.Hour, Metadata: 365 * 24 * time.Hour}},
+		{"legal@example.com", "legal@example.com", RetentionPolicy{}},
+		{"ali@example.org", "*", RetentionPolicy{Metadata: 12 * time.Hour}},
+	}
+	for _, test := range tests {
+		if match, policy := policies.For(test.mailbox); match != test.match || policy != test.policy {
+			t.Errorf("expected %s to have the %s policy %+v, but got the %s policy %+v", test.mailbox, test.match, test.policy, match, policy)
+		}
+	}
+
+	if _, err = ParseRetentionPolicies("example.com=30 days"); err == nil {
+		t.Errorf("expected a malformed policy to be rejected")
+	}
+}
+
+func TestPurgerRemovesExpiredMail(t *testing.T) {
+	directory, _ := os.MkdirTemp(".", "tmp")
+	defer func() {
+		if err := os.RemoveAll(directory); err != nil {
+			t.Fatalf("cannot remove the temp directory: %s", err)
+		}
+	}()
+	if err := os.MkdirAll(path.Join(directory, "cur"), fs.ModePerm); err != nil {
+		t.Fatalf("cannot create the maildir: %s", err)
+	}
+	if err := os.WriteFile(path.Join(directory, "cur", "purged:2,S"), []byte("hello"), fs.ModePerm); err != nil {
+		t.Fatalf("cannot write the mail: %s", err)
+	}
+
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	now := time.Now()
+	emails := map[string]*Email{
+		"deleted": {To: "old@retention.test", Mailbox: "old@retention.test", Model: gorm.Model{CreatedAt: now.Add(-400 * 24 * time.Hour)}},
+		"purged":  {To: "ali+tag@retention.test", Mailbox: "ali@retention.test", Subaddress: "tag", Model: gorm.Model{CreatedAt: now.Add(-60 * 24 * time.Hour)}, Source: "retention-test", Filename: "purged"},
+		"recent":  {To: "ali@retention.test", Mailbox: "ali@retention.test", Model: gorm.Model{CreatedAt: now.Add(-10 * 24 * time.Hour)}},
+		"kept":    {To: "legal@retention.test", Mailbox: "legal@retention.test", Model: gorm.Model{CreatedAt: now.Add(-400 * 24 * time.Hour)}},
+		"sent":    {From: "legal@retention.test", To: "someone@elsewhere.test", Direction: EmailOutbound, Model: gorm.Model{CreatedAt: now.Add(-400 * 24 * time.Hour)}},
+		"forged":  {To: "ali@retention.test", Mailbox: "ali@retention.test", SentDate: now.Add(-400 * 24 * time.Hour)},
+	}
+	for name, email := range emails {
+		email.Content = []byte(name)
+		email.Subject = fmt.Sprintf("retention %s", name)
+		email.MessageID = fmt.Sprintf("<%s@retention.test>", name)
+		if err := persistence.CreateEmail(email); err != nil {
+			t.Fatalf("cannot create the mail: %s", err)
+		}
+	}
+	followup := &Email{
+		To:        "old@retention.test",
+		Mailbox:   "old@retention.test",
+		Subject:   "retention followup",
+		MessageID: "<followup@retention.test>",
+		InReplyTo: "<deleted@retention.test>",
+		Content:   []byte("followup"),
+	}
+	if err := persistence.CreateEmail(followup); err != nil {
+		t.Fatalf("cannot create the mail: %s", err)
+	}
+	if followup.ThreadID == 0 || followup.ThreadID != emails["deleted"].ThreadID {
+		t.Fatalf("expected the followup to be threaded with the mail it replies to")
+	}
+	delivery := &Delivery{EmailID: emails["deleted"].ID, Recipient: "someone@elsewhere.test", Status: "deferred"}
+	db.Create(delivery)
+	db.Create(&Bounce{DeliveryID: delivery.ID, Recipient: "someone@elsewhere.test"})
+	db.Create(&AliasHit{Address: "old@retention.test", EmailID: emails["deleted"].ID})
+	forward := &Delivery{EmailID: emails["purged"].ID, Recipient: "someone@elsewhere.test", Status: DeliverySent, Content: []byte("rewritten purged")}
+	db.Create(forward)
+
+	policies, _ := ParseRetentionPolicies("retention.test=30d:365d,legal@retention.test=0:0,elsewhere.test=:365d")
+	producer := &FakeMessageProducer{}
+	purger := &Purger{
+		Policies:  policies,
+		Store:     persistence,
+		Producer:  producer,
+		Maildirs:  map[string]string{"retention-test": directory},
+		DryRun:    true,
+		BatchSize: 1,
+	}
+
+	report, err := purger.Purge(now)
+	if err != nil {
+		t.Fatalf("cannot report the purge: %s", err)
+	}
+	if report.Deleted != 1 || report.ContentPurged != 1 || report.Policies["retention.test"].Deleted != 1 {
+		t.Errorf("expected a mail to be deleted and another to be purged, but got %+v", report)
+	}
+	if producer.isCalled {
+		t.Errorf("expected a dry run not to announce anything")
+	}
+	if email, err := persistence.FindEmail(uint64(emails["deleted"].ID)); err != nil || string(email.Content) != "deleted" {
+		t.Errorf("expected a dry run to keep the mail, but got %v", err)
+	}
+
+	purger.DryRun = false
+	if report, err = purger.Purge(now); err != nil {
+		t.Fatalf("cannot purge: %s", err)
+	}
+	if report.Deleted != 1 || report.ContentPurged != 1 || report.FilesRemoved != 1 {
+		t.Errorf("expected a mail to be deleted and another to be purged with its file, but got %+v", report)
+	}
+
+	var count int64
+	db.Unscoped().Model(&Email{}).Where("id = ?", emails["deleted"].ID).Count(&count)
+	if count != 0 {
+		t.Errorf("expected the expired mail to be deleted for good")
+	}
+	if email, _ := persistence.FindEmail(uint64(emails["purged"].ID)); email.Content != nil || email.Subject != "retention purged" {
+		t.Errorf("expected the content to be purged and the metadata to be kept, but got %+v", email)
+	}
+	if db.First(forward, forward.ID); forward.Content != nil {
+		t.Errorf("expected the rewritten copy of the mail to be purged, but got %q", forward.Content)
+	}
+	if _, err = os.Stat(path.Join(directory, "cur", "purged:2,S")); !os.IsNotExist(err) {
+		t.Errorf("expected the mail file to be removed, but got %v", err)
+	}
+	for _, name := range []string{"recent", "kept", "sent", "forged"} {
+		if email, _ := persistence.FindEmail(uint64(emails[name].ID)); string(email.Content) != name {
+			t.Errorf("expected the %s mail to be kept, but got %q", name, email.Content)
+		}
+	}
+	var thread Thread
+	if err = db.First(&thread, followup.ThreadID).Error; err != nil || thread.MessageCount != 1 || thread.Subject != "retention followup" {
+		t.Errorf("expected the thread to be left with the followup, but got %+v: %v", thread, err)
+	}
+	var deliveries, bounces, hits int64
+	db.Unscoped().Model(&Delivery{}).Where("email_id = ?", emails["deleted"].ID).Count(&deliveries)
+	db.Unscoped().Model(&Bounce{}).Where("delivery_id = ?", delivery.ID).Count(&bounces)
+	db.Unscoped().Model(&AliasHit{}).Where("email_id = ?", emails["deleted"].ID).Count(&hits)
+	if deliveries != 0 || bounces != 0 || hits != 0 {
+		t.Errorf("expected the deliveries, bounces and alias hits of the mail to be deleted, but got %d, %d and %d", deliveries, bounces, hits)
+	}
+	if !producer.IsCalledWith("emailpurged", fmt.Sprintf("%v|ali+tag@retention.test|ali@retention.test|content", emails["purged"].ID)) {
+		t.Errorf("expected the purge to be announced, but got %q", producer.message)
+	}
+
+	if report, _ = purger.Purge(now); report.Deleted != 0 || report.ContentPurged != 0 {
+		t.Errorf("expected nothing to be left to purge, but got %+v", report)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+var defaultInternalHeaders = []string{"X-Original-To", "Delivered-To", "Return-Path"}
+
+// HeaderRewrite describes the changes made to the header of a mail before it
+// is forwarded. The body is never touched.
+type HeaderRewrite struct {
+	// Resent prepends a RFC 5322 section 3.6.6 resent block when set.
+	Resent        *ResentHeaders
+	SubjectPrefix string
+	// StripHeaders are removed wherever they appear.
+	StripHeaders []string
+	// AddHeaders replace any existing field with the same name.
+	AddHeaders map[string]string
+}
+
+type ResentHeaders struct {
+	From      string
+	To        string
+	Date      time.Time
+	MessageID string
+}
+
+type headerField struct {
+	name string
+	raw  string
+}
+
+// RewriteHeaders applies the rewrite to the header of content. Folding,
+// ordering and line endings of the fields it does not touch are kept as
+// they are.
+func RewriteHeaders(content []byte, rewrite HeaderRewrite) ([]byte, error) {
+	newline := "\n"
+	if bytes.Contains(content, []byte("\r\n")) {
+		newline = "\r\n"
+	}
+
+	header, body := splitMessage(content)
+	fields := parseHeaderFields(header)
+
+	strip := map[string]bool{}
+	for _, name := range rewrite.StripHeaders {
+		strip[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	for name := range rewrite.AddHeaders {
+		if err := validateHeader(name, rewrite.AddHeaders[name]); err != nil {
+			return nil, err
+		}
+		strip[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	if err := validateHeader("Subject", rewrite.SubjectPrefix); err != nil {
+		return nil, err
+	}
+	if resent := rewrite.Resent; resent != nil {
+		for name, value := range map[string]string{"Resent-From": resent.From, "Resent-To": resent.To, "Resent-Message-ID": resent.MessageID} {
+			if err := validateHeader(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var out bytes.Buffer
+
+	if resent := rewrite.Resent; resent != nil {
+		writeField(&out, "Resent-Date", resent.Date.Format(time.RFC1123Z), newline)
+		writeField(&out, "Resent-From", resent.From, newline)
+		writeField(&out, "Resent-To", resent.To, newline)
+		writeField(&out, "Resent-Message-ID", "<"+resent.MessageID+">", newline)
+	}
+
+	hasSubject := false
+	for _, field := range fields {
+		if strip[field.name] {
+			continue
+		}
+
+		if field.name == "Subject" && rewrite.SubjectPrefix != "" {
+			hasSubject = true
+			prefix := encodeHeaderValue(rewrite.SubjectPrefix)
+			subject := strings.TrimSpace(field.raw[strings.Index(field.raw, ":")+1:])
+			if !strings.HasPrefix(subject, prefix) {
+				subject = strings.TrimSpace(prefix + " " + subject)
+			}
+			writeField(&out, "Subject", subject, newline)
+			continue
+		}
+
+		out.WriteString(field.raw)
+	}
+	// Mail without a subject gets the prefix as its subject.
+	if rewrite.SubjectPrefix != "" && !hasSubject && !strip["Subject"] {
+		writeField(&out, "Subject", encodeHeaderValue(rewrite.SubjectPrefix), newline)
+	}
+
+	names := make([]string, 0, len(rewrite.AddHeaders))
+	for name := range rewrite.AddHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(&out, name, encodeHeaderValue(rewrite.AddHeaders[name]), newline)
+	}
+
+	out.WriteString(newline)
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+// splitMessage returns the header, including the line break of its last
+// field, and the body without the separating empty line.
+func splitMessage(content []byte) ([]byte, []byte) {
+	crlf := bytes.Index(content, []byte("\r\n\r\n"))
+	lf := bytes.Index(content, []byte("\n\n"))
+
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return content[:crlf+2], content[crlf+4:]
+	case lf >= 0:
+		return content[:lf+1], content[lf+2:]
+	default:
+		return content, nil
+	}
+}
+
+// parseHeaderFields splits a header into fields, keeping continuation lines
+// with the field they belong to.
+func parseHeaderFields(header []byte) []headerField {
+	var fields []headerField
+
+	for _, line := range strings.SplitAfter(string(header), "\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+
+		name := line
+		if colon := strings.Index(line, ":"); colon >= 0 {
+			name = line[:colon]
+		}
+		fields = append(fields, headerField{name: textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)), raw: line})
+	}
+	return fields
+}
+
+func writeField(out *bytes.Buffer, name, value, newline string) {
+	out.WriteString(name)
+	out.WriteString(": ")
+	out.WriteString(value)
+	out.WriteString(newline)
+}
+
+func validateHeader(name, value string) error {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("value of header %s contains a line break", name)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// defaultSubaddressDelimiters are the characters that separate a mailbox
+// from its tag, like recipient_delimiter of Postfix.
+const defaultSubaddressDelimiters = "+"
+
+// EmailFilter narrows a search to the fields that are set. Mailbox matches
+// the mail received by the mailbox and the mail sent from it.
+type EmailFilter struct {
+	Mailbox    string     `json:"mailbox,omitempty"`
+	Subaddress string     `json:"subaddress,omitempty"`
+	To         string     `json:"to,omitempty"`
+	From       string     `json:"from,omitempty"`
+	Direction  string     `json:"direction,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+	Until      *time.Time `json:"until,omitempty"`
+	// After is the last mail of the previous page. Paging by it instead of
+	// an offset does not shift when mail arrives or is purged meanwhile.
+	After *EmailCursor `json:"-"`
+}
+
+// EmailCursor is a position in the search results, which are ordered by
+// the sent date and then the ID, the newest first.
+type EmailCursor struct {
+	SentDate time.Time
+	ID       uint
+}
+
+type EmailSearcher interface {
+	FindEmails(filter EmailFilter, limit, offset int) ([]Email, error)
+	// FindEmailContents reads the content of the mail by their IDs. Mail
+	// whose content is purged is left out.
+	FindEmailContents(ids []uint) (map[uint][]byte, error)
+}
+
+func (p *Persistence) FindEmailContents(ids []uint) (map[uint][]byte, error) {
+	var emails []Email
+	if err := db.Select("id", "content").Where("id IN ? AND content IS NOT NULL", ids).Find(&emails).Error; err != nil {
+		return nil, err
+	}
+
+	contents := make(map[uint][]byte, len(emails))
+	for _, email := range emails {
+		contents[email.ID] = email.Content
+	}
+	return contents, nil
+}
+
+func (p *Persistence) FindEmails(filter EmailFilter, limit, offset int) ([]Email, error) {
+	query := db.Omit("content").Order("sent_date desc, id desc").Limit(limit).Offset(offset)
+	if filter.Mailbox != "" {
+		mailbox := normalizeAddress(filter.Mailbox)
+		query = query.Where("(mailbox = ? OR (direction = ? AND LOWER(`from`) = ?))", mailbox, EmailOutbound, mailbox)
+	}
+	if filter.Subaddress != "" {
+		query = query.Where("subaddress = ?", filter.Subaddress)
+	}
+	if filter.To != "" {
+		query = query.Where("`to` = ?", filter.To)
+	}
+	if filter.From != "" {
+		query = query.Where("`from` = ?", filter.From)
+	}
+	if filter.Direction != "" {
+		query = query.Where("direction = ?", filter.Direction)
+	}
+	if filter.Since != nil {
+		query = query.Where("sent_date >= ?", *filter.Since)
+	}
+	if filter.Until != nil {
+		query = query.Where("sent_date < ?", *filter.Until)
+	}
+	if filter.After != nil {
+		query = query.Where("(sent_date < ? OR (sent_date = ? AND id < ?))", filter.After.SentDate, filter.After.SentDate, filter.After.ID)
+	}
+
+	var emails []Email
+	result := query.Find(&emails)
+	return emails, result.Error
+}
+
+// splitSubaddress splits "user+tag@domain" into "user@domain" and "tag" at
+// the first of the delimiters in the local part. The mailbox is lower cased
+// so that it can be matched.
+func splitSubaddress(address, delimiters string) (string, string) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return normalizeAddress(address), ""
+	}
+
+	local, domain := address[:at], address[at:]
+	if i := strings.IndexAny(local, delimiters); delimiters != "" && i > 0 {
+		return normalizeAddress(local[:i] + domain), local[i+1:]
+	}
+	return normalizeAddress(address), ""
+}
+
+func (m *mailingServerServer) SearchEmails(ctx context.Context, request *pb.SearchEmailsRequest) (*pb.SearchEmailsResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	filter := EmailFilter{
+		Mailbox:    request.Mailbox,
+		Subaddress: request.Subaddress,
+		To:         request.To,
+		From:       request.From,
+		Direction:  request.Direction,
+	}
+	if request.Since != nil {
+		since := request.Since.AsTime()
+		filter.Since = &since
+	}
+	if request.Until != nil {
+		until := request.Until.AsTime()
+		filter.Until = &until
+	}
+
+	emails, err := m.Emails.FindEmails(filter, limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while searching emails: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.SearchEmailsResponse{}
+	for _, email := range emails {
+		response.Emails = append(response.Emails, &pb.EmailSummary{
+			MailId:     uint64(email.ID),
+			From:       email.From,
+			To:         email.To,
+			Mailbox:    email.Mailbox,
+			Subaddress: email.Subaddress,
+			Subject:    email.Subject,
+			MessageId:  email.MessageID,
+			SentDate:   timestamppb.New(email.SentDate),
+			Direction:  email.Direction,
+			ThreadId:   uint64(email.ThreadID),
+		})
+	}
+	return response, nil
+}
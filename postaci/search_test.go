@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitSubaddress(t *testing.T) {
+	cases := []struct {
+		address, delimiters, mailbox, subaddress string
+	}{
+		{"Ali+ticket-42@Example.com", "+", "ali@example.com", "ticket-42"},
+		{"ali@example.com", "+", "ali@example.com", ""},
+		{"ali-ticket+42@example.com", "+-", "ali@example.com", "ticket+42"},
+		{"+tag@example.com", "+", "+tag@example.com", ""},
+		{"ali+tag@example.com", "", "ali+tag@example.com", ""},
+	}
+	for _, c := range cases {
+		mailbox, subaddress := splitSubaddress(c.address, c.delimiters)
+		if mailbox != c.mailbox || subaddress != c.subaddress {
+			t.Errorf("expected %s to split into %s and %q, but got %s and %q", c.address, c.mailbox, c.subaddress, mailbox, subaddress)
+		}
+	}
+}
+
+func TestFindEmailsBySubaddress(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	sent := time.Date(2022, 9, 2, 12, 0, 0, 0, time.UTC)
+	for _, to := range []string{"support+ticket-7@search.test", "support+ticket-8@search.test", "support@search.test"} {
+		email := &Email{To: to, SentDate: sent, Direction: EmailInbound}
+		email.Mailbox, email.Subaddress = splitSubaddress(to, defaultSubaddressDelimiters)
+		if err := persistence.CreateEmail(email); err != nil {
+			t.Fatalf("cannot store the email: %s", err)
+		}
+	}
+
+	reply := &Email{From: "Support@search.test", To: "customer@example.org", SentDate: sent.Add(time.Hour), Direction: EmailOutbound, Content: []byte("noted")}
+	if err := persistence.CreateEmail(reply); err != nil {
+		t.Fatalf("cannot store the email: %s", err)
+	}
+
+	emails, err := persistence.FindEmails(EmailFilter{Mailbox: "Support@search.test"}, 10, 0)
+	if err != nil || len(emails) != 4 || emails[0].ID != reply.ID {
+		t.Errorf("expected every mail to and from the mailbox, but got %d and %v", len(emails), err)
+	}
+
+	var paged []uint
+	filter := EmailFilter{Mailbox: "support@search.test"}
+	for {
+		page, err := persistence.FindEmails(filter, 3, 0)
+		if err != nil {
+			t.Fatalf("cannot page the mail: %s", err)
+		}
+		for _, email := range page {
+			paged = append(paged, email.ID)
+		}
+		if len(page) < 3 {
+			break
+		}
+		// Mail that arrives between the pages does not shift them.
+		persistence.CreateEmail(&Email{To: "support@search.test", Mailbox: "support@search.test", SentDate: sent.Add(2 * time.Hour), Direction: EmailInbound})
+		filter.After = &EmailCursor{SentDate: page[len(page)-1].SentDate, ID: page[len(page)-1].ID}
+	}
+	if len(paged) != 4 || paged[0] != reply.ID || paged[3] != emails[3].ID {
+		t.Errorf("expected the pages to have every mail once, but got %v", paged)
+	}
+
+	emails, err = persistence.FindEmails(EmailFilter{Mailbox: "support@search.test", Subaddress: "ticket-7"}, 10, 0)
+	if err != nil || len(emails) != 1 || emails[0].To != "support+ticket-7@search.test" {
+		t.Errorf("expected the mail for the ticket, but got %+v and %v", emails, err)
+	}
+
+	contents, err := persistence.FindEmailContents([]uint{reply.ID, emails[0].ID})
+	if err != nil || len(contents) != 1 || string(contents[reply.ID]) != "noted" {
+		t.Errorf("expected the content of the mail that has one, but got %q and %v", contents, err)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// deliverySuppressed is reported for recipients that are never attempted
+// because they are on the suppression list.
+const deliverySuppressed = "suppressed"
+
+func (m *mailingServerServer) SendMail(ctx context.Context, request *pb.SendMailRequest) (*pb.SendMailResponse, error) {
+	start := time.Now()
+
+	from, err := mail.ParseAddress(request.From)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sender %q: %s", request.From, err)
+	}
+
+	var to, cc, bcc []mail.Address
+	for _, list := range []struct {
+		addresses []string
+		parsed    *[]mail.Address
+	}{{request.To, &to}, {request.Cc, &cc}, {request.Bcc, &bcc}} {
+		if *list.parsed, err = parseAddresses(list.addresses); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	if len(to)+len(cc)+len(bcc) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "the mail has no recipients")
+	}
+	if err = validateHeader("Subject", request.Subject); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err = validateRequestHeaders(request.Headers, request.Attachments); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	message := &OutgoingMessage{
+		From:        *from,
+		To:          to,
+		Cc:          cc,
+		Subject:     request.Subject,
+		Text:        request.Text,
+		HTML:        request.Html,
+		Attachments: attachmentsFromProto(request.Attachments),
+		Headers:     request.Headers,
+	}
+
+	email, results, err := m.sendMessage(ctx, message, bcc)
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	logrus.WithFields(logrus.Fields{
+		"mailId":     email.ID,
+		"messageId":  email.MessageID,
+		"sender":     email.From,
+		"recipients": len(results),
+		"elapsed":    elapsed,
+	}).Info("mail sent")
+	return &pb.SendMailResponse{
+		MailId:     uint64(email.ID),
+		MessageId:  email.MessageID,
+		Deliveries: results,
+	}, nil
+}
+
+// sendMessage stores message as an outbound email and delivers it to every
+// recipient, bcc included. A failed recipient does not stop the others, its
+// result tells what went wrong.
+func (m *mailingServerServer) sendMessage(ctx context.Context, message *OutgoingMessage, bcc []mail.Address) (*Email, []*pb.DeliveryResult, error) {
+	content, err := message.Bytes()
+	if err != nil {
+		return nil, nil, status.Errorf(codes.InvalidArgument, "cannot compose the mail: %s", err)
+	}
+
+	recipients := envelopeRecipients(message.To, message.Cc, bcc)
+	email := &Email{
+		From:         message.From.Address,
+		To:           strings.Join(recipients, ", "),
+		MessageID:    message.MessageID,
+		SentDate:     message.Date,
+		Content:      content,
+		Direction:    EmailOutbound,
+		Subject:      message.Subject,
+		InReplyTo:    message.InReplyTo,
+		ReferenceIDs: formatMessageIDs(message.References),
+	}
+	if err = m.EmailStore.CreateEmail(email); err != nil {
+		logrus.Errorf("something happened while persisting the outbound mail: %s", err)
+		return nil, nil, status.Error(codes.Internal, "cannot store the mail")
+	}
+
+	results := make([]*pb.DeliveryResult, 0, len(recipients))
+	for _, recipient := range recipients {
+		result := &pb.DeliveryResult{Recipient: recipient}
+
+		delivery, err := m.Deliverer.Deliver(ctx, email, email.From, recipient, content)
+		if delivery != nil {
+			result.DeliveryId = uint64(delivery.ID)
+			result.Status = delivery.Status
+		}
+		if err != nil {
+			var suppressedErr *SuppressedError
+			if errors.As(err, &suppressedErr) {
+				result.Status = deliverySuppressed
+			}
+			result.Error = err.Error()
+			logrus.WithField("recipient", recipient).Warnf("something happened while sending mail: %s", err)
+		}
+
+		results = append(results, result)
+	}
+	return email, results, nil
+}
+
+func parseAddresses(addresses []string) ([]mail.Address, error) {
+	parsed := make([]mail.Address, 0, len(addresses))
+	for _, address := range addresses {
+		a, err := mail.ParseAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q: %s", address, err)
+		}
+		parsed = append(parsed, *a)
+	}
+	return parsed, nil
+}
+
+// envelopeRecipients lists every address once, in the order they appear.
+func envelopeRecipients(lists ...[]mail.Address) []string {
+	seen := map[string]bool{}
+	var recipients []string
+	for _, list := range lists {
+		for _, address := range list {
+			if seen[normalizeAddress(address.Address)] {
+				continue
+			}
+			seen[normalizeAddress(address.Address)] = true
+			recipients = append(recipients, address.Address)
+		}
+	}
+	return recipients
+}
+
+// validateRequestHeaders checks the header fields and the attachment types
+// and names of a request, which all end up in the header of the mail.
+func validateRequestHeaders(headers map[string]string, attachments []*pb.Attachment) error {
+	for name, value := range headers {
+		if err := validateCustomHeader(name, value); err != nil {
+			return err
+		}
+	}
+	for _, attachment := range attachments {
+		if err := validateHeader("Content-Type", attachment.ContentType); err != nil {
+			return err
+		}
+		if strings.ContainsAny(attachment.Filename, "\r\n") {
+			return fmt.Errorf("attachment name %q contains a line break", attachment.Filename)
+		}
+	}
+	return nil
+}
+
+func attachmentsFromProto(attachments []*pb.Attachment) []Attachment {
+	converted := make([]Attachment, len(attachments))
+	for i, attachment := range attachments {
+		converted[i] = Attachment{
+			Filename:    attachment.Filename,
+			ContentType: attachment.ContentType,
+			Content:     attachment.Content,
+		}
+	}
+	return converted
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+type FakeEmailStore struct {
+	emails []*Email
+}
+
+func (f *FakeEmailStore) CreateEmail(email *Email) error {
+	f.emails = append(f.emails, email)
+	email.ID = uint(len(f.emails))
+	return nil
+}
+
+func (f *FakeEmailStore) FindEmail(emailId uint64) (*Email, error) {
+	if emailId == 0 || emailId > uint64(len(f.emails)) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return f.emails[emailId-1], nil
+}
+
+func TestSendMail(t *testing.T) {
+	sender := &FakeMailSender{}
+	store := &FakeEmailStore{}
+	server := &mailingServerServer{
+		Deliverer:  &Deliverer{Sender: sender, Store: &FakeDeliveryStore{}},
+		EmailStore: store,
+	}
+
+	response, err := server.SendMail(context.Background(), &pb.SendMailRequest{
+		From:    "Support <support@example.com>",
+		To:      []string{"ali@example.com"},
+		Cc:      []string{"veli@example.org", "ALI@example.com"},
+		Bcc:     []string{"audit@example.com"},
+		Subject: "Merhaba dünya",
+		Text:    "hello",
+		Html:    "<p>hello</p>",
+		Headers: map[string]string{"X-Ticket": "42"},
+	})
+	if err != nil {
+		t.Fatalf("cannot send mail: %s", err)
+	}
+
+	if len(store.emails) != 1 || store.emails[0].Direction != EmailOutbound || response.MessageId == "" {
+		t.Fatalf("expected the mail to be stored as outbound, but got %+v", store.emails)
+	}
+	if strings.Join(sender.recipients, " ") != "ali@example.com veli@example.org audit@example.com" {
+		t.Errorf("expected every recipient to get the mail once, but got %v", sender.recipients)
+	}
+	for _, delivery := range response.Deliveries {
+		if delivery.Status != DeliverySent {
+			t.Errorf("expected %s to be sent, but got %s", delivery.Recipient, delivery.Status)
+		}
+	}
+
+	parts, err := ReadMailParts(sender.mail)
+	if err != nil {
+		t.Fatalf("cannot read the sent mail: %s", err)
+	}
+	if subject := decodeHeader(parts.Header.Get("Subject")); subject != "Merhaba dünya" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if parts.Header.Get("Bcc") != "" || strings.Contains(string(sender.mail), "audit@example.com") {
+		t.Errorf("expected bcc recipients not to appear in the mail")
+	}
+	if parts.Text != "hello" || parts.HTML != "<p>hello</p>" || parts.Header.Get("X-Ticket") != "42" {
+		t.Errorf("unexpected mail content: %+v", parts)
+	}
+}
+
+func TestSendMailRefusesHeaderInjection(t *testing.T) {
+	sender := &FakeMailSender{}
+	server := &mailingServerServer{
+		Deliverer:  &Deliverer{Sender: sender, Store: &FakeDeliveryStore{}},
+		EmailStore: &FakeEmailStore{},
+	}
+
+	requests := []*pb.SendMailRequest{
+		{Subject: "hello\r\nBcc: someone@example.com"},
+		{Subject: "hello", Headers: map[string]string{"X-Ticket": "42\nBcc: someone@example.com"}},
+		{Subject: "hello", Attachments: []*pb.Attachment{{Filename: "a.txt", ContentType: "text/plain\nBcc: someone@example.com"}}},
+		{Subject: "hello", Attachments: []*pb.Attachment{{Filename: "a.txt\r\nBcc: someone@example.com"}}},
+	}
+	for _, request := range requests {
+		request.From, request.To = "support@example.com", []string{"ali@example.com"}
+		if _, err := server.SendMail(context.Background(), request); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("expected a line break in a header to be an invalid argument, but got %v", err)
+		}
+	}
+	if len(sender.recipients) != 0 {
+		t.Errorf("expected nothing to be sent, but got %v", sender.recipients)
+	}
+}
+
+func TestReplyToEmail(t *testing.T) {
+	sender := &FakeMailSender{}
+	store := &FakeEmailStore{}
+	server := &mailingServerServer{
+		Deliverer:   &Deliverer{Sender: sender, Store: &FakeDeliveryStore{}},
+		EmailFinder: store,
+		EmailStore:  store,
+	}
+	store.CreateEmail(&Email{
+		From:      "contact@example.com",
+		To:        "ali@example.com",
+		MessageID: "second@example.com",
+		SentDate:  time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC),
+		Direction: EmailInbound,
+		Content: []byte("From: Contact <contact@example.com>\n" +
+			"To: ali@example.com, veli@example.org\n" +
+			"Subject: Question\n" +
+			"Message-Id: <second@example.com>\n" +
+			"In-Reply-To: <first@example.com>\n" +
+			"References: <first@example.com>\n" +
+			"\n" +
+			"is it done?\n"),
+	})
+
+	store.CreateEmail(&Email{
+		From:      "contact@example.com",
+		To:        "ali@example.com",
+		MessageID: "third@example.com",
+		Direction: EmailInbound,
+		Content: []byte("From: contact@example.com\n" +
+			"Subject: =?utf-8?q?Question=0D=0ABcc=3A_someone=40example=2Ecom?=\n" +
+			"\n" +
+			"hello\n"),
+	})
+	if _, err := server.ReplyToEmail(context.Background(), &pb.ReplyToEmailRequest{MailId: 2, Text: "hi"}); err != nil {
+		t.Fatalf("cannot reply: %s", err)
+	}
+	injected, _ := ReadMailParts(sender.mail)
+	if injected.Header.Get("Bcc") != "" || injected.Header.Get("Subject") != "Re: Question Bcc: someone@example.com" {
+		t.Errorf("expected the decoded subject to stay a single field, but got %q", injected.Header)
+	}
+	sender.recipients = nil
+
+	_, err := server.ReplyToEmail(context.Background(), &pb.ReplyToEmailRequest{
+		MailId:   1,
+		Text:     "yes",
+		ReplyAll: true,
+		Quote:    true,
+	})
+	if err != nil {
+		t.Fatalf("cannot reply: %s", err)
+	}
+
+	if strings.Join(sender.recipients, " ") != "contact@example.com veli@example.org" {
+		t.Errorf("expected the sender and the other recipient to get the reply, but got %v", sender.recipients)
+	}
+
+	parts, err := ReadMailParts(sender.mail)
+	if err != nil {
+		t.Fatalf("cannot read the reply: %s", err)
+	}
+	if subject := parts.Header.Get("Subject"); subject != "Re: Question" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	if inReplyTo := parts.Header.Get("In-Reply-To"); inReplyTo != "<second@example.com>" {
+		t.Errorf("unexpected In-Reply-To %q", inReplyTo)
+	}
+	if references := parseMessageIDs(parts.Header.Get("References")); strings.Join(references, " ") != "first@example.com second@example.com" {
+		t.Errorf("unexpected References %v", references)
+	}
+	expected := "yes\r\n\r\nOn Thu, 1 Sep 2022 at 12:00, Contact <contact@example.com> wrote:\r\n> is it done?\r\n"
+	if parts.Text != expected {
+		t.Errorf("unexpected reply text %q", parts.Text)
+	}
+}
+
+func TestPurgedMailIsNotSent(t *testing.T) {
+	sender := &FakeMailSender{}
+	store := &FakeEmailStore{}
+	store.CreateEmail(&Email{From: "contact@example.org", To: "ali@example.com"})
+	deliveries := &FakeDeliveryStore{}
+	deliverer := &Deliverer{Sender: sender, Store: deliveries, EmailFinder: store}
+	server := &mailingServerServer{Deliverer: deliverer, EmailFinder: store}
+
+	_, err := server.ForwardMail(context.Background(), &pb.ForwardMailRequest{MailId: 1, Recipient: "veli@example.org"})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected purged mail not to be forwarded, but got %v", err)
+	}
+
+	now := time.Now()
+	deliveries.CreateDelivery(&Delivery{EmailID: 1, Recipient: "veli@example.org", Status: DeliveryDeferred, NextAttemptAt: &now})
+	deliverer.RetryDeferred(context.Background())
+	if deliveries.deliveries[0].Status != DeliveryFailed {
+		t.Errorf("expected the delivery of purged mail to fail, but got %+v", deliveries.deliveries[0])
+	}
+	if sender.sends != 0 {
+		t.Errorf("expected nothing to be sent, but got %d mails", sender.sends)
+	}
+}
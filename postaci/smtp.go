@@ -1,9 +1,26 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
 	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+const (
+	defaultDialTimeout    = 30 * time.Second
+	defaultCommandTimeout = time.Minute
+	defaultDataTimeout    = 5 * time.Minute
 )
 
 type SMPTService struct {
@@ -11,49 +28,406 @@ type SMPTService struct {
 	Port     uint16
 	Username string
 	Password string
+	// StartTLS upgrades the session before anything else is sent, and is
+	// required for Username and Password to be used. TLSConfig is verified
+	// against Host when it is nil.
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds establishing the TCP connection, CommandTimeout bounds
+	// every single SMTP command and DataTimeout bounds writing the mail body.
+	// The deadline of the context passed to Send always takes precedence.
+	DialTimeout    time.Duration
+	CommandTimeout time.Duration
+	DataTimeout    time.Duration
+
+	// LocalName is announced in EHLO, localhost is used when it is empty.
+	LocalName string
+	DSN       DSNOptions
+}
+
+// DSNOptions asks the relay for delivery status notifications (RFC 3461)
+// when it supports them. Notify is a comma separated list of NEVER, SUCCESS,
+// FAILURE and DELAY, and Return is either FULL or HDRS. Nothing is requested
+// when Notify is empty. The envelope id is taken from the context, see
+// WithEnvelopeID.
+type DSNOptions struct {
+	Notify string
+	Return string
+}
+
+type envelopeIDKey struct{}
+
+// WithEnvelopeID attaches an ENVID to mail sent with the returned context,
+// so that delivery status notifications can be traced back to it.
+func WithEnvelopeID(ctx context.Context, envelopeID string) context.Context {
+	return context.WithValue(ctx, envelopeIDKey{}, envelopeID)
+}
+
+func envelopeIDFromContext(ctx context.Context) string {
+	envelopeID, _ := ctx.Value(envelopeIDKey{}).(string)
+	return envelopeID
 }
 
 type MailSender interface {
 	Send(ctx context.Context, sender, recipientAddr string, mail []byte) error
 }
 
+type SendErrorKind int
+
+const (
+	ConnectionError SendErrorKind = iota
+	TimeoutError
+	CanceledError
+	RejectedError
+)
+
+func (k SendErrorKind) String() string {
+	switch k {
+	case TimeoutError:
+		return "timeout"
+	case CanceledError:
+		return "canceled"
+	case RejectedError:
+		return "rejected by the smtp server"
+	default:
+		return "connection problem"
+	}
+}
+
+type SMTPStage string
+
+const (
+	StageConnect  SMTPStage = "CONNECT"
+	StageGreeting SMTPStage = "GREETING"
+	StageHello    SMTPStage = "EHLO"
+	StageStartTLS SMTPStage = "STARTTLS"
+	StageAuth     SMTPStage = "AUTH"
+	StageMail     SMTPStage = "MAIL"
+	StageRcpt     SMTPStage = "RCPT"
+	StageData     SMTPStage = "DATA"
+	StageQuit     SMTPStage = "QUIT"
+)
+
+func (s SMTPStage) description() string {
+	switch s {
+	case StageConnect:
+		return "connecting to the smtp server"
+	case StageGreeting:
+		return "reading the smtp server greeting"
+	case StageHello:
+		return "issuing an EHLO command"
+	case StageData:
+		return "sending the mail body"
+	case StageQuit:
+		return "closing the connection"
+	default:
+		return fmt.Sprintf("issuing a %s command", string(s))
+	}
+}
+
+var enhancedStatusCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}`)
+
+// SendError tells whether sending failed because of a timeout, a connection
+// problem or a rejection by the smtp server, and at which stage it happened.
+// Rejections also carry the reply code and the RFC 3463 enhanced status code
+// when the server sent one.
+type SendError struct {
+	Kind         SendErrorKind
+	Stage        SMTPStage
+	Code         int
+	EnhancedCode string
+	Message      string
+	Err          error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("%s while %s: %s", e.Kind, e.Stage.description(), e.Err)
+}
+
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether retrying the same mail is pointless, which is
+// only the case for 5xx replies. Everything else may succeed later.
+func (e *SendError) Permanent() bool {
+	return e.Kind == RejectedError && e.Code >= 500
+}
+
+func (e *SendError) Temporary() bool {
+	return !e.Permanent()
+}
+
+// RelayFault reports whether the relay, rather than the mail, is the
+// problem: it could not be reached, did not let us in, or turned the mail
+// away for now. Another relay may take the mail.
+func (e *SendError) RelayFault() bool {
+	if e.Kind != RejectedError {
+		return e.Kind != CanceledError
+	}
+	switch e.Stage {
+	case StageGreeting, StageHello, StageStartTLS, StageAuth:
+		return true
+	}
+	return (e.Code >= 400 && e.Code < 500) || e.Code == 530
+}
+
 func (s *SMPTService) Send(ctx context.Context, sender, recipientAddr string, mail []byte) error {
-	addr := s.getAddr()
+	c, conn, closeSession, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeSession()
+
+	commandTimeout := orDefault(s.CommandTimeout, defaultCommandTimeout)
 
-	c, err := smtp.Dial(addr)
+	commands, err := s.envelopeCommands(ctx, c, sender, recipientAddr, mail)
 	if err != nil {
-		return fmt.Errorf("something happened while connecting to the smtp server: %s", err)
+		return err
 	}
-	defer c.Close()
 
-	err = c.Mail(sender)
+	setDeadline(ctx, conn, commandTimeout)
+	pipelining, _ := c.Extension("PIPELINING")
+	err = exchange(ctx, c.Text, commands, pipelining)
 	if err != nil {
-		return fmt.Errorf("something happened while issuing a MAIL command: %s", err)
+		return err
 	}
 
-	err = c.Rcpt(recipientAddr)
+	setDeadline(ctx, conn, orDefault(s.DataTimeout, defaultDataTimeout))
+	writer := c.Text.DotWriter()
+	_, err = writer.Write(mail)
 	if err != nil {
-		return fmt.Errorf("something happened while issuing a RCPT command: %s", err)
+		return newSendError(ctx, StageData, err)
 	}
 
-	writer, err := c.Data()
+	err = writer.Close()
 	if err != nil {
-		return fmt.Errorf("something happened while issuing DATA command: %s", err)
+		return newSendError(ctx, StageData, err)
 	}
 
-	_, err = writer.Write(mail)
+	_, _, err = c.Text.ReadResponse(250)
 	if err != nil {
-		return fmt.Errorf("something happened while writing the mail body: %s", err)
+		return newSendError(ctx, StageData, err)
 	}
 
-	err = c.Close()
+	setDeadline(ctx, conn, commandTimeout)
+	err = c.Quit()
 	if err != nil {
-		return fmt.Errorf("something happened while closing the connection: %s", err)
+		return newSendError(ctx, StageQuit, err)
 	}
 
 	return nil
 }
 
+// Check opens a session and says goodbye right after the EHLO exchange, to
+// tell whether the server is reachable and willing to talk.
+func (s *SMPTService) Check(ctx context.Context) error {
+	c, conn, closeSession, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer closeSession()
+
+	setDeadline(ctx, conn, orDefault(s.CommandTimeout, defaultCommandTimeout))
+	err = c.Quit()
+	if err != nil {
+		return newSendError(ctx, StageQuit, err)
+	}
+	return nil
+}
+
+// connect dials the server and completes the greeting and EHLO exchange.
+// The returned function releases the session.
+func (s *SMPTService) connect(ctx context.Context) (*smtp.Client, net.Conn, func(), error) {
+	addr := s.getAddr()
+
+	dialer := net.Dialer{Timeout: orDefault(s.DialTimeout, defaultDialTimeout)}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, nil, nil, newSendError(ctx, StageConnect, err)
+	}
+
+	// Closing the connection is the only way to interrupt a blocked read or
+	// write, so a canceled context tears down the whole session.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	release := func() {
+		close(done)
+		conn.Close()
+	}
+
+	commandTimeout := orDefault(s.CommandTimeout, defaultCommandTimeout)
+
+	setDeadline(ctx, conn, commandTimeout)
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		release()
+		return nil, nil, nil, newSendError(ctx, StageGreeting, err)
+	}
+
+	setDeadline(ctx, conn, commandTimeout)
+	err = c.Hello(s.localName())
+	if err != nil {
+		release()
+		return nil, nil, nil, newSendError(ctx, StageHello, err)
+	}
+
+	if s.StartTLS || s.Username != "" {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			release()
+			return nil, nil, nil, &SendError{Kind: ConnectionError, Stage: StageStartTLS, Err: errors.New("the server does not offer STARTTLS")}
+		}
+		setDeadline(ctx, conn, commandTimeout)
+		if err = c.StartTLS(s.tlsConfig()); err != nil {
+			release()
+			return nil, nil, nil, newSendError(ctx, StageStartTLS, err)
+		}
+	}
+
+	if s.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			release()
+			return nil, nil, nil, &SendError{Kind: ConnectionError, Stage: StageAuth, Err: errors.New("the server does not offer AUTH")}
+		}
+		setDeadline(ctx, conn, commandTimeout)
+		if err = c.Auth(s.getAuth()); err != nil {
+			release()
+			return nil, nil, nil, newSendError(ctx, StageAuth, err)
+		}
+	}
+
+	return c, conn, release, nil
+}
+
+func (s *SMPTService) tlsConfig() *tls.Config {
+	if s.TLSConfig != nil {
+		return s.TLSConfig
+	}
+	return &tls.Config{ServerName: s.Host}
+}
+
+type smtpCommand struct {
+	stage  SMTPStage
+	line   string
+	expect int
+}
+
+// envelopeCommands builds MAIL, RCPT and DATA with the parameters of every
+// extension the server announced in its EHLO reply. Mail that the server
+// is known to refuse is rejected here, before anything is transferred.
+func (s *SMPTService) envelopeCommands(ctx context.Context, c *smtp.Client, sender, recipientAddr string, mail []byte) ([]smtpCommand, error) {
+	sender, senderIsUTF8, err := toSMTPAddress(sender)
+	if err != nil {
+		return nil, localRejection(StageMail, 553, "5.1.7", fmt.Sprintf("invalid sender address: %s", err))
+	}
+	recipientAddr, recipientIsUTF8, err := toSMTPAddress(recipientAddr)
+	if err != nil {
+		return nil, localRejection(StageRcpt, 553, "5.1.3", fmt.Sprintf("invalid recipient address: %s", err))
+	}
+
+	mailParams := ""
+	rcptParams := ""
+
+	if ok, maxSize := c.Extension("SIZE"); ok {
+		if limit, err := strconv.Atoi(maxSize); err == nil && limit > 0 && len(mail) > limit {
+			return nil, localRejection(StageMail, 552, "5.3.4", fmt.Sprintf("message size %d exceeds the maximum of %d accepted by the smtp server", len(mail), limit))
+		}
+		mailParams += fmt.Sprintf(" SIZE=%d", len(mail))
+	}
+
+	// 8-bit mail is not converted to 7-bit, it is only sent to servers that
+	// take it as it is. A server that supports SMTPUTF8 supports 8BITMIME.
+	eightBitMIME, _ := c.Extension("8BITMIME")
+	smtpUTF8, _ := c.Extension("SMTPUTF8")
+	if has8Bit(mail) {
+		if eightBitMIME {
+			mailParams += " BODY=8BITMIME"
+		} else if !smtpUTF8 {
+			return nil, localRejection(StageMail, 554, "5.6.3", "the smtp server does not support 8-bit mail")
+		}
+	}
+
+	if senderIsUTF8 || recipientIsUTF8 || has8Bit(headerSection(mail)) {
+		if smtpUTF8 {
+			mailParams += " SMTPUTF8"
+		} else if senderIsUTF8 || recipientIsUTF8 {
+			return nil, localRejection(StageMail, 553, "5.6.7", "the smtp server does not support internationalized addresses")
+		} else {
+			return nil, localRejection(StageMail, 554, "5.6.9", "the smtp server does not support internationalized headers")
+		}
+	}
+
+	if ok, _ := c.Extension("DSN"); ok && s.DSN.Notify != "" {
+		if s.DSN.Return != "" {
+			mailParams += " RET=" + s.DSN.Return
+		}
+		if envelopeID := envelopeIDFromContext(ctx); envelopeID != "" {
+			mailParams += " ENVID=" + xtext(envelopeID)
+		}
+		rcptParams += " NOTIFY=" + s.DSN.Notify
+		if !recipientIsUTF8 {
+			rcptParams += " ORCPT=rfc822;" + xtext(recipientAddr)
+		}
+	}
+
+	return []smtpCommand{
+		{stage: StageMail, line: fmt.Sprintf("MAIL FROM:<%s>%s", sender, mailParams), expect: 250},
+		{stage: StageRcpt, line: fmt.Sprintf("RCPT TO:<%s>%s", recipientAddr, rcptParams), expect: 25},
+		{stage: StageData, line: "DATA", expect: 354},
+	}, nil
+}
+
+// exchange issues the commands and reads their replies. With PIPELINING the
+// whole batch is written before the first reply is read, as RFC 2920 allows
+// for MAIL, RCPT and a trailing DATA. The first failing reply is reported,
+// but every reply is still consumed to keep the session in sync.
+func exchange(ctx context.Context, text *textproto.Conn, commands []smtpCommand, pipelining bool) error {
+	ids := make([]uint, len(commands))
+	var firstErr error
+
+	for i, command := range commands {
+		id, err := text.Cmd("%s", command.line)
+		if err != nil {
+			return newSendError(ctx, command.stage, err)
+		}
+		ids[i] = id
+
+		if pipelining {
+			continue
+		}
+
+		if err = readReply(text, id, command.expect); err != nil {
+			return newSendError(ctx, command.stage, err)
+		}
+	}
+
+	if !pipelining {
+		return nil
+	}
+
+	for i, command := range commands {
+		err := readReply(text, ids[i], command.expect)
+		if err != nil && firstErr == nil {
+			firstErr = newSendError(ctx, command.stage, err)
+		}
+	}
+	return firstErr
+}
+
+func readReply(text *textproto.Conn, id uint, expect int) error {
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err := text.ReadResponse(expect)
+	return err
+}
+
 func (s *SMPTService) getAuth() smtp.Auth {
 	return smtp.PlainAuth("", s.Username, s.Password, s.Host)
 }
@@ -61,3 +435,121 @@ func (s *SMPTService) getAuth() smtp.Auth {
 func (s *SMPTService) getAddr() string {
 	return fmt.Sprintf("%s:%v", s.Host, s.Port)
 }
+
+func (s *SMPTService) localName() string {
+	if s.LocalName == "" {
+		return "localhost"
+	}
+	return s.LocalName
+}
+
+// setDeadline allows the next operation on conn to take at most timeout, or
+// less if the context expires earlier.
+func setDeadline(ctx context.Context, conn net.Conn, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+}
+
+func newSendError(ctx context.Context, stage SMTPStage, err error) *SendError {
+	var protocolErr *textproto.Error
+	var netErr net.Error
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &SendError{Kind: TimeoutError, Stage: stage, Err: ctx.Err()}
+	case errors.Is(ctx.Err(), context.Canceled):
+		return &SendError{Kind: CanceledError, Stage: stage, Err: ctx.Err()}
+	case errors.As(err, &protocolErr):
+		return &SendError{
+			Kind:         RejectedError,
+			Stage:        stage,
+			Code:         protocolErr.Code,
+			EnhancedCode: enhancedStatusCodePattern.FindString(protocolErr.Msg),
+			Message:      protocolErr.Msg,
+			Err:          err,
+		}
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return &SendError{Kind: TimeoutError, Stage: stage, Err: err}
+	default:
+		return &SendError{Kind: ConnectionError, Stage: stage, Err: err}
+	}
+}
+
+// localRejection reports mail that is refused before it reaches the server,
+// in the same shape as a rejection coming from the server itself.
+func localRejection(stage SMTPStage, code int, enhancedCode, message string) *SendError {
+	return &SendError{
+		Kind:         RejectedError,
+		Stage:        stage,
+		Code:         code,
+		EnhancedCode: enhancedCode,
+		Message:      message,
+		Err:          fmt.Errorf("%d %s %s", code, enhancedCode, message),
+	}
+}
+
+// toSMTPAddress converts the domain of addr to its ASCII form and tells
+// whether the local part still needs SMTPUTF8 to be transferred.
+func toSMTPAddress(addr string) (string, bool, error) {
+	if strings.ContainsAny(addr, "\r\n<>") {
+		return "", false, errors.New("address contains forbidden characters")
+	}
+
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr, !isASCII([]byte(addr)), nil
+	}
+
+	local, domain := addr[:at], addr[at+1:]
+	domain, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", false, err
+	}
+	return local + "@" + domain, !isASCII([]byte(local)), nil
+}
+
+func isASCII(b []byte) bool {
+	return !has8Bit(b)
+}
+
+func has8Bit(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return true
+		}
+	}
+	return false
+}
+
+func headerSection(mail []byte) []byte {
+	if i := bytes.Index(mail, []byte("\r\n\r\n")); i >= 0 {
+		return mail[:i]
+	}
+	if i := bytes.Index(mail, []byte("\n\n")); i >= 0 {
+		return mail[:i]
+	}
+	return mail
+}
+
+// xtext encodes ENVID and ORCPT values as described in RFC 3461 section 4.
+func xtext(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func orDefault(d, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTPServer answers a single smtp session. Extensions are announced in
+// the EHLO reply, replies maps a command verb to the reply it should get
+// instead of the default 250, and a verb listed in stall is never answered.
+type fakeSMTPServer struct {
+	listener   net.Listener
+	extensions []string
+	replies    map[string]string
+	stall      map[string]bool
+	commands   chan string
+	body       chan string
+	// tlsConfig answers STARTTLS when it is set.
+	tlsConfig *tls.Config
+}
+
+func newFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("cannot listen: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	return &fakeSMTPServer{
+		listener: listener,
+		replies:  map[string]string{},
+		stall:    map[string]bool{},
+		commands: make(chan string, 100),
+		body:     make(chan string, 1),
+	}
+}
+
+func (f *fakeSMTPServer) sender() *SMPTService {
+	addr := f.listener.Addr().(*net.TCPAddr)
+	return &SMPTService{Host: "127.0.0.1", Port: uint16(addr.Port)}
+}
+
+func (f *fakeSMTPServer) serve() {
+	conn, err := f.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 fake.example.com ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		f.commands <- line
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if f.stall[verb] {
+			r.ReadString('\n')
+			return
+		}
+		if custom, ok := f.replies[verb]; ok {
+			reply(custom)
+			continue
+		}
+
+		switch verb {
+		case "STARTTLS":
+			reply("220 ready to start tls")
+			conn = tls.Server(conn, f.tlsConfig)
+			r = bufio.NewReader(conn)
+		case "EHLO":
+			lines := append([]string{"fake.example.com"}, f.extensions...)
+			for i, line := range lines {
+				if i == len(lines)-1 {
+					reply("250 " + line)
+				} else {
+					reply("250-" + line)
+				}
+			}
+		case "DATA":
+			reply("354 go ahead")
+			var body strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				body.WriteString(line)
+			}
+			f.body <- body.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+// selfSignedTLS makes a certificate for 127.0.0.1, and the client config
+// that trusts it.
+func selfSignedTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate a key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake.example.com"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create a certificate: %s", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(certificate)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+}
+
+func TestSendDeliversMail(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	go server.serve()
+
+	err := server.sender().Send(context.Background(), "contact@example.com", "ali@example.com", []byte("Subject: hi\r\n\r\nhello\r\n"))
+	if err != nil {
+		t.Fatalf("expected mail to be sent, but got %s", err)
+	}
+
+	if body := <-server.body; body != "Subject: hi\r\n\r\nhello\r\n" {
+		t.Errorf("unexpected mail body %q", body)
+	}
+}
+
+func TestSendHonorsContextDeadline(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.stall["RCPT"] = true
+	go server.serve()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := server.sender().Send(ctx, "contact@example.com", "ali@example.com", []byte("hello"))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected send to give up after the deadline, but it took %v", elapsed)
+	}
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Kind != TimeoutError {
+		t.Fatalf("expected a timeout error, but got %v", err)
+	}
+}
+
+func TestSendReportsRejection(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.replies["RCPT"] = "550 no such user"
+	go server.serve()
+
+	err := server.sender().Send(context.Background(), "contact@example.com", "nobody@example.com", []byte("hello"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Kind != RejectedError {
+		t.Fatalf("expected a rejection error, but got %v", err)
+	}
+}
+
+func TestSendErrorCarriesReplyCodes(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.replies["RCPT"] = "450 4.2.1 mailbox busy"
+	go server.serve()
+
+	err := server.sender().Send(context.Background(), "contact@example.com", "ali@example.com", []byte("hello"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		t.Fatalf("expected a send error, but got %v", err)
+	}
+	if sendErr.Stage != StageRcpt || sendErr.Code != 450 || sendErr.EnhancedCode != "4.2.1" {
+		t.Errorf("unexpected stage %s, code %d and enhanced code %s", sendErr.Stage, sendErr.Code, sendErr.EnhancedCode)
+	}
+	if sendErr.Permanent() {
+		t.Errorf("expected a 4xx reply to be temporary")
+	}
+}
+
+func TestSendUsesAnnouncedExtensions(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.extensions = []string{"SIZE 1000", "8BITMIME", "SMTPUTF8", "PIPELINING", "DSN"}
+	go server.serve()
+
+	sender := server.sender()
+	sender.DSN = DSNOptions{Notify: "FAILURE,DELAY", Return: "HDRS"}
+	ctx := WithEnvelopeID(context.Background(), "delivery-42")
+
+	err := sender.Send(ctx, "contact@example.com", "müller@bücher.example", []byte("Subject: grüße\r\n\r\nhallo\r\n"))
+	if err != nil {
+		t.Fatalf("expected mail to be sent, but got %s", err)
+	}
+	<-server.body
+
+	<-server.commands // EHLO
+	mail := <-server.commands
+	rcpt := <-server.commands
+
+	for _, param := range []string{"SIZE=", "BODY=8BITMIME", "SMTPUTF8", "RET=HDRS", "ENVID=delivery-42"} {
+		if !strings.Contains(mail, param) {
+			t.Errorf("expected %q to contain %s", mail, param)
+		}
+	}
+	if rcpt != "RCPT TO:<müller@xn--bcher-kva.example> NOTIFY=FAILURE,DELAY" {
+		t.Errorf("unexpected RCPT command %q", rcpt)
+	}
+}
+
+func TestSendRejectsOversizeMailEarly(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.extensions = []string{"SIZE 10"}
+	go server.serve()
+
+	err := server.sender().Send(context.Background(), "contact@example.com", "ali@example.com", []byte("this mail is too large"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Code != 552 || !sendErr.Permanent() {
+		t.Fatalf("expected a permanent size rejection, but got %v", err)
+	}
+
+	<-server.commands // EHLO
+	select {
+	case command := <-server.commands:
+		t.Errorf("expected no command after EHLO, but got %q", command)
+	default:
+	}
+}
+
+func TestSendRequiresSMTPUTF8ForInternationalMailboxes(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	go server.serve()
+
+	err := server.sender().Send(context.Background(), "contact@example.com", "müller@example.com", []byte("hello"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.EnhancedCode != "5.6.7" {
+		t.Fatalf("expected an SMTPUTF8 rejection, but got %v", err)
+	}
+}
+
+func TestSendRejects8BitMailTheServerCannotTake(t *testing.T) {
+	tests := []struct {
+		mail         string
+		extensions   []string
+		enhancedCode string
+	}{
+		{"Subject: hi\r\n\r\ngrüße\r\n", nil, "5.6.3"},
+		{"Subject: grüße\r\n\r\nhallo\r\n", nil, "5.6.3"},
+		{"Subject: grüße\r\n\r\nhallo\r\n", []string{"8BITMIME"}, "5.6.9"},
+	}
+	for _, test := range tests {
+		server := newFakeSMTPServer(t)
+		server.extensions = test.extensions
+		go server.serve()
+
+		err := server.sender().Send(context.Background(), "contact@example.com", "ali@example.com", []byte(test.mail))
+
+		var sendErr *SendError
+		if !errors.As(err, &sendErr) || sendErr.EnhancedCode != test.enhancedCode || !sendErr.Permanent() {
+			t.Errorf("expected %q to be refused with %s before it is sent to %v, but got %v", test.mail, test.enhancedCode, test.extensions, err)
+		}
+	}
+}
+
+func TestSendAuthenticatesOverStartTLS(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.extensions = []string{"STARTTLS", "AUTH PLAIN"}
+	server.replies["AUTH"] = "235 2.7.0 authenticated"
+	serverTLS, clientTLS := selfSignedTLS(t)
+	server.tlsConfig = serverTLS
+	go server.serve()
+
+	sender := server.sender()
+	sender.Username, sender.Password, sender.TLSConfig = "relay", "secret", clientTLS
+	if err := sender.Send(context.Background(), "contact@example.com", "ali@example.com", []byte("hello\r\n")); err != nil {
+		t.Fatalf("expected mail to be sent, but got %s", err)
+	}
+
+	var verbs []string
+	for len(server.commands) > 0 {
+		verbs = append(verbs, strings.SplitN(<-server.commands, " ", 2)[0])
+	}
+	if strings.Join(verbs[:4], " ") != "EHLO STARTTLS EHLO AUTH" {
+		t.Errorf("expected to authenticate after STARTTLS, but got %v", verbs)
+	}
+}
+
+func TestSendDoesNotSendCredentialsInCleartext(t *testing.T) {
+	server := newFakeSMTPServer(t)
+	server.extensions = []string{"AUTH PLAIN"}
+	go server.serve()
+
+	sender := server.sender()
+	sender.Username, sender.Password = "relay", "secret"
+	err := sender.Send(context.Background(), "contact@example.com", "ali@example.com", []byte("hello\r\n"))
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) || sendErr.Stage != StageStartTLS || !sendErr.RelayFault() {
+		t.Fatalf("expected the relay to be refused without STARTTLS, but got %v", err)
+	}
+	for len(server.commands) > 0 {
+		if command := <-server.commands; strings.HasPrefix(command, "AUTH") {
+			t.Errorf("expected credentials not to be sent, but got %q", command)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+)
+
+// sendErrorCode picks the gRPC code a client should act on: invalid input
+// for recipients the relay refuses, unavailable for anything worth retrying.
+func sendErrorCode(err *SendError) codes.Code {
+	switch err.Kind {
+	case TimeoutError:
+		return codes.DeadlineExceeded
+	case CanceledError:
+		return codes.Canceled
+	case ConnectionError:
+		return codes.Unavailable
+	}
+
+	if !err.Permanent() {
+		return codes.Unavailable
+	}
+	if err.Stage == StageRcpt {
+		return codes.InvalidArgument
+	}
+	return codes.FailedPrecondition
+}
+
+func sendErrorStatus(err error) error {
+	var suppressedErr *SuppressedError
+	if errors.As(err, &suppressedErr) {
+		return status.Error(codes.FailedPrecondition, suppressedErr.Error())
+	}
+
+	var sendErr *SendError
+	if !errors.As(err, &sendErr) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	st, detailErr := status.New(sendErrorCode(sendErr), sendErr.Error()).WithDetails(&pb.SmtpFailure{
+		Kind:         sendErr.Kind.String(),
+		Stage:        string(sendErr.Stage),
+		Code:         uint32(sendErr.Code),
+		EnhancedCode: sendErr.EnhancedCode,
+		Permanent:    sendErr.Permanent(),
+		Message:      sendErr.Message,
+	})
+	if detailErr != nil {
+		logrus.Errorf("something happened while attaching smtp failure details: %s", detailErr)
+		return status.Error(sendErrorCode(sendErr), sendErr.Error())
+	}
+	return st.Err()
+}
+
+func findEmailStatus(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return status.Error(codes.NotFound, "mail does not exist")
+	}
+	return status.Error(codes.Internal, err.Error())
+}
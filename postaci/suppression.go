@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+const (
+	SuppressionSourceSMTP      = "smtp"
+	SuppressionSourceBounce    = "bounce"
+	SuppressionSourceComplaint = "complaint"
+	SuppressionSourceManual    = "manual"
+)
+
+// Suppression keeps mail from being sent to an address until it expires. A
+// nil ExpiresAt never expires.
+type Suppression struct {
+	gorm.Model
+	Address   string `gorm:"uniqueIndex;size:320"`
+	Reason    string
+	Source    string
+	ExpiresAt *time.Time
+}
+
+type SuppressionList interface {
+	FindSuppression(address string) (*Suppression, error)
+	Suppress(address, reason, source string, expiresAt *time.Time) error
+	Unsuppress(address string) error
+	ListSuppressions(address string, limit, offset int) ([]Suppression, error)
+}
+
+// SuppressedError is returned instead of sending to a suppressed address.
+type SuppressedError struct {
+	Suppression *Suppression
+}
+
+func (e *SuppressedError) Error() string {
+	return fmt.Sprintf("recipient %s is suppressed: %s", e.Suppression.Address, e.Suppression.Reason)
+}
+
+func (p *Persistence) FindSuppression(address string) (*Suppression, error) {
+	var suppression Suppression
+	result := db.Where("address = ? AND (expires_at IS NULL OR expires_at > ?)", normalizeAddress(address), time.Now()).First(&suppression)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return &suppression, result.Error
+}
+
+func (p *Persistence) Suppress(address, reason, source string, expiresAt *time.Time) error {
+	return suppressAddress(db, address, reason, source, expiresAt)
+}
+
+func (p *Persistence) Unsuppress(address string) error {
+	// Suppressions are deleted for good, a soft deleted row would still hold
+	// the unique address.
+	return db.Unscoped().Where("address = ?", normalizeAddress(address)).Delete(&Suppression{}).Error
+}
+
+func (p *Persistence) ListSuppressions(address string, limit, offset int) ([]Suppression, error) {
+	query := db.Where("(expires_at IS NULL OR expires_at > ?)", time.Now())
+	if address != "" {
+		query = query.Where("address LIKE ? ESCAPE '!'", containing(normalizeAddress(address)))
+	}
+
+	var suppressions []Suppression
+	result := query.Order("id desc").Limit(limit).Offset(offset).Find(&suppressions)
+	return suppressions, result.Error
+}
+
+// suppressAddress adds the address to the suppression list, or renews the
+// entry when it is already there.
+func suppressAddress(tx *gorm.DB, address, reason, source string, expiresAt *time.Time) error {
+	var suppression Suppression
+	result := tx.Where(Suppression{Address: normalizeAddress(address)}).
+		Assign(map[string]interface{}{"reason": reason, "source": source, "expires_at": expiresAt}).
+		FirstOrCreate(&suppression)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"address": suppression.Address,
+		"source":  source,
+		"reason":  reason,
+	}).Info("address is suppressed")
+	return nil
+}
+
+// isHardBounce tells whether a permanent failure is about the mailbox itself.
+// Policy rejections (5.7.x) usually concern the mail rather than the address,
+// so they do not get the address suppressed.
+func isHardBounce(enhancedCode string) bool {
+	return strings.HasPrefix(enhancedCode, "5.") && !strings.HasPrefix(enhancedCode, "5.7.")
+}
+
+func normalizeAddress(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// containing is a LIKE pattern, escaped with '!', that matches the values
+// that contain the given one, so that its '%' and '_' are not wildcards.
+func containing(value string) string {
+	return "%" + strings.NewReplacer("!", "!!", "%", "!%", "_", "!_").Replace(value) + "%"
+}
+
+// FeedbackReport is a RFC 5965 abuse report sent through a feedback loop.
+type FeedbackReport struct {
+	FeedbackType      string
+	OriginalRecipient string
+	OriginalMessageID string
+	// ReturnPath is the envelope sender of the original message, the VERP
+	// address of the delivery when VERP is used.
+	ReturnPath string
+}
+
+// ParseFeedbackReport reads an ARF report. It returns nil without an error
+// when the content is some other kind of mail.
+func ParseFeedbackReport(content []byte) (*FeedbackReport, error) {
+	report := &FeedbackReport{}
+	isReport, err := walkReport(content, "feedback-report", func(partType string, body *bufio.Reader) error {
+		switch partType {
+		case "message/feedback-report":
+			fields, err := textproto.NewReader(body).ReadMIMEHeader()
+			if len(fields) == 0 && err != nil {
+				return fmt.Errorf("cannot read the feedback report fields: %s", err)
+			}
+			report.FeedbackType = strings.ToLower(fields.Get("Feedback-Type"))
+			report.OriginalRecipient = typedValue(fields.Get("Original-Rcpt-To"))
+		case "message/rfc822", "text/rfc822-headers":
+			header, _ := textproto.NewReader(body).ReadMIMEHeader()
+			report.OriginalMessageID = trimMessageID(header.Get("Message-Id"))
+			report.ReturnPath = strings.Trim(strings.TrimSpace(header.Get("Return-Path")), "<>")
+			if report.OriginalRecipient == "" {
+				report.OriginalRecipient = header.Get("To")
+			}
+		}
+		return nil
+	})
+	if err != nil || !isReport {
+		return nil, err
+	}
+	return report, nil
+}
+
+// HandleComplaint suppresses the recipient of the delivery that was
+// complained about and emits a complaint event. Reports that cannot be
+// traced back to one of our deliveries are not acted on. It reports whether
+// the delivery was found.
+func HandleComplaint(producer MessageProducer, tokens *DeliveryTokens, report *FeedbackReport) (bool, error) {
+	delivery, err := FindComplainedDelivery(tokens, report)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	address := normalizeAddress(delivery.Recipient)
+	if err = suppressAddress(db, address, fmt.Sprintf("%s complaint", report.FeedbackType), SuppressionSourceComplaint, nil); err != nil {
+		return true, err
+	}
+	return true, producer.Produce(context.Background(), "complaint", fmt.Sprintf("%s|%s", address, report.FeedbackType))
+}
+
+// FindComplainedDelivery looks for the delivery a complaint is about, by the
+// signed token of its VERP return path or by its Message-Id. When the report
+// names the recipient, the delivery must be to that recipient, and without
+// one the Message-Id must belong to a single delivery.
+func FindComplainedDelivery(tokens *DeliveryTokens, report *FeedbackReport) (*Delivery, error) {
+	recipient := report.OriginalRecipient
+	if parsed, err := mail.ParseAddress(recipient); err == nil {
+		recipient = parsed.Address
+	}
+	concerns := func(delivery *Delivery) bool {
+		return recipient == "" || strings.EqualFold(delivery.Recipient, recipient)
+	}
+
+	if id, ok := tokens.VERPDeliveryID(report.ReturnPath); ok {
+		var delivery Delivery
+		if err := db.First(&delivery, id).Error; err == nil && concerns(&delivery) {
+			return &delivery, nil
+		}
+	}
+
+	if report.OriginalMessageID == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	var deliveries []Delivery
+	err := db.Joins("JOIN emails ON emails.id = deliveries.email_id").
+		Where("emails.message_id = ?", report.OriginalMessageID).
+		Order("deliveries.id desc").
+		Find(&deliveries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Delivery
+	for i := range deliveries {
+		if !concerns(&deliveries[i]) {
+			continue
+		}
+		if found != nil && !strings.EqualFold(found.Recipient, deliveries[i].Recipient) {
+			return nil, gorm.ErrRecordNotFound
+		}
+		if found == nil {
+			found = &deliveries[i]
+		}
+	}
+	if found == nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return found, nil
+}
+
+func (m *mailingServerServer) ListSuppressions(ctx context.Context, request *pb.ListSuppressionsRequest) (*pb.ListSuppressionsResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	suppressions, err := m.Suppressions.ListSuppressions(request.Address, limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while listing suppressions: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListSuppressionsResponse{}
+	for i := range suppressions {
+		response.Suppressions = append(response.Suppressions, suppressionToProto(&suppressions[i]))
+	}
+	return response, nil
+}
+
+func (m *mailingServerServer) AddSuppression(ctx context.Context, request *pb.AddSuppressionRequest) (*pb.Suppression, error) {
+	parsed, err := mail.ParseAddress(request.Address)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid address: %s", err)
+	}
+	address := normalizeAddress(parsed.Address)
+
+	var expiresAt *time.Time
+	if request.ExpiresAt != nil {
+		t := request.ExpiresAt.AsTime()
+		if !t.After(time.Now()) {
+			return nil, status.Error(codes.InvalidArgument, "expires_at must be in the future")
+		}
+		expiresAt = &t
+	}
+
+	if err = m.Suppressions.Suppress(address, request.Reason, SuppressionSourceManual, expiresAt); err != nil {
+		logrus.Errorf("something happened while adding a suppression: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	suppression, err := m.Suppressions.FindSuppression(address)
+	if err != nil || suppression == nil {
+		return nil, status.Error(codes.Internal, "cannot read the suppression back")
+	}
+	return suppressionToProto(suppression), nil
+}
+
+func (m *mailingServerServer) RemoveSuppression(ctx context.Context, request *pb.RemoveSuppressionRequest) (*pb.RemoveSuppressionResponse, error) {
+	if err := m.Suppressions.Unsuppress(request.Address); err != nil {
+		logrus.Errorf("something happened while removing a suppression: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.RemoveSuppressionResponse{}, nil
+}
+
+func suppressionToProto(suppression *Suppression) *pb.Suppression {
+	message := &pb.Suppression{
+		Address:   suppression.Address,
+		Reason:    suppression.Reason,
+		Source:    suppression.Source,
+		CreatedAt: timestamppb.New(suppression.CreatedAt),
+	}
+	if suppression.ExpiresAt != nil {
+		message.ExpiresAt = timestamppb.New(*suppression.ExpiresAt)
+	}
+	return message
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestHandleComplaintSuppressesTheDeliveryRecipient(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	email := &Email{From: "contact@example.com", MessageID: "complained@example.com", Direction: EmailOutbound}
+	if err := persistence.CreateEmail(email); err != nil {
+		t.Fatalf("cannot create the mail: %s", err)
+	}
+	delivery := &Delivery{EmailID: email.ID, Sender: "contact@example.com", Recipient: "Reader@Example.org", Status: DeliverySent}
+	if err := persistence.CreateDelivery(delivery); err != nil {
+		t.Fatalf("cannot create delivery: %s", err)
+	}
+	tokens := &DeliveryTokens{Secret: []byte("secret"), ReturnPath: "bounces@example.com"}
+
+	forged := []*FeedbackReport{
+		{FeedbackType: "abuse", OriginalRecipient: "victim@example.org"},
+		{FeedbackType: "abuse", OriginalRecipient: "victim@example.org", OriginalMessageID: "complained@example.com"},
+		{FeedbackType: "abuse", OriginalMessageID: "unknown@example.com"},
+		{FeedbackType: "abuse", ReturnPath: fmt.Sprintf("bounces+%d@example.com", delivery.ID)},
+	}
+	for _, report := range forged {
+		if matched, err := HandleComplaint(&FakeMessageProducer{}, tokens, report); err != nil || matched {
+			t.Errorf("expected %+v not to match, but got %v and %v", report, matched, err)
+		}
+	}
+	if suppression, _ := persistence.FindSuppression("victim@example.org"); suppression != nil {
+		t.Errorf("expected an address that was not mailed not to be suppressed")
+	}
+
+	reports := []*FeedbackReport{
+		{FeedbackType: "abuse", OriginalMessageID: "complained@example.com"},
+		{FeedbackType: "abuse", ReturnPath: verpAddress(tokens.ReturnPath, tokens.Token(delivery.ID))},
+	}
+	for _, report := range reports {
+		persistence.Unsuppress("reader@example.org")
+		producer := &FakeMessageProducer{}
+		if matched, err := HandleComplaint(producer, tokens, report); err != nil || !matched {
+			t.Fatalf("expected %+v to match the delivery, but got %v and %v", report, matched, err)
+		}
+		if suppression, _ := persistence.FindSuppression("reader@example.org"); suppression == nil {
+			t.Errorf("expected the recipient of the delivery to be suppressed")
+		}
+		if !producer.IsCalledWith("complaint", "reader@example.org|abuse") {
+			t.Errorf("complaint event is not emitted with correct arguments")
+		}
+	}
+	persistence.Unsuppress("reader@example.org")
+}
+
+func TestAddSuppressionStoresTheNormalizedAddress(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	server := &mailingServerServer{Suppressions: persistence}
+
+	suppression, err := server.AddSuppression(context.Background(), &pb.AddSuppressionRequest{Address: "Someone <Someone@Example.org>", Reason: "asked"})
+	if err != nil {
+		t.Fatalf("cannot add the suppression: %s", err)
+	}
+	if suppression.Address != "someone@example.org" {
+		t.Errorf("expected the address to be stored normalized, but got %q", suppression.Address)
+	}
+	persistence.Unsuppress("someone@example.org")
+
+	_, err = server.AddSuppression(context.Background(), &pb.AddSuppressionRequest{Address: "someone@example.org", ExpiresAt: timestamppb.New(time.Now().Add(-time.Hour))})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a suppression that expired already to be refused, but got %v", err)
+	}
+}
+
+func TestListSuppressionsMatchesWildcardsLiterally(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	for _, address := range []string{"first_last@wildcard.test", "firstxlast@wildcard.test", "100%@wildcard.test"} {
+		persistence.Suppress(address, "asked", SuppressionSourceManual, nil)
+		defer persistence.Unsuppress(address)
+	}
+
+	for search, expected := range map[string]string{"first_last": "first_last@wildcard.test", "0%@": "100%@wildcard.test"} {
+		suppressions, err := persistence.ListSuppressions(search, 10, 0)
+		if err != nil {
+			t.Fatalf("cannot list the suppressions: %s", err)
+		}
+		if len(suppressions) != 1 || suppressions[0].Address != expected {
+			t.Errorf("expected %s to find %s only, but got %+v", search, expected, suppressions)
+		}
+	}
+}
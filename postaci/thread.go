@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// subjectThreadWindow is how long a thread can be joined by subject alone.
+const subjectThreadWindow = 30 * 24 * time.Hour
+
+var replyPrefix = regexp.MustCompile(`(?i)^\s*(re|fwd?|aw|sv)(\[\d+\])?\s*:\s*`)
+
+// Thread is a conversation. Mail is put in a thread by its In-Reply-To and
+// References fields, the way JWZ threading links messages, and by subject
+// when a reply carries no references.
+type Thread struct {
+	gorm.Model
+	Subject           string
+	NormalizedSubject string `gorm:"size:255;index"`
+	MessageCount      int
+	LastMessageAt     time.Time `gorm:"index"`
+}
+
+// EmailReference links a mail to a message id in its In-Reply-To or
+// References, so that the replies to a message are found by an index.
+type EmailReference struct {
+	ID        uint   `gorm:"primarykey"`
+	EmailID   uint   `gorm:"index"`
+	MessageID string `gorm:"size:255;index"`
+}
+
+type ThreadStore interface {
+	FindThreads(limit, offset int) ([]Thread, error)
+	FindThread(threadId uint64) (*Thread, []Email, error)
+}
+
+func (p *Persistence) FindThreads(limit, offset int) ([]Thread, error) {
+	var threads []Thread
+	result := db.Order("last_message_at desc").Limit(limit).Offset(offset).Find(&threads)
+	return threads, result.Error
+}
+
+func (p *Persistence) FindThread(threadId uint64) (*Thread, []Email, error) {
+	var thread Thread
+	if err := db.First(&thread, threadId).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var emails []Email
+	result := db.Omit("content").Where("thread_id = ?", thread.ID).Order("sent_date, id").Find(&emails)
+	return &thread, emails, result.Error
+}
+
+// threadEmail puts a stored email in a thread. Its ancestors decide the
+// thread when we have any of them. Replies that arrived before the email
+// are in threads of their own until then, and those threads are merged
+// into it. A reply without references joins a recent thread with the same
+// subject between the same people.
+func threadEmail(tx *gorm.DB, email *Email) error {
+	ancestors := parseMessageIDs(email.ReferenceIDs)
+	if email.InReplyTo != "" {
+		ancestors = append(ancestors, email.InReplyTo)
+	}
+	if err := createEmailReferences(tx, email.ID, ancestors); err != nil {
+		return err
+	}
+
+	var threadIDs []uint
+	if len(ancestors) > 0 {
+		var found []uint
+		err := tx.Model(&Email{}).
+			Where("message_id IN ? AND thread_id <> 0 AND id <> ?", ancestors, email.ID).
+			Distinct().Pluck("thread_id", &found).Error
+		if err != nil {
+			return err
+		}
+		threadIDs = append(threadIDs, found...)
+	}
+
+	if email.MessageID != "" {
+		var found []uint
+		err := tx.Model(&Email{}).
+			Joins("JOIN email_references ON email_references.email_id = emails.id").
+			Where("email_references.message_id = ? AND emails.thread_id <> 0 AND emails.id <> ?", referenceKey(email.MessageID), email.ID).
+			Distinct().Pluck("emails.thread_id", &found).Error
+		if err != nil {
+			return err
+		}
+		threadIDs = append(threadIDs, found...)
+	}
+
+	subject, isReply := normalizeSubject(email.Subject)
+	mailbox, correspondents := threadParticipants(email)
+	if len(threadIDs) == 0 && isReply && subject != "" && mailbox != "" && len(correspondents) > 0 {
+		// The thread must have mail between the mailbox and one of the
+		// correspondents, received by the mailbox or sent from it.
+		conversation := "emails.thread_id = threads.id AND emails.deleted_at IS NULL AND (" +
+			"(emails.direction <> ? AND emails.mailbox = ? AND emails.`from` IN ?) OR " +
+			"(emails.direction = ? AND emails.`from` = ? AND (" + strings.Repeat("emails.`to` LIKE ? ESCAPE '!' OR ", len(correspondents)-1) + "emails.`to` LIKE ? ESCAPE '!')))"
+		args := []interface{}{EmailOutbound, mailbox, correspondents, EmailOutbound, mailbox}
+		for _, correspondent := range correspondents {
+			args = append(args, containing(correspondent))
+		}
+
+		var thread Thread
+		err := tx.Where("normalized_subject = ? AND last_message_at > ?", subject, email.SentDate.Add(-subjectThreadWindow)).
+			Where("EXISTS (SELECT 1 FROM emails WHERE "+conversation+")", args...).
+			Order("last_message_at desc").First(&thread).Error
+		if err == nil {
+			threadIDs = append(threadIDs, thread.ID)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+	}
+
+	var target uint
+	if len(threadIDs) == 0 {
+		thread := Thread{
+			Subject:           stripSubjectPrefixes(email.Subject),
+			NormalizedSubject: subject,
+		}
+		if err := tx.Create(&thread).Error; err != nil {
+			return err
+		}
+		target = thread.ID
+	} else {
+		target = threadIDs[0]
+		var merged []uint
+		for _, id := range threadIDs {
+			if id < target {
+				target = id
+			}
+		}
+		for _, id := range threadIDs {
+			if id != target {
+				merged = append(merged, id)
+			}
+		}
+		if len(merged) > 0 {
+			if err := tx.Model(&Email{}).Where("thread_id IN ?", merged).Update("thread_id", target).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&Thread{}, merged).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	email.ThreadID = target
+	if err := tx.Model(email).Update("thread_id", target).Error; err != nil {
+		return err
+	}
+	return refreshThread(tx, target)
+}
+
+// threadParticipants returns our address in the conversation of a mail, the
+// mailbox it was received by or the sender of outbound mail, and the
+// addresses on the other side.
+func threadParticipants(email *Email) (string, []string) {
+	if email.Direction == EmailOutbound {
+		var recipients []string
+		for _, recipient := range strings.Split(email.To, ",") {
+			if recipient = strings.TrimSpace(recipient); recipient != "" {
+				recipients = append(recipients, recipient)
+			}
+		}
+		return email.From, recipients
+	}
+
+	mailbox := email.Mailbox
+	if mailbox == "" {
+		mailbox = email.To
+	}
+	if email.From == "" {
+		return mailbox, nil
+	}
+	return mailbox, []string{email.From}
+}
+
+// createEmailReferences stores the message ids a mail refers to.
+func createEmailReferences(tx *gorm.DB, emailID uint, messageIDs []string) error {
+	seen := map[string]bool{}
+	var references []EmailReference
+	for _, messageID := range messageIDs {
+		key := referenceKey(messageID)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		references = append(references, EmailReference{EmailID: emailID, MessageID: key})
+	}
+	if len(references) == 0 {
+		return nil
+	}
+	return tx.Create(&references).Error
+}
+
+// referenceKey is the message id as it is indexed, cut to the size of the
+// column.
+func referenceKey(messageID string) string {
+	if len(messageID) > 255 {
+		return messageID[:255]
+	}
+	return messageID
+}
+
+// migrateEmailReferences creates the table of references, filling it from
+// the stored mail when it is new.
+func migrateEmailReferences(tx *gorm.DB) error {
+	backfill := !tx.Migrator().HasTable(&EmailReference{})
+	if err := tx.AutoMigrate(&EmailReference{}); err != nil || !backfill {
+		return err
+	}
+
+	var emails []Email
+	return tx.Select("id", "in_reply_to", "reference_ids").
+		Where("in_reply_to <> '' OR reference_ids <> ''").
+		FindInBatches(&emails, 500, func(batch *gorm.DB, _ int) error {
+			for _, email := range emails {
+				ancestors := parseMessageIDs(email.ReferenceIDs)
+				if email.InReplyTo != "" {
+					ancestors = append(ancestors, email.InReplyTo)
+				}
+				if err := createEmailReferences(tx, email.ID, ancestors); err != nil {
+					return err
+				}
+			}
+			return nil
+		}).Error
+}
+
+// refreshThread recounts the messages of a thread after it changed.
+func refreshThread(tx *gorm.DB, threadId uint) error {
+	var count int64
+	if err := tx.Model(&Email{}).Where("thread_id = ?", threadId).Count(&count).Error; err != nil {
+		return err
+	}
+
+	var latest Email
+	if err := tx.Select("sent_date").Where("thread_id = ?", threadId).Order("sent_date desc").First(&latest).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&Thread{}).Where("id = ?", threadId).Updates(map[string]interface{}{
+		"message_count":   count,
+		"last_message_at": latest.SentDate,
+	}).Error
+}
+
+// pruneThread counts a thread again after some of its mail is deleted, and
+// takes its subject from the oldest mail it has left. A thread without mail
+// is deleted.
+func pruneThread(tx *gorm.DB, threadId uint) error {
+	var oldest Email
+	err := tx.Select("subject").Where("thread_id = ?", threadId).Order("sent_date, id").First(&oldest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx.Unscoped().Delete(&Thread{}, threadId).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	subject, _ := normalizeSubject(oldest.Subject)
+	err = tx.Model(&Thread{}).Where("id = ?", threadId).Updates(map[string]interface{}{
+		"subject":            stripSubjectPrefixes(oldest.Subject),
+		"normalized_subject": subject,
+	}).Error
+	if err != nil {
+		return err
+	}
+	return refreshThread(tx, threadId)
+}
+
+// normalizeSubject returns the subject in the form threads are matched by,
+// and tells whether it was marked as a reply or a forward.
+func normalizeSubject(subject string) (string, bool) {
+	stripped := stripSubjectPrefixes(subject)
+	normalized := strings.ToLower(strings.Join(strings.Fields(stripped), " "))
+	return normalized, stripped != strings.TrimSpace(subject)
+}
+
+// stripSubjectPrefixes removes reply and forward prefixes, like "Re: Fwd: ".
+func stripSubjectPrefixes(subject string) string {
+	stripped := strings.TrimSpace(subject)
+	for {
+		next := replyPrefix.ReplaceAllString(stripped, "")
+		if next == stripped {
+			return stripped
+		}
+		stripped = next
+	}
+}
+
+func (m *mailingServerServer) ListThreads(ctx context.Context, request *pb.ListThreadsRequest) (*pb.ListThreadsResponse, error) {
+	limit := int(request.Limit)
+	if limit <= 0 || limit > 1000 {
+		limit = 100
+	}
+
+	threads, err := m.Threads.FindThreads(limit, int(request.Offset))
+	if err != nil {
+		logrus.Errorf("something happened while listing threads: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &pb.ListThreadsResponse{}
+	for i := range threads {
+		response.Threads = append(response.Threads, threadToProto(&threads[i]))
+	}
+	return response, nil
+}
+
+func (m *mailingServerServer) GetThread(ctx context.Context, request *pb.GetThreadRequest) (*pb.GetThreadResponse, error) {
+	thread, emails, err := m.Threads.FindThread(request.ThreadId)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, status.Errorf(codes.NotFound, "thread %d is not found", request.ThreadId)
+		}
+		logrus.Errorf("something happened while fetching the thread: %s", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	byMessageID := map[string]uint{}
+	for _, email := range emails {
+		if email.MessageID != "" {
+			byMessageID[email.MessageID] = email.ID
+		}
+	}
+
+	response := &pb.GetThreadResponse{Thread: threadToProto(thread)}
+	for _, email := range emails {
+		response.Messages = append(response.Messages, &pb.ThreadMessage{
+			MailId:    uint64(email.ID),
+			ParentId:  uint64(threadParent(&email, byMessageID)),
+			From:      email.From,
+			To:        email.To,
+			Subject:   email.Subject,
+			MessageId: email.MessageID,
+			SentDate:  timestamppb.New(email.SentDate),
+			Direction: email.Direction,
+		})
+	}
+	return response, nil
+}
+
+// threadParent is the closest ancestor of the email in its thread: the mail
+// it replies to, or else the last of its references that we have.
+func threadParent(email *Email, byMessageID map[string]uint) uint {
+	if id, ok := byMessageID[email.InReplyTo]; ok && id != email.ID {
+		return id
+	}
+	references := parseMessageIDs(email.ReferenceIDs)
+	for i := len(references) - 1; i >= 0; i-- {
+		if id, ok := byMessageID[references[i]]; ok && id != email.ID {
+			return id
+		}
+	}
+	return 0
+}
+
+func threadToProto(thread *Thread) *pb.Thread {
+	return &pb.Thread{
+		Id:            uint64(thread.ID),
+		Subject:       thread.Subject,
+		MessageCount:  uint32(thread.MessageCount),
+		LastMessageAt: timestamppb.New(thread.LastMessageAt),
+	}
+}
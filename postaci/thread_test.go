@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/aliparlakci/mailproxy/postaci/protobuf"
+)
+
+func TestThreadingMergesRepliesThatArriveFirst(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+	server := &mailingServerServer{Threads: persistence}
+
+	sent := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	emails := []*Email{
+		{MessageID: "reply@thread.test", InReplyTo: "root@thread.test", ReferenceIDs: "<root@thread.test>", Subject: "Re: Threading", SentDate: sent.Add(time.Hour), From: "ali@thread.test", Mailbox: "veli@thread.test", Direction: EmailInbound},
+		{MessageID: "root@thread.test", Subject: "Threading", SentDate: sent, From: "veli@thread.test", To: "ali@thread.test", Direction: EmailOutbound},
+		{MessageID: "late@thread.test", Subject: "RE: threading", SentDate: sent.Add(2 * time.Hour), From: "ali@thread.test", Mailbox: "veli@thread.test", Direction: EmailInbound},
+		{MessageID: "other@thread.test", Subject: "Something else", SentDate: sent, From: "ali@thread.test", Mailbox: "veli@thread.test", Direction: EmailInbound},
+		{MessageID: "stranger@thread.test", Subject: "Re: Threading", SentDate: sent.Add(2 * time.Hour), From: "stranger@thread.test", Mailbox: "veli@thread.test", Direction: EmailInbound},
+		{MessageID: "elsewhere@thread.test", Subject: "Re: Threading", SentDate: sent.Add(2 * time.Hour), From: "ali@thread.test", Mailbox: "deniz@thread.test", Direction: EmailInbound},
+	}
+	for _, email := range emails {
+		if err := persistence.CreateEmail(email); err != nil {
+			t.Fatalf("cannot store the email: %s", err)
+		}
+	}
+
+	if emails[0].ThreadID != emails[1].ThreadID {
+		t.Fatalf("expected the root to join the thread of its reply")
+	}
+	if emails[2].ThreadID != emails[1].ThreadID {
+		t.Errorf("expected a reply without references to be threaded by subject")
+	}
+	for _, email := range emails[3:] {
+		if email.ThreadID == emails[1].ThreadID {
+			t.Errorf("expected %s to have a thread of its own", email.MessageID)
+		}
+	}
+
+	response, err := server.GetThread(context.Background(), &pb.GetThreadRequest{ThreadId: uint64(emails[1].ThreadID)})
+	if err != nil {
+		t.Fatalf("cannot get the thread: %s", err)
+	}
+	if response.Thread.MessageCount != 3 || response.Thread.Subject != "Threading" {
+		t.Errorf("unexpected thread %+v", response.Thread)
+	}
+	if len(response.Messages) != 3 || response.Messages[0].MailId != uint64(emails[1].ID) ||
+		response.Messages[1].ParentId != uint64(emails[1].ID) || response.Messages[2].ParentId != 0 {
+		t.Errorf("unexpected thread messages %+v", response.Messages)
+	}
+}
+
+func TestThreadingBySubjectMatchesCorrespondentsLiterally(t *testing.T) {
+	persistence := &Persistence{}
+	persistence.InitializeTesting()
+
+	sent := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	emails := []*Email{
+		{MessageID: "wild-root@thread.test", Subject: "Wildcards", SentDate: sent, From: "veli@wild.test", To: "firstxlast@wild.test", Direction: EmailOutbound},
+		{MessageID: "wild-other@thread.test", Subject: "Re: Wildcards", SentDate: sent.Add(time.Hour), From: "first_last@wild.test", Mailbox: "veli@wild.test", Direction: EmailInbound},
+		{MessageID: "wild-reply@thread.test", Subject: "Re: Wildcards", SentDate: sent.Add(time.Hour), From: "firstxlast@wild.test", Mailbox: "veli@wild.test", Direction: EmailInbound},
+	}
+	for _, email := range emails {
+		if err := persistence.CreateEmail(email); err != nil {
+			t.Fatalf("cannot store the email: %s", err)
+		}
+	}
+
+	if emails[1].ThreadID == emails[0].ThreadID {
+		t.Errorf("expected a reply from someone else not to join the thread")
+	}
+	if emails[2].ThreadID != emails[0].ThreadID {
+		t.Errorf("expected a reply from the correspondent to be threaded by subject")
+	}
+}